@@ -18,7 +18,17 @@ package main
 //  9) User merges two trees (/sync)
 // 10) Server responds with new content for merged tree.
 //
-// Note that connection state is not kept in the server, only on the client.
+// Each of these actions is also available within a named document, as /docs/{name}/{action}. The
+// routes above act on the default document.
+//
+// Note that connection state is not kept in the server, only on the client, except for sites
+// that opt in to auto-sync (/autosync). In that case, the server merges changes from the chosen
+// sites as soon as they happen.
+//
+// Every change to a site is pushed to all connected clients via server-sent events (/events), as
+// a list of index-based operations from the previous version of the content. Since clients may
+// edit a site while a change is being pushed, each edit carries the version of the content it was
+// based on, and the server maps its indices to the chars that existed at that version.
 
 import (
 	"encoding/json"
@@ -28,12 +38,17 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
 
+	"github.com/google/uuid"
+
 	"github.com/brunokim/causal-tree/crdt"
+	"github.com/brunokim/causal-tree/diff"
 )
 
 var (
@@ -56,16 +71,29 @@ const (
 
 type debugMessage struct {
 	msgType debugMsgType
-	payload interface{}
+	payload []byte
 }
 
 // -----
 
 type treeinfo struct {
-	id    string
-	site  *crdt.CausalTree
-	mu    *sync.Mutex
-	order int
+	id       string
+	site     *crdt.CausalTree
+	mu       *sync.Mutex
+	order    int
+	versions *versionLog
+}
+
+func newTreeinfo(site *crdt.CausalTree, order int) treeinfo {
+	tree := treeinfo{
+		id:       site.SiteID.String(),
+		site:     site,
+		mu:       &sync.Mutex{},
+		order:    order,
+		versions: &versionLog{wefts: make(map[int]map[uuid.UUID]uint32)},
+	}
+	tree.versions.add(site.Sitemap, site.Now())
+	return tree
 }
 
 func sortTreeinfos(trees []treeinfo) {
@@ -74,36 +102,45 @@ func sortTreeinfos(trees []treeinfo) {
 	})
 }
 
+// state holds the sites of a single document.
 type state struct {
 	sync.Mutex
 
+	name string
+	// Tracks requests that are using this document, so that it's only closed after they finish.
+	requests sync.WaitGroup
+
 	debugMsgs chan<- debugMessage
+	events    *hub
 
 	treemap sync.Map // map[string]treeinfo
 	maplen  int
 
+	// Map from a site ID to the site IDs it automatically syncs from.
+	autosync map[string][]string
+
 	numLoadRequests int
 	numEditRequests int
 	numForkRequests int
 	numSyncRequests int
 }
 
-func newState(debugMsgs chan<- debugMessage) *state {
-	site := crdt.NewCausalTree()
-	siteID := site.SiteID.String()
-	tree := treeinfo{
-		id:    siteID,
-		site:  site,
-		mu:    &sync.Mutex{},
-		order: 0,
-	}
-	var treemap sync.Map
-	treemap.Store(siteID, tree)
-	return &state{
+func newState(name string, debugMsgs chan<- debugMessage) *state {
+	s := &state{
+		name:      name,
 		debugMsgs: debugMsgs,
-		treemap:   treemap,
+		events:    newHub(),
 		maplen:    1,
+		autosync:  make(map[string][]string),
 	}
+	// The document is a single string, created with the first site and shared by its forks.
+	site := crdt.NewCausalTree()
+	if _, err := site.SetString(); err != nil {
+		panic(fmt.Sprintf("newState: %v", err))
+	}
+	tree := newTreeinfo(site, 0)
+	s.treemap.Store(tree.id, tree)
+	return s
 }
 
 func (s *state) treeinfos() []treeinfo {
@@ -119,18 +156,62 @@ func (s *state) treeinfos() []treeinfo {
 
 // -----
 
+// Number of versions kept for each site. Edits based on older versions are rejected.
+const maxVersions = 256
+
+// versionLog records the wefts of the latest versions of a site's content.
+//
+// Wefts are keyed by site UUID, since site indices change as the tree learns about new sites.
+type versionLog struct {
+	last  int
+	wefts map[int]map[uuid.UUID]uint32
+}
+
+// Records a new version, returning its number.
+func (l *versionLog) add(sitemap []uuid.UUID, weft crdt.Weft) int {
+	l.last++
+	m := make(map[uuid.UUID]uint32)
+	for i, siteID := range sitemap {
+		m[siteID] = weft[i]
+	}
+	l.wefts[l.last] = m
+	delete(l.wefts, l.last-maxVersions)
+	return l.last
+}
+
+// Returns a view of the tree at the given version, if it's still known.
+func (l *versionLog) view(t *crdt.CausalTree, version int) (*crdt.CausalTree, bool) {
+	m, ok := l.wefts[version]
+	if !ok {
+		return nil, false
+	}
+	weft := make(crdt.Weft, len(t.Sitemap))
+	for i, siteID := range t.Sitemap {
+		weft[i] = m[siteID]
+	}
+	view, err := t.ViewAt(weft)
+	if err != nil {
+		log.Printf("Error viewing version %d: %v", version, err)
+		return nil, false
+	}
+	return view, true
+}
+
+// -----
+
 func main() {
 	flag.Parse()
 
-	debugMsgs := runDebug()
-	s := newState(debugMsgs)
+	srv := newServer()
 
 	http.Handle("/", http.FileServer(http.Dir(*staticDir)))
 	http.Handle("/debug/", http.StripPrefix("/debug", http.FileServer(http.Dir(*debugDir))))
-	http.Handle("/load", loadHTTPHandler{s})
-	http.Handle("/edit", editHTTPHandler{s})
-	http.Handle("/fork", forkHTTPHandler{s})
-	http.Handle("/sync", syncHTTPHandler{s})
+	http.Handle("/docs", srv)
+	http.Handle("/docs/", srv)
+	// Routes for the default document, kept for compatibility.
+	for _, action := range []string{"load", "edit", "fork", "sync", "autosync", "events"} {
+		http.Handle("/"+action, srv.actionHandler(defaultDoc, action))
+	}
 
 	addr := fmt.Sprintf(":%d", *port)
 	log.Printf("Serving in %s\n", addr)
@@ -141,9 +222,31 @@ func main() {
 
 type treeResponse struct {
 	ID      string `json:"id"`
+	Version int    `json:"version"`
 	Content string `json:"content"`
 }
 
+// Returns the current version and content of a tree. The caller must hold the tree's lock.
+func treeResp(tree treeinfo) treeResponse {
+	return treeResponse{
+		ID:      tree.id,
+		Version: tree.versions.last,
+		Content: tree.site.ToString(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, name string, x interface{}) {
+	bs, err := json.Marshal(x)
+	if err != nil {
+		log.Printf("Error marshaling %s response: %v", name, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%s error: %v", name, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
+
 type loadResponse struct {
 	Trees []treeResponse `json:"trees"`
 }
@@ -173,21 +276,11 @@ func (s *state) handleLoad(w http.ResponseWriter) {
 	trees := s.treeinfos()
 	resp.Trees = make([]treeResponse, len(trees))
 	for i, tree := range trees {
-		resp.Trees[i] = treeResponse{
-			ID:      tree.id,
-			Content: tree.site.ToString(),
-		}
-	}
-	bs, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("Error marshaling load response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "load error: %v", err)
-		return
+		tree.mu.Lock()
+		resp.Trees[i] = treeResp(tree)
+		tree.mu.Unlock()
 	}
-	// Write response and update internal state.
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(bs)
+	writeJSON(w, "load", resp)
 	// Write debug info.
 	s.writeDebug(map[string]interface{}{
 		"Type":    "loadStep",
@@ -200,8 +293,9 @@ func (s *state) handleLoad(w http.ResponseWriter) {
 // -----
 
 type editRequest struct {
-	ID  string          `json:"id"`
-	Ops []editOperation `json:"ops"`
+	ID      string          `json:"id"`
+	Version int             `json:"version"`
+	Ops     []editOperation `json:"ops"`
 }
 
 type editOperation struct {
@@ -210,6 +304,14 @@ type editOperation struct {
 	Dist int    `json:"dist"`
 }
 
+// editResponse contains the site's content after applying an edit. ViewVersion represents the
+// content the client had after the edit, without any concurrent changes, so that further edits
+// may be based on it.
+type editResponse struct {
+	treeResponse
+	ViewVersion int `json:"viewVersion"`
+}
+
 type editHTTPHandler struct {
 	s *state
 }
@@ -222,13 +324,10 @@ func (h editHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	h.s.handleEdit(w, editReq)
+	h.s.propagate(editReq.ID)
 }
 
 func (s *state) handleEdit(w http.ResponseWriter, req *editRequest) {
-	s.writeDebug(map[string]interface{}{
-		"Type":    "edit",
-		"Request": req,
-	})
 	defer s.syncDebug()
 	// Retrieve tree from ID and acquire its lock.
 	id := req.ID
@@ -242,25 +341,78 @@ func (s *state) handleEdit(w http.ResponseWriter, req *editRequest) {
 	tree := val.(treeinfo)
 	tree.mu.Lock()
 	defer tree.mu.Unlock()
-	// Get ID of this edit call.
+	// Find chars as seen by the client.
+	view, ok := tree.versions.view(tree.site, req.Version)
+	if !ok {
+		log.Printf("%s: unknown version %d", id, req.Version)
+		w.WriteHeader(http.StatusConflict)
+		writeJSON(w, "edit", treeResp(tree))
+		return
+	}
+	chars := view.CharIDs()
+	if n := countBaseChars(req.Ops); n != len(chars) {
+		log.Printf("%s: edit expects %d chars, version %d has %d", id, n, req.Version, len(chars))
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "edit error: expected %d chars, version %d has %d", n, req.Version, len(chars))
+		return
+	}
+	// Get ID of this edit call. The debug info contains the chars seen by the client, so that
+	// the edit may be replayed without knowing about versions.
 	s.Lock()
 	numRequests := s.numEditRequests
 	s.numEditRequests++
 	s.Unlock()
+	s.writeDebug(map[string]interface{}{
+		"Type":    "edit",
+		"Request": req,
+		"Base":    chars,
+	})
+	str, err := docString(tree.site)
+	if err != nil {
+		log.Printf("%s: %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "edit error: %v", err)
+		return
+	}
+	// Keep a copy of the tree, to be restored if any operation fails, so that a partial edit is
+	// never seen by clients.
+	backup, err := tree.site.ViewAt(tree.site.Now())
+	if err != nil {
+		log.Printf("%s: %v", id, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "edit error: %v", err)
+		return
+	}
+	backup.Timestamp = tree.site.Timestamp
+	base, before := tree.versions.last, tree.site.ToString()
 	// Execute operations in tree.
 	var i int
+	var prev crdt.AtomID
 	for j, op := range req.Ops {
+		var err error
 		switch op.Op {
 		case "keep":
+			prev = chars[i]
 			i++
 		case "insert":
 			ch, _ := utf8.DecodeRuneInString(op.Char)
-			tree.site.InsertCharAt(ch, i-1)
-			log.Printf("%s: operation = insertCharAt %c %d", id, ch, i-1)
-			i++
+			var char *crdt.Char
+			if char, err = insertAfter(tree.site, str, prev, ch); err == nil {
+				log.Printf("%s: operation = insertChar %c after %v", id, ch, prev)
+				prev = char.ID()
+			}
 		case "delete":
-			tree.site.DeleteAt(i)
-			log.Printf("%s: operation = deleteCharAt %d", id, i)
+			if err = tree.site.DeleteAtom(chars[i]); err == nil {
+				log.Printf("%s: operation = delete %v", id, chars[i])
+			}
+			i++
+		}
+		if err != nil {
+			*tree.site = *backup
+			log.Printf("%s: operation #%d (%s) failed: %v", id, j, op.Op, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "edit error: operation #%d (%s): %v", j, op.Op, err)
+			return
 		}
 		// Dump trees into debug file.
 		if op.Op != "keep" {
@@ -273,11 +425,57 @@ func (s *state) handleEdit(w http.ResponseWriter, req *editRequest) {
 			})
 		}
 	}
+	// Record the client's view, if it lacks concurrent changes, and the current version.
+	var viewVersion int
+	if req.Version != base {
+		viewWeft := view.Now()
+		for k, siteID := range view.Sitemap {
+			if siteID == tree.site.SiteID {
+				viewWeft[k] = tree.site.Timestamp
+			}
+		}
+		viewVersion = tree.versions.add(view.Sitemap, viewWeft)
+	}
+	version := s.publish(tree, base, before)
+	if viewVersion == 0 {
+		viewVersion = version
+	}
 	// Write response with current tree content.
-	content := tree.site.ToString()
-	w.Header().Set("Content-Type", "text/plain")
-	io.WriteString(w, content)
-	log.Printf("%s: value     = %s", id, content)
+	resp := editResponse{treeResp(tree), viewVersion}
+	writeJSON(w, "edit", resp)
+	log.Printf("%s: value     = %s", id, resp.Content)
+}
+
+// Returns the document's string, which is the only child of the root.
+func docString(t *crdt.CausalTree) (*crdt.String, error) {
+	if len(t.Weave) == 0 {
+		return nil, fmt.Errorf("tree has no string")
+	}
+	return t.StringValue(t.Weave[0].ID)
+}
+
+// Inserts a char after the char with ID prev, or at the start of the string if prev is zero.
+func insertAfter(t *crdt.CausalTree, str *crdt.String, prev crdt.AtomID, ch rune) (*crdt.Char, error) {
+	cur := str.Cursor()
+	if prev != (crdt.AtomID{}) {
+		char, err := t.CharValue(prev)
+		if err != nil {
+			return nil, err
+		}
+		cur = char.GetStringCursor()
+	}
+	return cur.Insert(ch)
+}
+
+// Returns the number of chars that an edit expects in the original content.
+func countBaseChars(ops []editOperation) int {
+	var n int
+	for _, op := range ops {
+		if op.Op == "keep" || op.Op == "delete" {
+			n++
+		}
+	}
+	return n
 }
 
 // -----
@@ -332,28 +530,11 @@ func (s *state) handleFork(w http.ResponseWriter, req *forkRequest) {
 		fmt.Fprintf(w, "fork error: %v", err)
 		return
 	}
-	remoteID := remote.SiteID.String()
-	s.treemap.Store(remoteID, treeinfo{
-		id:    remoteID,
-		site:  remote,
-		mu:    &sync.Mutex{},
-		order: order,
-	})
+	remoteTree := newTreeinfo(remote, order)
+	s.treemap.Store(remoteTree.id, remoteTree)
 	log.Printf("%s: fork      = %s", tree.site.SiteID, remote.SiteID)
 	// Write response
-	resp := treeResponse{
-		ID:      remoteID,
-		Content: remote.ToString(),
-	}
-	bs, err := json.Marshal(resp)
-	if err != nil {
-		log.Printf("Error marshaling fork response: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "fork error: %v", err)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(bs)
+	writeJSON(w, "fork", treeResp(remoteTree))
 	// Write debug info.
 	s.writeDebug(map[string]interface{}{
 		"Type":      "forkStep",
@@ -370,6 +551,10 @@ func (s *state) handleFork(w http.ResponseWriter, req *forkRequest) {
 type syncRequest struct {
 	LocalID   string   `json:"id"`
 	RemoteIDs []string `json:"mergeIds"`
+	// Whether this request was made by the server due to auto-sync.
+	Auto bool `json:"auto,omitempty"`
+
+	numRequest int
 }
 
 type syncHTTPHandler struct {
@@ -384,73 +569,348 @@ func (h syncHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	h.s.handleSync(w, syncReq)
+	h.s.propagate(syncReq.LocalID)
 }
 
 func (s *state) handleSync(w http.ResponseWriter, req *syncRequest) {
-	s.writeDebug(map[string]interface{}{
-		"Type":    "sync",
-		"Request": req,
-	})
+	local, remotes, err := s.syncTrees(req)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "sync error: %v", err)
+		return
+	}
 	defer s.syncDebug()
-	//
-	s.Lock()
-	numRequests := s.numSyncRequests
-	s.numSyncRequests++
-	s.Unlock()
-	//
+	for i, remote := range remotes {
+		if _, err := s.merge(local, remote, req, i); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "sync error: %v", err)
+			return
+		}
+	}
+	local.mu.Lock()
+	defer local.mu.Unlock()
+	writeJSON(w, "sync", treeResp(local))
+}
+
+// Retrieves the trees in a sync request, and writes its debug info.
+func (s *state) syncTrees(req *syncRequest) (treeinfo, []treeinfo, error) {
 	val, ok := s.treemap.Load(req.LocalID)
 	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "unknown ID %q", req.LocalID)
-		return
+		return treeinfo{}, nil, fmt.Errorf("unknown ID %q", req.LocalID)
 	}
 	local := val.(treeinfo)
+	remotes := make([]treeinfo, len(req.RemoteIDs))
 	for i, remoteID := range req.RemoteIDs {
 		val, ok := s.treemap.Load(remoteID)
 		if !ok {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprintf(w, "unknown remote frontend ID: %q", remoteID)
-			return
+			return treeinfo{}, nil, fmt.Errorf("unknown remote frontend ID: %q", remoteID)
 		}
-		remote := val.(treeinfo)
+		remotes[i] = val.(treeinfo)
+	}
+	s.Lock()
+	req.numRequest = s.numSyncRequests
+	s.numSyncRequests++
+	s.Unlock()
+	s.writeDebug(map[string]interface{}{
+		"Type":    "sync",
+		"Request": req,
+	})
+	return local, remotes, nil
+}
+
+// Merges remote into local, publishing the changes if there are any. Returns whether there
+// were new atoms.
+func (s *state) merge(local, remote treeinfo, req *syncRequest, stepIdx int) (bool, error) {
+	if local.mu == remote.mu {
+		// A site has nothing to learn from itself.
+		return false, nil
+	}
+	lockAll(local, remote)
+	defer unlockAll(local, remote)
+	base, before := local.versions.last, local.site.ToString()
+	n := len(local.site.Weave)
+	if err := local.site.Merge(remote.site); err != nil {
+		log.Printf("%s: merge     = %s: %v", local.id, remote.id, err)
+		return false, err
+	}
+	log.Printf("%s: merge     = %s", local.id, remote.id)
+	// Write debug info. Merges without new atoms are also written, since they still update
+	// the tree's timestamp.
+	s.writeDebug(map[string]interface{}{
+		"Type":      "syncStep",
+		"ReqIdx":    req.numRequest,
+		"StepIdx":   stepIdx,
+		"Sites":     s.debugTrees(),
+		"LocalIdx":  local.order,
+		"RemoteIdx": remote.order,
+	})
+	if len(local.site.Weave) == n {
+		// No new atoms.
+		return false, nil
+	}
+	s.publish(local, base, before)
+	return true, nil
+}
+
+// -----
+
+type autosyncRequest struct {
+	LocalID   string   `json:"id"`
+	RemoteIDs []string `json:"mergeIds"`
+}
 
-		lockAll(local, remote)
-		local.site.Merge(remote.site)
-		unlockAll(local, remote)
+type autosyncHTTPHandler struct {
+	s *state
+}
 
-		log.Printf("%s: merge     = %s", req.LocalID, remoteID)
-		// Write debug info.
-		s.writeDebug(map[string]interface{}{
-			"Type":      "syncStep",
-			"ReqIdx":    numRequests,
-			"StepIdx":   i,
-			"Sites":     s.debugTrees(),
-			"LocalIdx":  local.order,
-			"RemoteIdx": remote.order,
-		})
+func (h autosyncHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	parser := json.NewDecoder(req.Body)
+	autosyncReq := &autosyncRequest{}
+	if err := parser.Decode(autosyncReq); err != nil {
+		log.Printf("Error parsing body in /autosync: %v", err)
+		return
+	}
+	if err := h.s.handleAutosync(autosyncReq); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "autosync error: %v", err)
+		return
 	}
-	w.Header().Set("Content-Type", "text/plain")
-	io.WriteString(w, local.site.ToString())
+	w.WriteHeader(http.StatusNoContent)
+	h.s.propagate(autosyncReq.RemoteIDs...)
+}
+
+// Sets the sites that a site automatically syncs from. An empty list disables auto-sync.
+func (s *state) handleAutosync(req *autosyncRequest) error {
+	for _, id := range append([]string{req.LocalID}, req.RemoteIDs...) {
+		if _, ok := s.treemap.Load(id); !ok {
+			return fmt.Errorf("unknown ID %q", id)
+		}
+	}
+	for _, id := range req.RemoteIDs {
+		if id == req.LocalID {
+			return fmt.Errorf("site %q can't auto-sync from itself", id)
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(req.RemoteIDs) == 0 {
+		delete(s.autosync, req.LocalID)
+	} else {
+		s.autosync[req.LocalID] = req.RemoteIDs
+	}
+	log.Printf("%s: autosync  = %v", req.LocalID, req.RemoteIDs)
+	return nil
+}
+
+// Merges changes from the given sites into the sites that auto-sync from them, and so on
+// transitively. This terminates even with cycles, because merges that bring no new atoms are
+// not propagated further.
+func (s *state) propagate(ids ...string) {
+	for len(ids) > 0 {
+		id := ids[0]
+		ids = ids[1:]
+		for _, localID := range s.autosyncFrom(id) {
+			req := &syncRequest{LocalID: localID, RemoteIDs: []string{id}, Auto: true}
+			local, remotes, err := s.syncTrees(req)
+			if err != nil {
+				log.Printf("Error in autosync: %v", err)
+				continue
+			}
+			changed, err := s.merge(local, remotes[0], req, 0)
+			if err != nil {
+				log.Printf("Error in autosync: %v", err)
+			} else if changed {
+				ids = append(ids, localID)
+			}
+			s.syncDebug()
+		}
+	}
+}
+
+// Returns the sites that auto-sync from the given site, in ascending order.
+func (s *state) autosyncFrom(id string) []string {
+	s.Lock()
+	defer s.Unlock()
+	var localIDs []string
+	for localID, remoteIDs := range s.autosync {
+		for _, remoteID := range remoteIDs {
+			if remoteID == id {
+				localIDs = append(localIDs, localID)
+				break
+			}
+		}
+	}
+	sort.Strings(localIDs)
+	return localIDs
 }
 
 // -----
 
-// Lock mutexes in ascending order.
+// updateEvent is pushed to clients whenever a site's content changes. Ops transform the content
+// at version Base into the content at Version.
+type updateEvent struct {
+	ID      string          `json:"id"`
+	Base    int             `json:"base"`
+	Version int             `json:"version"`
+	Ops     []editOperation `json:"ops"`
+	Content string          `json:"content"`
+}
+
+var opNames = map[diff.OpType]string{
+	diff.Keep:   "keep",
+	diff.Insert: "insert",
+	diff.Delete: "delete",
+}
+
+// Records a new version of a tree, and pushes the changes since the base version to clients.
+// The caller must hold the tree's lock.
+func (s *state) publish(tree treeinfo, base int, before string) int {
+	version := tree.versions.add(tree.site.Sitemap, tree.site.Now())
+	after := tree.site.ToString()
+	if before == after {
+		return version
+	}
+	ops, err := diff.Diff(before, after)
+	if err != nil {
+		log.Printf("Error computing diff for %s: %v", tree.id, err)
+		return version
+	}
+	event := updateEvent{
+		ID:      tree.id,
+		Base:    base,
+		Version: version,
+		Ops:     make([]editOperation, len(ops)),
+		Content: after,
+	}
+	for i, op := range ops {
+		event.Ops[i] = editOperation{
+			Op:   opNames[op.Op],
+			Char: string(op.Char),
+			Dist: op.Dist,
+		}
+	}
+	bs, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error marshaling event: %v", err)
+		return version
+	}
+	s.events.broadcast(bs)
+	return version
+}
+
+// hub keeps the channels of connected clients.
+type hub struct {
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+}
+
+func newHub() *hub {
+	return &hub{clients: make(map[chan []byte]struct{})}
+}
+
+// Returns a channel for a new client. The channel is closed if the hub is closed.
+func (h *hub) subscribe() chan []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan []byte, 64)
+	if h.clients == nil {
+		close(ch)
+		return ch
+	}
+	h.clients[ch] = struct{}{}
+	return ch
+}
+
+func (h *hub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, ch)
+}
+
+// Sends a message to all clients, without blocking. Slow clients miss messages, which is
+// fine since every event also contains the full content.
+func (h *hub) broadcast(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// Disconnects all clients.
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.clients {
+		close(ch)
+	}
+	h.clients = nil
+}
+
+type eventsHTTPHandler struct {
+	s *state
+}
+
+// Streams update events to a client, until it disconnects.
+func (h eventsHTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "events error: streaming not supported")
+		return
+	}
+	ch := h.s.events.subscribe()
+	defer h.s.events.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(w, "event: update\ndata: %s\n\n", msg)
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// -----
+
+// Lock mutexes in ascending order. Repeated trees are locked only once.
 func lockAll(trees ...treeinfo) {
-	sortTreeinfos(trees)
-	for _, tree := range trees {
+	for _, tree := range uniqueTreeinfos(trees) {
 		tree.mu.Lock()
 	}
 }
 
-// Unlock mutexes in descending order.
+// Unlock mutexes in descending order. Repeated trees are unlocked only once.
 func unlockAll(trees ...treeinfo) {
-	sortTreeinfos(trees)
+	trees = uniqueTreeinfos(trees)
 	for i := len(trees) - 1; i >= 0; i-- {
 		trees[i].mu.Unlock()
 	}
 }
 
+// Sorts trees in ascending order, removing repeated ones.
+func uniqueTreeinfos(trees []treeinfo) []treeinfo {
+	sortTreeinfos(trees)
+	var unique []treeinfo
+	for i, tree := range trees {
+		if i == 0 || tree.mu != trees[i-1].mu {
+			unique = append(unique, tree)
+		}
+	}
+	return unique
+}
+
 // -----
 
 func (s *state) debugTrees() []*crdt.CausalTree {
@@ -469,12 +929,20 @@ func (s *state) isDebug() bool {
 	return s.debugMsgs != nil
 }
 
+// Writes a debug record. The record is marshaled immediately, so that it contains the trees
+// as they are at this step, even if they are changed before the record is written.
 func (s *state) writeDebug(x interface{}) {
-	if s.isDebug() {
-		s.debugMsgs <- debugMessage{
-			msgType: writeDebug,
-			payload: x,
-		}
+	if !s.isDebug() {
+		return
+	}
+	bs, err := json.Marshal(x)
+	if err != nil {
+		log.Printf("Error while writing to debug file: %v", err)
+		return
+	}
+	s.debugMsgs <- debugMessage{
+		msgType: writeDebug,
+		payload: bs,
 	}
 }
 
@@ -484,8 +952,9 @@ func (s *state) syncDebug() {
 	}
 }
 
-func runDebug() chan<- debugMessage {
-	f := createDebug()
+// Starts writing debug messages for a document, until the returned channel is closed.
+func runDebug(name string) chan<- debugMessage {
+	f := createDebug(name)
 	if f == nil {
 		return nil
 	}
@@ -497,12 +966,8 @@ func runDebug() chan<- debugMessage {
 			}
 			switch msg.msgType {
 			case writeDebug:
-				if bs, err := json.Marshal(msg.payload); err != nil {
-					log.Printf("Error while writing to debug file: %v", err)
-				} else {
-					f.Write(bs)
-					f.WriteString("\n")
-				}
+				f.Write(msg.payload)
+				f.WriteString("\n")
 			case syncDebug:
 				f.Sync()
 			}
@@ -512,7 +977,9 @@ func runDebug() chan<- debugMessage {
 	return ch
 }
 
-func createDebug() *os.File {
+// Creates the debug file for a document. The default document uses the debug filename as is, and
+// other documents append their name to it, e.g., log_{{datetime}}_{{name}}.jsonl.
+func createDebug(name string) *os.File {
 	if !*debug && *debugFilename == "" {
 		return nil
 	}
@@ -520,7 +987,12 @@ func createDebug() *os.File {
 		datetime := time.Now().Format("2006-01-02T15:04:05")
 		*debugFilename = fmt.Sprintf("log_%s.jsonl", datetime)
 	}
-	debugFile, err := os.Create(*debugFilename)
+	filename := *debugFilename
+	if name != defaultDoc {
+		ext := filepath.Ext(filename)
+		filename = fmt.Sprintf("%s_%s%s", strings.TrimSuffix(filename, ext), name, ext)
+	}
+	debugFile, err := os.Create(filename)
 	if err != nil {
 		log.Printf("Error opening debug file: %v", err)
 		return nil
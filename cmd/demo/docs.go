@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Name of the document used by routes without a /docs/{name} prefix.
+const defaultDoc = "default"
+
+var docNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var (
+	errInvalidDocName = errors.New("document names must have 1-64 letters, digits, '_' or '-'")
+	errDocNotFound    = errors.New("document not found")
+)
+
+// server holds all documents, and routes requests to them:
+//
+//	GET    /docs                 lists documents
+//	DELETE /docs/{name}          deletes a document, closing its debug log and event streams
+//	POST   /docs/{name}/{action} runs a demo action (load, edit, fork, sync, autosync) in a document
+//	GET    /docs/{name}/events   streams update events from a document
+//
+// Documents are created on their first load, except for the default document, which always
+// exists at startup.
+type server struct {
+	mu   sync.Mutex
+	docs map[string]*state
+}
+
+func newServer() *server {
+	return &server{docs: map[string]*state{
+		defaultDoc: newState(defaultDoc, runDebug(defaultDoc)),
+	}}
+}
+
+// Returns a document, registering a new request with it. The caller must call
+// s.requests.Done() when the request finishes.
+func (srv *server) acquire(name string, create bool) (*state, error) {
+	if !docNameRE.MatchString(name) {
+		return nil, errInvalidDocName
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	s, ok := srv.docs[name]
+	if !ok {
+		if !create {
+			return nil, errDocNotFound
+		}
+		s = newState(name, runDebug(name))
+		srv.docs[name] = s
+		log.Printf("%s: new document", name)
+	}
+	s.requests.Add(1)
+	return s, nil
+}
+
+// Removes a document. Its resources are released after all pending requests finish.
+func (srv *server) deleteDoc(name string) error {
+	srv.mu.Lock()
+	s, ok := srv.docs[name]
+	delete(srv.docs, name)
+	srv.mu.Unlock()
+	if !ok {
+		return errDocNotFound
+	}
+	s.events.close()
+	go func() {
+		s.requests.Wait()
+		if s.isDebug() {
+			close(s.debugMsgs)
+		}
+		log.Printf("%s: deleted document", name)
+	}()
+	return nil
+}
+
+type docResponse struct {
+	Name     string `json:"name"`
+	NumSites int    `json:"numSites"`
+}
+
+type listResponse struct {
+	Docs []docResponse `json:"docs"`
+}
+
+// Returns all documents, in ascending order of name.
+func (srv *server) list() listResponse {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	resp := listResponse{Docs: []docResponse{}}
+	for name, s := range srv.docs {
+		s.Lock()
+		numSites := s.maplen
+		s.Unlock()
+		resp.Docs = append(resp.Docs, docResponse{name, numSites})
+	}
+	sort.Slice(resp.Docs, func(i, j int) bool {
+		return resp.Docs[i].Name < resp.Docs[j].Name
+	})
+	return resp
+}
+
+func (srv *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/docs"), "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "" && req.Method == http.MethodGet:
+		writeJSON(w, "list", srv.list())
+	case len(parts) == 1 && req.Method == http.MethodDelete:
+		if err := srv.deleteDoc(parts[0]); err != nil {
+			writeDocError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2:
+		srv.actionHandler(parts[0], parts[1]).ServeHTTP(w, req)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "docs error: unknown route %s %s", req.Method, req.URL.Path)
+	}
+}
+
+// Returns a handler that runs an action within a document.
+func (srv *server) actionHandler(name, action string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s, err := srv.acquire(name, action == "load")
+		if err != nil {
+			writeDocError(w, err)
+			return
+		}
+		var h http.Handler
+		switch action {
+		case "load":
+			h = loadHTTPHandler{s}
+		case "edit":
+			h = editHTTPHandler{s}
+		case "fork":
+			h = forkHTTPHandler{s}
+		case "sync":
+			h = syncHTTPHandler{s}
+		case "autosync":
+			h = autosyncHTTPHandler{s}
+		case "events":
+			// Event streams are long-lived, and are closed when the document is deleted,
+			// so they don't count as pending requests.
+			s.requests.Done()
+			eventsHTTPHandler{s}.ServeHTTP(w, req)
+			return
+		default:
+			s.requests.Done()
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, "docs error: unknown action %q", action)
+			return
+		}
+		defer s.requests.Done()
+		h.ServeHTTP(w, req)
+	})
+}
+
+func writeDocError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDocNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	fmt.Fprintf(w, "docs error: %v", err)
+}
@@ -1,11 +1,19 @@
-import { diff } from "./diff.js";
+import { diff, applyOps, mapIndex } from "./diff.js";
 
 export class CrdtController {
-  constructor(parent_controller, id, content) {
+  constructor(parent_controller, id, content, version) {
     this.id = id || crypto.randomUUID();
     this.parent_controller = parent_controller;
     this.view = null;
+    // Content of this site at the given version, as known by the server.
     this.content = content || "";
+    this.version = version || 0;
+    this.autosync = false;
+    // Only one edit is sent at a time. Changes made while it's in flight are sent afterwards,
+    // and update events are held until then.
+    this.inflight = false;
+    this.sentText = null;
+    this.pendingEvent = null;
   }
 
   render() {
@@ -35,38 +43,102 @@ export class CrdtController {
   }
 
   textInput(evt) {
-    let textarea = $(evt.target);
-    let content = textarea.val();
+    if (this.inflight) {
+      return;
+    }
+    this.sendEdit();
+  }
 
-    if (content == this.content) {
+  sendEdit() {
+    let text = this.textarea().val();
+    if (text == this.content) {
       return;
     }
-    let ops = diff(this.content, content);
-    this.content = content;
+    let ops = diff(this.content, text);
     console.log(ops);
+    this.inflight = true;
+    this.sentText = text;
 
-    let body = { id: this.id, ops: ops };
-    fetch("/edit", {
+    let body = { id: this.id, version: this.version, ops: ops };
+    fetch(this.parent_controller.url("edit"), {
       method: "POST",
       headers: {
-        Accept: "text/plain",
+        Accept: "application/json",
         "Content-Type": "application/json",
       },
       body: JSON.stringify(body),
     })
-      .then((response) => response.text())
-      .then((text) => this.handleEditResponse(text))
-      .catch((err) => console.log(err));
+      .then((response) => {
+        // A conflict means that the edit was based on a version that the server forgot.
+        if (!response.ok && response.status != 409) {
+          return response.text().then((text) => Promise.reject(text));
+        }
+        return response.json();
+      })
+      .then((json) => this.handleEditResponse(json))
+      .catch((err) => {
+        console.log(err);
+        this.inflight = false;
+      });
   }
 
-  handleEditResponse(text) {
-    if (this.content != text) {
+  handleEditResponse(resp) {
+    this.inflight = false;
+    if (!resp.viewVersion) {
       console.log(
-        `ERROR: ${this.id}: got ${text} from server (local: ${this.content})`
+        `ERROR: ${this.id}: edit rejected, resetting to server content`
       );
+      this.setContent(resp.content, resp.version);
+      return;
+    }
+    if (this.textarea().val() != this.sentText) {
+      // Send changes made while the edit was in flight, based on the content
+      // as seen by this client.
+      this.content = this.sentText;
+      this.version = resp.viewVersion;
+      this.sendEdit();
+      return;
+    }
+    this.setContent(resp.content, resp.version);
+    let event = this.pendingEvent;
+    this.pendingEvent = null;
+    if (event) {
+      this.handleUpdateEvent(event);
     }
   }
 
+  // Handles a change pushed by the server. Events for older versions are ignored.
+  handleUpdateEvent(event) {
+    if (event.version <= this.version) {
+      return;
+    }
+    if (this.inflight) {
+      if (!this.pendingEvent || this.pendingEvent.version < event.version) {
+        this.pendingEvent = event;
+      }
+      return;
+    }
+    if (event.base == this.version) {
+      let content = applyOps(this.content, event.ops);
+      this.setContent(content, event.version, event.ops);
+    } else {
+      this.setContent(event.content, event.version);
+    }
+  }
+
+  // Replaces the textarea content, keeping the selection over the same text.
+  setContent(content, version, ops) {
+    let textarea = this.textarea();
+    ops = ops || diff(textarea.val(), content);
+    let start = mapIndex(ops, textarea.prop("selectionStart"));
+    let end = mapIndex(ops, textarea.prop("selectionEnd"));
+    textarea.val(content);
+    textarea.prop("selectionStart", start);
+    textarea.prop("selectionEnd", end);
+    this.content = content;
+    this.version = version;
+  }
+
   // NOTE: sync is just local to the current controller because it's more intuitive for anyone
   // clicking a button in its scope, so it merges in the changes from incoming-connected sites.
   //
@@ -75,27 +147,48 @@ export class CrdtController {
     let mergeIds = this.parent_controller.incomingIds(this);
 
     let body = { id: this.id, mergeIds: mergeIds };
-    fetch("/sync", {
+    fetch(this.parent_controller.url("sync"), {
       method: "POST",
       headers: {
-        Accept: "text/plain",
+        Accept: "application/json",
         "Content-Type": "application/json",
       },
       body: JSON.stringify(body),
     })
-      .then((response) => response.text())
-      .then((text) => this.handleSyncResponse(text))
+      .then((response) => response.json())
+      .then((json) => this.handleSyncResponse(json))
       .catch((err) => console.log(err));
   }
 
-  handleSyncResponse(text) {
-    this.textarea().val(text);
-    this.content = text;
+  handleSyncResponse(tree) {
+    this.handleUpdateEvent({
+      version: tree.version,
+      base: -1,
+      content: tree.content,
+    });
+  }
+
+  setAutosync(isEnabled) {
+    this.autosync = isEnabled;
+    this.updateAutosync();
+  }
+
+  // Asks the server to automatically merge changes from incoming-connected sites.
+  updateAutosync() {
+    let mergeIds = this.autosync
+      ? this.parent_controller.incomingIds(this)
+      : [];
+    let body = { id: this.id, mergeIds: mergeIds };
+    fetch(this.parent_controller.url("autosync"), {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(body),
+    }).catch((err) => console.log(err));
   }
 
   fork() {
     let body = { local: this.id };
-    fetch("/fork", {
+    fetch(this.parent_controller.url("fork"), {
       method: "POST",
       headers: {
         Accept: "application/json",
@@ -109,7 +202,11 @@ export class CrdtController {
   }
 
   handleForkResponse(tree) {
-    let sibling = this.parent_controller.newCrdt(tree.id, tree.content);
+    let sibling = this.parent_controller.newCrdt(
+      tree.id,
+      tree.content,
+      tree.version
+    );
 
     this.parent_controller.connect(this.id, sibling.id);
     this.renderSyncArea();
@@ -118,8 +215,8 @@ export class CrdtController {
     let textarea1 = this.textarea();
     let textarea2 = sibling.textarea();
 
-    // Copy properties of this textarea to forked textarea.
-    textarea2.val(textarea1.val());
+    // Copy selection of this textarea to forked textarea. Its content comes from the server,
+    // and may lack edits that are still in flight.
     textarea2.prop("selectionStart", textarea1.prop("selectionStart"));
     textarea2.prop("selectionEnd", textarea1.prop("selectionEnd"));
     textarea2.prop("selectionDirection", textarea1.prop("selectionDirection"));
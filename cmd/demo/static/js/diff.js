@@ -92,3 +92,50 @@ function choosePath(ch1, ch2, keepPath, insertPath, deletePath) {
   }
   return { op: "delete", ch: ch1, dist: 1 + deletePath.dist };
 }
+
+// Applies a sequence of operations returned by diff(s1, s2) to s1, returning s2.
+export function applyOps(s1, ops) {
+  let chars1 = Array.from(s1);
+  let chars2 = [];
+  let i = 0;
+  for (let op of ops) {
+    if (op.op == "keep") {
+      chars2.push(chars1[i]);
+      i++;
+    } else if (op.op == "delete") {
+      i++;
+    } else if (op.op == "insert") {
+      chars2.push(op.ch);
+    }
+  }
+  return chars2.join("");
+}
+
+// Maps an index in s1 to the corresponding index in s2, given the operations returned by
+// diff(s1, s2). Indices are in UTF-16 code units, like textarea selections.
+//
+// Text inserted exactly at the index ends up after it, so a cursor isn't pushed forward by
+// remote insertions.
+export function mapIndex(ops, index) {
+  let oldPos = 0,
+    newPos = 0;
+  for (let op of ops) {
+    let len = op.ch.length;
+    if (op.op == "insert") {
+      if (oldPos >= index) {
+        break;
+      }
+      newPos += len;
+      continue;
+    }
+    if (oldPos + len > index) {
+      // Index is at or within this char.
+      return op.op == "keep" ? newPos + (index - oldPos) : newPos;
+    }
+    oldPos += len;
+    if (op.op == "keep") {
+      newPos += len;
+    }
+  }
+  return newPos + (index - oldPos);
+}
@@ -0,0 +1,49 @@
+// Lists documents in the server, allowing to open, create and delete them.
+export class DocsController {
+  constructor(container, currentName) {
+    this.container = container;
+    this.currentName = currentName;
+  }
+
+  refresh() {
+    fetch("/docs", { headers: { Accept: "application/json" } })
+      .then((response) => response.json())
+      .then((json) => this.render(json.docs))
+      .catch((err) => console.log(err));
+  }
+
+  render(docs) {
+    let list = $("<ul>");
+    for (let doc of docs) {
+      let item = $("<li>").append(
+        $("<a>", { href: `/?doc=${encodeURIComponent(doc.name)}` }).text(
+          `${doc.name} (${doc.numSites} sites)`
+        )
+      );
+      if (doc.name != this.currentName) {
+        item.append(
+          $("<button>")
+            .text("Delete")
+            .click(() => this.delete(doc.name))
+        );
+      }
+      list.append(item);
+    }
+    let form = $("<form>")
+      .append(
+        $("<input>", {
+          type: "text",
+          name: "doc",
+          placeholder: "New document",
+        })
+      )
+      .append($("<button>", { type: "submit" }).text("Open"));
+    this.container.html("").append(list).append(form);
+  }
+
+  delete(name) {
+    fetch(`/docs/${encodeURIComponent(name)}`, { method: "DELETE" })
+      .then(() => this.refresh())
+      .catch((err) => console.log(err));
+  }
+}
@@ -1,11 +1,28 @@
 import { SitesController } from "./sites_controller.js";
+import { DocsController } from "./docs_controller.js";
 
-let controller = new SitesController($("#crdts"));
+// The document is chosen with the "doc" query parameter, e.g., /?doc=notes.
+let docName =
+  new URLSearchParams(window.location.search).get("doc") || "default";
+$("#doc-name").text(docName);
 
-fetch("/load", {
+let controller = new SitesController($("#crdts"), docName);
+let docsController = new DocsController($("#docs"), docName);
+
+fetch(controller.url("load"), {
   method: "POST",
   headers: { Accept: "application/json" },
 })
   .then((response) => response.json())
   .then((json) => controller.handleLoadResponse(json))
+  .then(() => {
+    // Receive changes to any site as soon as the server makes them.
+    let events = new EventSource(controller.url("events"));
+    events.addEventListener("update", (evt) =>
+      controller.handleUpdateEvent(JSON.parse(evt.data))
+    );
+    // The stream is closed by the server if the document is deleted.
+    events.addEventListener("error", () => events.close());
+  })
+  .then(() => docsController.refresh())
   .catch((err) => console.log(err));
@@ -1,21 +1,34 @@
 import { CrdtController } from "./crdt_controller.js";
 
 export class SitesController {
-  constructor(container) {
+  constructor(container, docName) {
     this.container = container;
+    this.docName = docName;
 
     this.crdts = [];
     this.graph = {};
   }
 
+  // Returns the URL of an action within this document.
+  url(action) {
+    return `/docs/${encodeURIComponent(this.docName)}/${action}`;
+  }
+
   handleLoadResponse(resp) {
     for (let tree of resp.trees) {
-      this.newCrdt(tree.id, tree.content);
+      this.newCrdt(tree.id, tree.content, tree.version);
+    }
+  }
+
+  handleUpdateEvent(event) {
+    let crdt = this.crdts.find((crdt) => crdt.id == event.id);
+    if (crdt) {
+      crdt.handleUpdateEvent(event);
     }
   }
 
-  newCrdt(id, content) {
-    let crdt = new CrdtController(this, id, content);
+  newCrdt(id, content, version) {
+    let crdt = new CrdtController(this, id, content, version);
     this.crdts.push(crdt);
     this.graph[crdt.id] = { inc: new Set(), out: new Set() };
 
@@ -45,6 +58,10 @@ export class SitesController {
     } else {
       this.disconnect(source, dest);
     }
+    let destCrdt = this.crdts.find((crdt) => crdt.id == dest);
+    if (destCrdt.autosync) {
+      destCrdt.updateAutosync();
+    }
 
     // Set the corresponding checkbox in remote.
     let remoteCheckbox = $(
@@ -83,6 +100,15 @@ export class SitesController {
         $("<button>")
           .text("Sync")
           .click((evt) => child.sync())
+      )
+      .append(
+        $("<label>")
+          .append(
+            $("<input>", { type: "checkbox" })
+              .prop("checked", child.autosync)
+              .on("change", (evt) => child.setAutosync(evt.target.checked))
+          )
+          .append("Auto-sync")
       );
 
     for (let crdt of this.crdts) {
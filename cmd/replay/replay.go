@@ -0,0 +1,390 @@
+// Command replay re-executes the requests recorded in a debug log from the demo server, checking
+// that every step produces the same sites as recorded. It reports the first divergence found.
+//
+// A log from a demo session that exposed a bug may then be used as a regression test.
+//
+// Usage:
+//
+//	go run ./cmd/replay [--verbose] log.jsonl
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"unicode/utf8"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+
+	"github.com/brunokim/causal-tree/crdt"
+)
+
+var verbose = flag.Bool("verbose", false, "whether to print every step")
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s [--verbose] log.jsonl\n", os.Args[0])
+		os.Exit(2)
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	var out io.Writer = io.Discard
+	if *verbose {
+		out = os.Stdout
+	}
+	numSteps, err := replay(f, out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("OK: %d steps replayed\n", numSteps)
+}
+
+// -----
+
+// record is a line in the debug log. Request records have a Request, and step records have the
+// request index and the resulting sites.
+type record struct {
+	Type    string
+	Request json.RawMessage
+	// Chars seen by the client in an edit request. Older logs don't have it, and it's null if
+	// there were no chars. In both cases, the edit is applied to the current chars.
+	Base []crdt.AtomID
+	// Fields of step records.
+	ReqIdx    int
+	StepIdx   int
+	LocalIdx  int
+	RemoteIdx int
+	Sites     []json.RawMessage
+}
+
+type editRequest struct {
+	Ops []editOperation `json:"ops"`
+}
+
+type editOperation struct {
+	Op   string `json:"op"`
+	Char string `json:"ch"`
+}
+
+// siteRecord contains the fields of a recorded tree that are needed for replaying.
+type siteRecord struct {
+	SiteID uuid.UUID
+	Weave  []struct {
+		Value json.RawMessage
+	}
+}
+
+// DivergenceError is returned when a replayed site differs from the recorded one.
+type DivergenceError struct {
+	Line int
+	Step string
+	Site int
+	Diff string
+}
+
+func (err *DivergenceError) Error() string {
+	return fmt.Sprintf("line %d: %s: site #%d diverges (-recorded, +replayed):\n%s", err.Line, err.Step, err.Site, err.Diff)
+}
+
+// Progress of an edit request, whose ops are replayed as their steps are found.
+type editState struct {
+	ops     []editOperation
+	base    []crdt.AtomID
+	hasBase bool
+	next    int
+	i       int
+	prev    crdt.AtomID
+}
+
+type replayer struct {
+	sites    []*crdt.CausalTree
+	requests map[string][]record
+	edits    map[int]*editState
+}
+
+// Replays a log, returning the number of steps replayed. Each step is described in w.
+func replay(r io.Reader, w io.Writer) (int, error) {
+	rp := &replayer{
+		requests: make(map[string][]record),
+		edits:    make(map[int]*editState),
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30)
+	var numSteps int
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return numSteps, fmt.Errorf("line %d: %w", line, err)
+		}
+		switch rec.Type {
+		case "load", "edit", "fork", "sync":
+			rp.requests[rec.Type] = append(rp.requests[rec.Type], rec)
+			continue
+		case "test":
+			// Test records don't contain the operation that was run.
+			continue
+		}
+		step := describeStep(rec)
+		fmt.Fprintf(w, "line %d: %s\n", line, step)
+		if err := rp.step(rec); err != nil {
+			return numSteps, fmt.Errorf("line %d: %s: %w", line, step, err)
+		}
+		if err := rp.compare(rec.Sites); err != nil {
+			var divergence *DivergenceError
+			if errors.As(err, &divergence) {
+				divergence.Line = line
+				divergence.Step = step
+				return numSteps, divergence
+			}
+			return numSteps, fmt.Errorf("line %d: %s: %w", line, step, err)
+		}
+		numSteps++
+	}
+	return numSteps, scanner.Err()
+}
+
+func describeStep(rec record) string {
+	switch rec.Type {
+	case "loadStep":
+		return fmt.Sprintf("load request #%d", rec.ReqIdx)
+	case "editStep":
+		return fmt.Sprintf("edit request #%d @ %d at site #%d", rec.ReqIdx, rec.StepIdx, rec.LocalIdx)
+	case "forkStep":
+		return fmt.Sprintf("fork site #%d into site #%d", rec.LocalIdx, rec.RemoteIdx)
+	case "syncStep":
+		return fmt.Sprintf("merge site #%d from site #%d", rec.LocalIdx, rec.RemoteIdx)
+	}
+	return rec.Type
+}
+
+func (rp *replayer) step(rec record) error {
+	if len(rp.sites) == 0 {
+		// Create initial site, with the same ID as recorded.
+		site, err := parseSite(rec.Sites, 0)
+		if err != nil {
+			return err
+		}
+		tree := crdt.NewCausalTreeWithSiteID(site.SiteID)
+		if site.hasString() {
+			if _, err := tree.SetString(); err != nil {
+				return err
+			}
+		}
+		rp.sites = append(rp.sites, tree)
+	}
+	switch rec.Type {
+	case "loadStep":
+		return nil
+	case "editStep":
+		return rp.edit(rec)
+	case "forkStep":
+		return rp.fork(rec)
+	case "syncStep":
+		local, err := rp.site(rec.LocalIdx)
+		if err != nil {
+			return err
+		}
+		remote, err := rp.site(rec.RemoteIdx)
+		if err != nil {
+			return err
+		}
+		return local.Merge(remote)
+	default:
+		return fmt.Errorf("unknown record type %q", rec.Type)
+	}
+}
+
+func (rp *replayer) site(i int) (*crdt.CausalTree, error) {
+	if i < 0 || i >= len(rp.sites) {
+		return nil, fmt.Errorf("site #%d doesn't exist", i)
+	}
+	return rp.sites[i], nil
+}
+
+// Returns whether the recorded site's chars are within a string. Older logs have chars as
+// children of the root.
+func (site siteRecord) hasString() bool {
+	if len(site.Weave) == 0 {
+		return false
+	}
+	str, err := json.Marshal(crdt.InsertStr{})
+	if err != nil {
+		panic(err)
+	}
+	return bytes.Equal(site.Weave[0].Value, str)
+}
+
+func parseSite(sites []json.RawMessage, i int) (siteRecord, error) {
+	var site siteRecord
+	if i < 0 || i >= len(sites) {
+		return site, fmt.Errorf("site #%d not recorded", i)
+	}
+	err := json.Unmarshal(sites[i], &site)
+	return site, err
+}
+
+// Executes the ops of an edit request up to the step's op, in the same way as the demo server.
+func (rp *replayer) edit(rec record) error {
+	site, err := rp.site(rec.LocalIdx)
+	if err != nil {
+		return err
+	}
+	edit, ok := rp.edits[rec.ReqIdx]
+	if !ok {
+		reqs := rp.requests["edit"]
+		if rec.ReqIdx >= len(reqs) {
+			return fmt.Errorf("edit request #%d not recorded", rec.ReqIdx)
+		}
+		var req editRequest
+		if err := json.Unmarshal(reqs[rec.ReqIdx].Request, &req); err != nil {
+			return err
+		}
+		edit = &editState{
+			ops:     req.Ops,
+			base:    reqs[rec.ReqIdx].Base,
+			hasBase: reqs[rec.ReqIdx].Base != nil,
+		}
+		rp.edits[rec.ReqIdx] = edit
+	}
+	if !edit.hasBase {
+		// Older logs apply ops to the content as it was in the start of the request.
+		edit.base, edit.hasBase = site.CharIDs(), true
+	}
+	if rec.StepIdx >= len(edit.ops) {
+		return fmt.Errorf("edit request #%d has only %d ops", rec.ReqIdx, len(edit.ops))
+	}
+	for ; edit.next <= rec.StepIdx; edit.next++ {
+		op := edit.ops[edit.next]
+		if (op.Op == "keep" || op.Op == "delete") && edit.i >= len(edit.base) {
+			return fmt.Errorf("op #%d is out of range", edit.next)
+		}
+		switch op.Op {
+		case "keep":
+			edit.prev = edit.base[edit.i]
+			edit.i++
+		case "insert":
+			ch, _ := utf8.DecodeRuneInString(op.Char)
+			if edit.prev, err = insertChar(site, edit.prev, ch); err != nil {
+				return err
+			}
+		case "delete":
+			if err := deleteChar(site, edit.base[edit.i]); err != nil {
+				return err
+			}
+			edit.i++
+		}
+	}
+	return nil
+}
+
+// Returns the string of a site, or nil if its chars are children of the root.
+func siteString(site *crdt.CausalTree) (*crdt.String, error) {
+	if len(site.Weave) == 0 {
+		return nil, nil
+	}
+	if _, ok := site.Weave[0].Value.(crdt.InsertStr); !ok {
+		return nil, nil
+	}
+	return site.StringValue(site.Weave[0].ID)
+}
+
+// Inserts a char after prev, or at the start if prev is zero, returning the new char's ID.
+// Chars of older logs are inserted with the legacy API, that also moves the tree's cursor.
+func insertChar(site *crdt.CausalTree, prev crdt.AtomID, ch rune) (crdt.AtomID, error) {
+	str, err := siteString(site)
+	if err != nil {
+		return crdt.AtomID{}, err
+	}
+	if str == nil {
+		site.Cursor = prev
+		if err := site.InsertChar(ch); err != nil {
+			return crdt.AtomID{}, err
+		}
+		return site.Cursor, nil
+	}
+	cur := str.Cursor()
+	if prev != (crdt.AtomID{}) {
+		char, err := site.CharValue(prev)
+		if err != nil {
+			return crdt.AtomID{}, err
+		}
+		cur = char.GetStringCursor()
+	}
+	char, err := cur.Insert(ch)
+	if err != nil {
+		return crdt.AtomID{}, err
+	}
+	return char.ID(), nil
+}
+
+// Deletes a char. Chars of older logs are deleted with the legacy API, that also moves the
+// tree's cursor.
+func deleteChar(site *crdt.CausalTree, id crdt.AtomID) error {
+	str, err := siteString(site)
+	if err != nil {
+		return err
+	}
+	if str == nil {
+		site.Cursor = id
+		return site.Delete()
+	}
+	return site.DeleteAtom(id)
+}
+
+func (rp *replayer) fork(rec record) error {
+	local, err := rp.site(rec.LocalIdx)
+	if err != nil {
+		return err
+	}
+	if rec.RemoteIdx != len(rp.sites) {
+		return fmt.Errorf("want fork into site #%d, got #%d", len(rp.sites), rec.RemoteIdx)
+	}
+	site, err := parseSite(rec.Sites, rec.RemoteIdx)
+	if err != nil {
+		return err
+	}
+	remote, err := local.ForkWithSiteID(site.SiteID)
+	if err != nil {
+		return err
+	}
+	rp.sites = append(rp.sites, remote)
+	return nil
+}
+
+// Compares replayed sites with the recorded ones, as JSON values.
+func (rp *replayer) compare(recorded []json.RawMessage) error {
+	if len(recorded) != len(rp.sites) {
+		return fmt.Errorf("recorded %d sites, replayed %d", len(recorded), len(rp.sites))
+	}
+	for i, site := range rp.sites {
+		bs, err := json.Marshal(site)
+		if err != nil {
+			return err
+		}
+		var want, got interface{}
+		if err := json.Unmarshal(recorded[i], &want); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(bs, &got); err != nil {
+			return err
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			return &DivergenceError{Site: i, Diff: diff}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt"
+)
+
+func TestReplay(t *testing.T) {
+	f, err := os.Open("testdata/session.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	numSteps, err := replay(f, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numSteps != 22 {
+		t.Errorf("got %d steps, want 22", numSteps)
+	}
+}
+
+func TestReplayDivergence(t *testing.T) {
+	bs, err := os.ReadFile("testdata/session.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tamper with the timestamp of a site in the last merge.
+	lines := bytes.Split(bytes.TrimSpace(bs), []byte("\n"))
+	lastMerge := -1
+	for i, line := range lines {
+		if bytes.Contains(line, []byte(`"Type":"syncStep"`)) {
+			lastMerge = i
+		}
+	}
+	var rec map[string]interface{}
+	if err := json.Unmarshal(lines[lastMerge], &rec); err != nil {
+		t.Fatal(err)
+	}
+	site := rec["Sites"].([]interface{})[1].(map[string]interface{})
+	site["Timestamp"] = site["Timestamp"].(float64) + 1
+	if lines[lastMerge], err = json.Marshal(rec); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = replay(bytes.NewReader(bytes.Join(lines, []byte("\n"))), io.Discard)
+	var divergence *DivergenceError
+	if !errors.As(err, &divergence) {
+		t.Fatalf("want DivergenceError, got %v", err)
+	}
+	if divergence.Line != lastMerge+1 || divergence.Site != 1 {
+		t.Errorf("got divergence at line %d, site #%d; want line %d, site #1", divergence.Line, divergence.Site, lastMerge+1)
+	}
+}
+
+// Writes a log where chars are within a string, in the same way as the demo server.
+func stringSessionLog(t *testing.T) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	write := func(x map[string]interface{}) {
+		if err := enc.Encode(x); err != nil {
+			t.Fatal(err)
+		}
+	}
+	site := crdt.NewCausalTree()
+	str, err := site.SetString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(map[string]interface{}{"Type": "load"})
+	write(map[string]interface{}{"Type": "loadStep", "Sites": []*crdt.CausalTree{site}})
+	// Type "hi" at the first site.
+	write(map[string]interface{}{
+		"Type":    "edit",
+		"Request": editRequest{Ops: []editOperation{{"insert", "h"}, {"insert", "i"}}},
+	})
+	cur := str.Cursor()
+	for j, ch := range "hi" {
+		if _, err := cur.Insert(ch); err != nil {
+			t.Fatal(err)
+		}
+		write(map[string]interface{}{"Type": "editStep", "StepIdx": j, "Sites": []*crdt.CausalTree{site}})
+	}
+	// Fork and replace "i" with "o" at the second site.
+	remote, err := site.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sites := []*crdt.CausalTree{site, remote}
+	write(map[string]interface{}{"Type": "forkStep", "RemoteIdx": 1, "Sites": sites})
+	write(map[string]interface{}{
+		"Type":    "edit",
+		"Request": editRequest{Ops: []editOperation{{"keep", ""}, {"delete", ""}, {"insert", "o"}}},
+		"Base":    remote.CharIDs(),
+	})
+	remoteStr, err := remote.StringValue(str.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteCur := remoteStr.Cursor()
+	if err := remoteCur.Index(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := remoteCur.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	write(map[string]interface{}{"Type": "editStep", "ReqIdx": 1, "StepIdx": 1, "LocalIdx": 1, "Sites": sites})
+	if _, err := remoteCur.Insert('o'); err != nil {
+		t.Fatal(err)
+	}
+	write(map[string]interface{}{"Type": "editStep", "ReqIdx": 1, "StepIdx": 2, "LocalIdx": 1, "Sites": sites})
+	// Merge the second site into the first.
+	if err := site.Merge(remote); err != nil {
+		t.Fatal(err)
+	}
+	write(map[string]interface{}{"Type": "syncStep", "RemoteIdx": 1, "Sites": sites})
+	if got := site.ToString(); got != "ho" {
+		t.Fatalf("site.ToString() = %q, want %q", got, "ho")
+	}
+	return buf.Bytes()
+}
+
+func TestReplayString(t *testing.T) {
+	numSteps, err := replay(bytes.NewReader(stringSessionLog(t)), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numSteps != 7 {
+		t.Errorf("got %d steps, want 7", numSteps)
+	}
+}
@@ -0,0 +1,254 @@
+package crdt
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidAnchor is returned when an anchor can't be created or resolved.
+var ErrInvalidAnchor = errors.New("invalid anchor")
+
+// +--------+
+// | Anchor |
+// +--------+
+
+// Bias defines to which side of an anchored char a position sticks to.
+type Bias int
+
+const (
+	// BiasLeft anchors a position right after a char. Chars inserted concurrently at this
+	// position will appear after it.
+	BiasLeft Bias = iota
+	// BiasRight anchors a position right before a char. Chars inserted concurrently at this
+	// position will appear before it.
+	BiasRight
+)
+
+func (b Bias) String() string {
+	switch b {
+	case BiasLeft:
+		return "left"
+	case BiasRight:
+		return "right"
+	}
+	return fmt.Sprintf("Bias(%d)", int(b))
+}
+
+// MarshalText encodes the bias as "left" or "right".
+func (b Bias) MarshalText() ([]byte, error) {
+	switch b {
+	case BiasLeft, BiasRight:
+		return []byte(b.String()), nil
+	}
+	return nil, fmt.Errorf("%w: unknown bias %d", ErrInvalidAnchor, int(b))
+}
+
+// UnmarshalText decodes a bias encoded with MarshalText.
+func (b *Bias) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "left":
+		*b = BiasLeft
+	case "right":
+		*b = BiasRight
+	default:
+		return fmt.Errorf("%w: unknown bias %q", ErrInvalidAnchor, text)
+	}
+	return nil
+}
+
+// Anchor is a position between chars of a String, that is stable under concurrent edits.
+//
+// It's attached to a char, and sticks to its left or right side depending on Bias. If the
+// char is deleted, the anchor falls back to the place where the char was, that is, after its
+// nearest non-deleted neighbor to the left.
+//
+// An anchor attached to the string head is either at the start (BiasLeft) or at the end
+// (BiasRight) of the string.
+type Anchor struct {
+	treePosition
+
+	// Store the last known position of the string's head, e.g., InsertStr atom.
+	lastKnownHeadPos int
+	// Bias defines to which side of the char the anchor sticks to.
+	Bias Bias
+}
+
+// Anchor returns an anchor at the given string position, in range [0:Len()].
+//
+// With BiasLeft, the anchor is attached to the char before the position, or to the string
+// head if i is 0. With BiasRight, the anchor is attached to the char after the position, or
+// to the string head if i is Len().
+func (s *String) Anchor(i int, bias Bias) (*Anchor, error) {
+	if i < 0 || i > s.Len() {
+		return nil, fmt.Errorf("%w: index %d out of bounds", ErrInvalidAnchor, i)
+	}
+	pos := s.atomIndex()
+	switch bias {
+	case BiasLeft:
+		if i > 0 {
+			pos = s.charPos(i - 1)
+		}
+	case BiasRight:
+		if i < s.Len() {
+			pos = s.charPos(i)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown bias %d", ErrInvalidAnchor, int(bias))
+	}
+	return &Anchor{newTreePosition(s.t, pos), s.lastKnownPos, bias}, nil
+}
+
+// GetString returns a pointer to the anchor's owner string.
+func (a *Anchor) GetString() *String {
+	return findString(&a.treePosition, &a.lastKnownHeadPos)
+}
+
+// Index returns the anchor's current position within its string, in range [0:Len()].
+func (a *Anchor) Index() int {
+	s := a.GetString()
+	if a.id == s.id {
+		if a.Bias == BiasRight {
+			return s.Len()
+		}
+		return 0
+	}
+	var i int
+	s.walkChars(func(pos int, atom Atom, isDeleted bool) bool {
+		if atom.ID == a.id {
+			if !isDeleted && a.Bias == BiasLeft {
+				i++
+			}
+			return false
+		}
+		if !isDeleted {
+			i++
+		}
+		return true
+	})
+	return i
+}
+
+// Ref returns a reference to the anchor that may be shared with other sites.
+func (a *Anchor) Ref() AnchorRef {
+	id := a.ID()
+	return AnchorRef{
+		Site:      a.site,
+		Index:     id.Index,
+		Timestamp: id.Timestamp,
+		Bias:      a.Bias,
+	}
+}
+
+// AnchorRef is a serializable reference to an anchor, that is independent of a site's sitemap.
+type AnchorRef struct {
+	Site      uuid.UUID `json:"site"`
+	Index     uint32    `json:"index"`
+	Timestamp uint32    `json:"timestamp"`
+	Bias      Bias      `json:"bias"`
+}
+
+// ResolveAnchor returns the anchor for a reference, possibly created in another site.
+// Returns an error if the referenced atom is unknown, or isn't a char or string.
+func (t *CausalTree) ResolveAnchor(ref AnchorRef) (*Anchor, error) {
+	if _, err := ref.Bias.MarshalText(); err != nil {
+		return nil, err
+	}
+	site := siteIndex(t.Sitemap, ref.Site)
+	if site == len(t.Sitemap) || t.Sitemap[site] != ref.Site {
+		return nil, fmt.Errorf("%w: unknown site %v", ErrAtomNotFound, ref.Site)
+	}
+	id := AtomID{Site: uint16(site), Index: ref.Index, Timestamp: ref.Timestamp}
+	i, err := t.findAtom(id)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("%w: anchor can't be attached to root", ErrInvalidAnchor)
+	}
+	p := newTreePosition(t, i)
+	switch v := t.Weave[i].Value.(type) {
+	case InsertStr:
+		return &Anchor{p, i, ref.Bias}, nil
+	case InsertChar:
+		// Find string head among the char's ancestors.
+		head := t.Weave[i]
+		for {
+			if head.Cause.Timestamp == 0 {
+				return nil, fmt.Errorf("%w: char %v is not within a string", ErrInvalidAnchor, id)
+			}
+			head = t.getAtom(head.Cause)
+			if _, ok := head.Value.(InsertStr); ok {
+				break
+			}
+		}
+		return &Anchor{p, t.atomIndex(head.ID), ref.Bias}, nil
+	default:
+		return nil, fmt.Errorf("%w: %v is not a char or string: %T (%v)", ErrInvalidAnchor, id, v, v)
+	}
+}
+
+// +-------+
+// | Range |
+// +-------+
+
+// Range is a selection within a String, delimited by two anchors.
+type Range struct {
+	Start, End *Anchor
+}
+
+// Range returns a range selecting the chars in [start:end) of the string.
+//
+// Chars inserted concurrently at the range limits are not included in it. If the range is
+// empty, both ends are the same anchor, so it remains empty.
+func (s *String) Range(start, end int) (*Range, error) {
+	if start > end {
+		return nil, fmt.Errorf("%w: range start %d is after its end %d", ErrInvalidAnchor, start, end)
+	}
+	if start == end {
+		a, err := s.Anchor(start, BiasLeft)
+		if err != nil {
+			return nil, err
+		}
+		return &Range{a, a}, nil
+	}
+	startAnchor, err := s.Anchor(start, BiasRight)
+	if err != nil {
+		return nil, err
+	}
+	endAnchor, err := s.Anchor(end, BiasLeft)
+	if err != nil {
+		return nil, err
+	}
+	return &Range{startAnchor, endAnchor}, nil
+}
+
+// Indices returns the current positions of the range limits within their string.
+func (r *Range) Indices() (start, end int) {
+	return r.Start.Index(), r.End.Index()
+}
+
+// Ref returns a reference to the range that may be shared with other sites.
+func (r *Range) Ref() RangeRef {
+	return RangeRef{r.Start.Ref(), r.End.Ref()}
+}
+
+// RangeRef is a serializable reference to a range.
+type RangeRef struct {
+	Start AnchorRef `json:"start"`
+	End   AnchorRef `json:"end"`
+}
+
+// ResolveRange returns the range for a reference, possibly created in another site.
+func (t *CausalTree) ResolveRange(ref RangeRef) (*Range, error) {
+	start, err := t.ResolveAnchor(ref.Start)
+	if err != nil {
+		return nil, fmt.Errorf("range start: %w", err)
+	}
+	end, err := t.ResolveAnchor(ref.End)
+	if err != nil {
+		return nil, fmt.Errorf("range end: %w", err)
+	}
+	return &Range{start, end}, nil
+}
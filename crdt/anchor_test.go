@@ -0,0 +1,186 @@
+package crdt_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/uuid"
+)
+
+// Returns a tree with the given string, and the string handle.
+func makeString(t *testing.T, content string) (*crdt.CausalTree, *crdt.String) {
+	tree := crdt.NewCausalTree()
+	str, err := tree.SetString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := str.Cursor()
+	for _, ch := range content {
+		if _, err := cur.Insert(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tree, str
+}
+
+// Runs f on a fork of the tree, and merges it back.
+func editRemote(t *testing.T, tree *crdt.CausalTree, str *crdt.String, f func(cur *crdt.StringCursor) error) {
+	remote, err := tree.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteStr, err := remote.StringValue(str.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f(remoteStr.Cursor()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Merge(remote); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnchor(t *testing.T) {
+	insertAt := func(i int, ch rune) func(cur *crdt.StringCursor) error {
+		return func(cur *crdt.StringCursor) error {
+			if err := cur.Index(i - 1); err != nil {
+				return err
+			}
+			_, err := cur.Insert(ch)
+			return err
+		}
+	}
+	deleteAt := func(i int) func(cur *crdt.StringCursor) error {
+		return func(cur *crdt.StringCursor) error {
+			if err := cur.Index(i); err != nil {
+				return err
+			}
+			return cur.Delete()
+		}
+	}
+	tests := []struct {
+		desc  string
+		index int
+		bias  crdt.Bias
+		edit  func(cur *crdt.StringCursor) error
+		want  int
+	}{
+		{"left, insert at anchor", 2, crdt.BiasLeft, insertAt(2, 'x'), 2},
+		{"right, insert at anchor", 2, crdt.BiasRight, insertAt(2, 'x'), 3},
+		{"left, insert before", 2, crdt.BiasLeft, insertAt(0, 'x'), 3},
+		{"right, insert after", 2, crdt.BiasRight, insertAt(3, 'x'), 2},
+		{"left, delete anchored char", 2, crdt.BiasLeft, deleteAt(1), 1},
+		{"right, delete anchored char", 2, crdt.BiasRight, deleteAt(2), 2},
+		{"left, delete before", 2, crdt.BiasLeft, deleteAt(0), 1},
+		{"start, insert at start", 0, crdt.BiasLeft, insertAt(0, 'x'), 0},
+		{"start, right", 0, crdt.BiasRight, insertAt(0, 'x'), 1},
+		{"end, left", 4, crdt.BiasLeft, insertAt(4, 'x'), 4},
+		{"end, insert at end", 4, crdt.BiasRight, insertAt(4, 'x'), 5},
+		{"end, delete last char", 4, crdt.BiasRight, deleteAt(3), 3},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			tree, str := makeString(t, "abcd")
+			anchor, err := str.Anchor(test.index, test.bias)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := anchor.Index(); got != test.index {
+				t.Errorf("before edit: anchor.Index() = %d (!= %d)", got, test.index)
+			}
+			editRemote(t, tree, str, test.edit)
+			if got := anchor.Index(); got != test.want {
+				t.Errorf("after edit: anchor.Index() = %d (!= %d), str = %q", got, test.want, str.Snapshot())
+			}
+		})
+	}
+}
+
+func TestAnchorRef(t *testing.T) {
+	tree, str := makeString(t, "abcd")
+	remote, err := tree.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rng, err := str.Range(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(rng.Ref())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ref crdt.RangeRef
+	if err := json.Unmarshal(bs, &ref); err != nil {
+		t.Fatal(err)
+	}
+	remoteRange, err := remote.ResolveRange(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start, end := remoteRange.Indices(); start != 1 || end != 3 {
+		t.Errorf("remote range = [%d:%d] (!= [1:3])", start, end)
+	}
+	// Insert chars at both limits in another site.
+	editRemote(t, tree, str, func(cur *crdt.StringCursor) error {
+		for _, i := range []int{2, 0} {
+			if err := cur.Index(i); err != nil {
+				return err
+			}
+			if _, err := cur.Insert('x'); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err := remote.Merge(tree); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := str.Snapshot(), "axbcxd"; got != want {
+		t.Fatalf("str.Snapshot() = %q (!= %q)", got, want)
+	}
+	if start, end := rng.Indices(); start != 2 || end != 4 {
+		t.Errorf("local range = [%d:%d] (!= [2:4])", start, end)
+	}
+	if start, end := remoteRange.Indices(); start != 2 || end != 4 {
+		t.Errorf("remote range = [%d:%d] (!= [2:4])", start, end)
+	}
+}
+
+func TestAnchorErrors(t *testing.T) {
+	tree, str := makeString(t, "abcd")
+	if _, err := str.Anchor(5, crdt.BiasLeft); !errors.Is(err, crdt.ErrInvalidAnchor) {
+		t.Errorf("out of bounds: want ErrInvalidAnchor, got %v", err)
+	}
+	if _, err := str.Range(3, 1); !errors.Is(err, crdt.ErrInvalidAnchor) {
+		t.Errorf("inverted range: want ErrInvalidAnchor, got %v", err)
+	}
+	anchor, err := str.Anchor(1, crdt.BiasLeft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := anchor.Ref()
+	ref.Site = uuid.UUID{}
+	if _, err := tree.ResolveAnchor(ref); !errors.Is(err, crdt.ErrAtomNotFound) {
+		t.Errorf("unknown site: want ErrAtomNotFound, got %v", err)
+	}
+	ref = anchor.Ref()
+	ref.Bias = crdt.Bias(2)
+	if _, err := tree.ResolveAnchor(ref); !errors.Is(err, crdt.ErrInvalidAnchor) {
+		t.Errorf("unknown bias: want ErrInvalidAnchor, got %v", err)
+	}
+	// Char outside of a string.
+	if err := tree.InsertChar('x'); err != nil {
+		t.Fatal(err)
+	}
+	ref = crdt.AnchorRef{Site: tree.SiteID, Index: tree.Cursor.Index, Timestamp: tree.Cursor.Timestamp}
+	if _, err := tree.ResolveAnchor(ref); !errors.Is(err, crdt.ErrInvalidAnchor) {
+		t.Errorf("char outside string: want ErrInvalidAnchor, got %v", err)
+	}
+	if err := json.Unmarshal([]byte(`{"bias":"up"}`), &ref); !errors.Is(err, crdt.ErrInvalidAnchor) {
+		t.Errorf("unmarshal unknown bias: want ErrInvalidAnchor, got %v", err)
+	}
+}
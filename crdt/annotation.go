@@ -0,0 +1,216 @@
+package crdt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidAnnotation is returned when an annotation can't be attached to a string.
+var ErrInvalidAnnotation = errors.New("invalid annotation")
+
+// +-------------+
+// | Annotations |
+// +-------------+
+
+// Annotations attach side-channel values to a range of a string, like a thread of comments.
+//
+// An annotation is an InsertAnnotation container, child of the root, that references the first
+// and last chars of its range. It's not part of the string contents, nor of the tree's JSON, and
+// carries its own replicated values, like the strings of each comment in a thread.
+//
+// The range grows with chars inserted within it, and shrinks as they are deleted. If all chars in
+// the range are deleted the annotation is orphaned, but it remains attached to the place where
+// they were, and may still be retrieved.
+
+// Annotation is a Value attached to a range of a String, containing other values.
+type Annotation struct{ treePosition }
+
+func (*Annotation) isValue() {}
+
+// Annotate attaches a new annotation to the chars in range [start:end).
+// Returns an error if the range is empty or out of bounds [0:Len()].
+func (s *String) Annotate(start, end int) (*Annotation, error) {
+	if start < 0 || start >= end || end > s.Len() {
+		return nil, fmt.Errorf("%w: range [%d:%d) is empty or out of bounds", ErrInvalidAnnotation, start, end)
+	}
+	startID := s.t.Weave[s.charPos(start)].ID
+	endID := s.t.Weave[s.charPos(end-1)].ID
+	i, err := s.t.addAtom(-1, InsertAnnotation{Start: startID, End: endID})
+	if err != nil {
+		return nil, err
+	}
+	return &Annotation{newTreePosition(s.t, i)}, nil
+}
+
+// AnnotationValue returns a wrapper over InsertAnnotation.
+func (t *CausalTree) AnnotationValue(atomID AtomID) (*Annotation, error) {
+	i, err := t.findAtom(atomID)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("%v is not an InsertAnnotation atom: root", atomID)
+	}
+	atom := t.Weave[i]
+	if _, ok := atom.Value.(InsertAnnotation); !ok {
+		return nil, fmt.Errorf("%v is not an InsertAnnotation atom: %T (%v)", atomID, atom, atom)
+	}
+	return &Annotation{newTreePosition(t, i)}, nil
+}
+
+func (a *Annotation) value() InsertAnnotation {
+	return a.t.Weave[a.atomIndex()].Value.(InsertAnnotation)
+}
+
+// GetString returns a pointer to the annotated string.
+func (a *Annotation) GetString() *String {
+	// Find string head among the start char's ancestors.
+	head := a.t.getAtom(a.value().Start)
+	for {
+		if _, ok := head.Value.(InsertStr); ok {
+			break
+		}
+		head = a.t.getAtom(head.Cause)
+	}
+	return &String{newTreePosition(a.t, a.t.atomIndex(head.ID))}
+}
+
+// Range returns the current positions of the annotated chars within their string, as the range
+// [start:end). If the annotation is orphaned, the range is empty and placed where the chars were.
+//
+// Time complexity: O(string block size)
+func (a *Annotation) Range() (start, end int) {
+	offsets := a.GetString().charOffsets()
+	return a.rangeFrom(offsets)
+}
+
+func (a *Annotation) rangeFrom(offsets map[AtomID]charOffset) (start, end int) {
+	v := a.value()
+	return offsets[v.Start].before, offsets[v.End].after
+}
+
+// IsOrphaned returns whether all chars of the annotated range were deleted.
+func (a *Annotation) IsOrphaned() bool {
+	start, end := a.Range()
+	return start == end
+}
+
+// AddString adds an empty string to the annotation, e.g., a new comment of a thread.
+func (a *Annotation) AddString() (*String, error) {
+	i, err := a.t.addAtom(a.atomIndex(), InsertStr{})
+	if err != nil {
+		return nil, err
+	}
+	return &String{newTreePosition(a.t, i)}, nil
+}
+
+// AddCounter adds a new counter to the annotation, e.g., for votes or reactions.
+func (a *Annotation) AddCounter() (*Counter, error) {
+	i, err := a.t.addAtom(a.atomIndex(), InsertCounter{})
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{newTreePosition(a.t, i)}, nil
+}
+
+// Values returns the annotation's non-deleted values, in the order they were added.
+//
+// Time complexity: O(annotation block size)
+func (a *Annotation) Values() []Value {
+	headPos := a.atomIndex()
+	weave := a.t.Weave
+	var values []Value
+	walkCausalBlock2(weave, headPos, func(pos int, atom Atom, isDeleted bool) bool {
+		if atom.Cause != a.id || isDeleted {
+			return true
+		}
+		p := newTreePosition(a.t, pos)
+		switch atom.Value.(type) {
+		case InsertStr:
+			values = append(values, &String{p})
+		case InsertCounter:
+			values = append(values, &Counter{p})
+		}
+		return true
+	})
+	// Siblings are sorted from newest to oldest.
+	for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+	return values
+}
+
+// Delete removes the annotation and all its values, e.g., to resolve a thread.
+func (a *Annotation) Delete() error {
+	_, err := a.t.addAtom(a.atomIndex(), Delete{})
+	return err
+}
+
+// Number of non-deleted chars before and after a char.
+type charOffset struct {
+	before, after int
+}
+
+// Returns the offsets of every char in the string, including deleted ones.
+//
+// Time complexity: O(block size)
+func (s *String) charOffsets() map[AtomID]charOffset {
+	offsets := make(map[AtomID]charOffset)
+	var i int
+	s.walkChars(func(pos int, atom Atom, isDeleted bool) bool {
+		off := charOffset{before: i}
+		if !isDeleted {
+			i++
+		}
+		off.after = i
+		offsets[atom.ID] = off
+		return true
+	})
+	return offsets
+}
+
+// Annotations returns the non-deleted annotations attached to this string, including orphaned
+// ones, in the order they were created.
+//
+// Time complexity: O(atoms)
+func (s *String) Annotations() []*Annotation {
+	return s.annotations(s.charOffsets())
+}
+
+func (s *String) annotations(offsets map[AtomID]charOffset) []*Annotation {
+	var annotations []*Annotation
+	weave := s.t.Weave
+	for i := 0; i < len(weave); i += causalBlockSize(weave[i:]) {
+		v, ok := weave[i].Value.(InsertAnnotation)
+		if !ok {
+			continue
+		}
+		if _, ok := offsets[v.Start]; !ok {
+			continue
+		}
+		if i+1 < len(weave) && isDelete(weave[i+1]) {
+			continue
+		}
+		annotations = append(annotations, &Annotation{newTreePosition(s.t, i)})
+	}
+	// Root children are sorted from newest to oldest.
+	for i, j := 0, len(annotations)-1; i < j; i, j = i+1, j-1 {
+		annotations[i], annotations[j] = annotations[j], annotations[i]
+	}
+	return annotations
+}
+
+// AnnotationsAt returns the non-deleted annotations covering the i-th char, in the order they
+// were created. Orphaned annotations don't cover any char.
+//
+// Time complexity: O(atoms)
+func (s *String) AnnotationsAt(i int) []*Annotation {
+	offsets := s.charOffsets()
+	var annotations []*Annotation
+	for _, a := range s.annotations(offsets) {
+		if start, end := a.rangeFrom(offsets); start <= i && i < end {
+			annotations = append(annotations, a)
+		}
+	}
+	return annotations
+}
@@ -0,0 +1,254 @@
+package crdt_test
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Summary of an annotation, for comparison.
+type annotationInfo struct {
+	Start, End int
+	Orphaned   bool
+	Values     []string
+}
+
+func describeAnnotations(t *testing.T, annotations []*crdt.Annotation) []annotationInfo {
+	t.Helper()
+	var infos []annotationInfo
+	for _, a := range annotations {
+		start, end := a.Range()
+		info := annotationInfo{Start: start, End: end, Orphaned: a.IsOrphaned()}
+		for _, value := range a.Values() {
+			switch v := value.(type) {
+			case *crdt.String:
+				info.Values = append(info.Values, v.Snapshot())
+			case *crdt.Counter:
+				info.Values = append(info.Values, strconv.Itoa(int(v.Snapshot())))
+			default:
+				t.Fatalf("unexpected annotation value %T", value)
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Adds a string with the given contents to the annotation.
+func addComment(t *testing.T, a *crdt.Annotation, text string) {
+	t.Helper()
+	comment, err := a.AddString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := comment.Cursor().InsertString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	tree, str := makeString(t, "hello world")
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	hello, err := str.Annotate(0, 5)
+	must(err)
+	addComment(t, hello, "greeting")
+	addComment(t, hello, "too informal?")
+	world, err := str.Annotate(4, 11)
+	must(err)
+	votes, err := world.AddCounter()
+	must(err)
+	must(votes.Add(3))
+
+	// Annotations don't change the tree contents.
+	if s := tree.ToString(); s != "hello world" {
+		t.Errorf("ToString() = %q, want %q", s, "hello world")
+	}
+	want := []annotationInfo{
+		{0, 5, false, []string{"greeting", "too informal?"}},
+		{4, 11, false, []string{"3"}},
+	}
+	if diff := cmp.Diff(want, describeAnnotations(t, str.Annotations())); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+	// Query by position.
+	for _, test := range []struct {
+		i    int
+		want []crdt.AtomID
+	}{
+		{0, []crdt.AtomID{hello.ID()}},
+		{4, []crdt.AtomID{hello.ID(), world.ID()}},
+		{5, []crdt.AtomID{world.ID()}},
+		{11, nil},
+	} {
+		var got []crdt.AtomID
+		for _, a := range str.AnnotationsAt(test.i) {
+			got = append(got, a.ID())
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("AnnotationsAt(%d) (-want, +got):\n%s", test.i, diff)
+		}
+	}
+
+	// Edit before and within the ranges.
+	must(str.DeleteRange(0, 1))
+	_, err = str.ReplaceRange(1, 1, "--")
+	must(err)
+	if s := str.Snapshot(); s != "e--llo world" {
+		t.Fatalf("Snapshot() = %q, want %q", s, "e--llo world")
+	}
+	// Delete the whole first range, orphaning it.
+	must(str.DeleteRange(0, 6))
+	want = []annotationInfo{
+		{0, 0, true, []string{"greeting", "too informal?"}},
+		{0, 6, false, []string{"3"}},
+	}
+	if diff := cmp.Diff(want, describeAnnotations(t, str.Annotations())); diff != "" {
+		t.Errorf("after edits (-want, +got):\n%s", diff)
+	}
+	if got := str.AnnotationsAt(0); len(got) != 1 || got[0].ID() != world.ID() {
+		t.Errorf("AnnotationsAt(0) = %v, want only %v", got, world.ID())
+	}
+	// Orphaned annotations are still retrievable by ID.
+	a, err := tree.AnnotationValue(hello.ID())
+	must(err)
+	if !a.IsOrphaned() || a.GetString().ID() != str.ID() {
+		t.Errorf("want orphaned annotation on %v", str.ID())
+	}
+
+	// Deleting an annotation removes it and its values.
+	must(world.Delete())
+	want = []annotationInfo{{0, 0, true, []string{"greeting", "too informal?"}}}
+	if diff := cmp.Diff(want, describeAnnotations(t, str.Annotations())); diff != "" {
+		t.Errorf("after delete (-want, +got):\n%s", diff)
+	}
+	must(tree.Validate())
+}
+
+func TestAnnotationsConcurrent(t *testing.T) {
+	tree, str := makeString(t, "abcdef")
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	thread, err := str.Annotate(1, 4)
+	must(err)
+	addComment(t, thread, "q")
+	remote, remoteStr := forkString(t, tree, str)
+	// Local: reply to the thread, and delete its whole range.
+	addComment(t, thread, "a1")
+	must(str.DeleteRange(1, 4))
+	// Remote: reply concurrently, type within the range, and annotate another range.
+	remoteThread, err := remote.AnnotationValue(thread.ID())
+	must(err)
+	addComment(t, remoteThread, "a2")
+	_, err = remoteStr.ReplaceRange(2, 2, "xy")
+	must(err)
+	other, err := remoteStr.Annotate(6, 8)
+	must(err)
+	addComment(t, other, "r")
+	// Merge in both directions.
+	fork, err := remote.Fork()
+	must(err)
+	must(tree.Merge(remote))
+	must(fork.Merge(tree))
+	forkStr, err := fork.StringValue(str.ID())
+	must(err)
+	if s := str.Snapshot(); s != "axyef" {
+		t.Errorf("Snapshot() = %q, want %q", s, "axyef")
+	}
+	// Chars inserted concurrently within the range keep the annotation alive. Concurrent replies
+	// are sorted deterministically.
+	want := []annotationInfo{
+		{1, 3, false, []string{"q", "a2", "a1"}},
+		{3, 5, false, []string{"r"}},
+	}
+	if diff := cmp.Diff(want, describeAnnotations(t, str.Annotations())); diff != "" {
+		t.Errorf("local (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, describeAnnotations(t, forkStr.Annotations())); diff != "" {
+		t.Errorf("remote (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(tree.Weave, fork.Weave); diff != "" {
+		t.Errorf("weaves differ (-local, +remote):\n%s", diff)
+	}
+
+	// Deltas also carry annotations.
+	empty := crdt.NewCausalTree()
+	must(applyDelta(empty, tree))
+	emptyStr, err := empty.StringValue(str.ID())
+	must(err)
+	if diff := cmp.Diff(want, describeAnnotations(t, emptyStr.Annotations())); diff != "" {
+		t.Errorf("delta (-want, +got):\n%s", diff)
+	}
+}
+
+func TestAnnotationErrors(t *testing.T) {
+	_, str := makeString(t, "abc")
+	for _, r := range [][2]int{{1, 1}, {-1, 1}, {0, 4}, {2, 1}} {
+		if _, err := str.Annotate(r[0], r[1]); !errors.Is(err, crdt.ErrInvalidAnnotation) {
+			t.Errorf("Annotate(%d, %d): want %v, got %v", r[0], r[1], crdt.ErrInvalidAnnotation, err)
+		}
+	}
+}
+
+func TestValidateAnnotations(t *testing.T) {
+	tests := []struct {
+		desc    string
+		corrupt func(v *crdt.InsertAnnotation, head, other crdt.AtomID)
+		want    string
+	}{
+		{"valid tree", func(v *crdt.InsertAnnotation, head, other crdt.AtomID) {}, ""},
+		{"start at string head", func(v *crdt.InsertAnnotation, head, other crdt.AtomID) {
+			v.Start = head
+		}, "references non-char"},
+		{"end in other string", func(v *crdt.InsertAnnotation, head, other crdt.AtomID) {
+			v.End = other
+		}, "is not within a single string"},
+		{"unknown end", func(v *crdt.InsertAnnotation, head, other crdt.AtomID) {
+			v.End.Timestamp += 100
+		}, "references unknown char"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			tree, str := makeString(t, "abc")
+			otherStr, err := tree.SetString()
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := otherStr.Cursor().Insert('x')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := str.Annotate(0, 2); err != nil {
+				t.Fatal(err)
+			}
+			for i, atom := range tree.Weave {
+				if v, ok := atom.Value.(crdt.InsertAnnotation); ok {
+					test.corrupt(&v, str.ID(), other.ID())
+					setAtom(tree, i, func(atom *crdt.Atom) { atom.Value = v })
+				}
+			}
+			err = tree.Validate()
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("want no error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, crdt.ErrInvalidTree) || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("want error containing %q, got %v", test.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,352 @@
+package crdt
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/google/uuid"
+)
+
+// Errors returned by counters.
+var (
+	ErrCounterOverflow = errors.New("counter overflow")
+	ErrNotEnoughRights = errors.New("not enough rights to decrement bounded counter")
+	ErrBoundedCounter  = errors.New("operation not supported by bounded counters")
+	ErrInvalidTransfer = errors.New("invalid transfer of counter rights")
+)
+
+// +----------+
+// | Counters |
+// +----------+
+
+// Counters sum 64-bit integers, added as InsertAdd atoms.
+//
+// The counter value is the exact sum of all additions, clamped to the int64 range. Since the sum
+// is exact, it doesn't depend on the order of additions, so all replicas converge to the same
+// value even if it overflows in-between. For example, adding MaxInt64, 1 and -1 results in
+// MaxInt64 in any order.
+//
+// The overflow policy is set when the counter is created, and defines whether local additions
+// that would overflow the counter are accepted.
+//
+// A reset deletes all additions seen by the site, so additions made concurrently are kept.
+//
+// Bounded counters never go below zero, even with concurrent decrements. Each site has a number
+// of decrement rights: it gains rights by incrementing the counter, or by receiving them from
+// other sites with an InsertTransfer, and spends them by decrementing or transferring. Since
+// a site only spends the rights it has seen, and the total rights equal the counter value, the
+// value is never negative. Bounded counters can't be reset, since deleting increments would
+// revoke rights that other sites may have spent concurrently.
+
+// OverflowPolicy defines how a counter handles additions beyond the int64 range.
+type OverflowPolicy int
+
+const (
+	// OverflowSaturate accepts all additions, and the counter value saturates at the limits
+	// of the int64 range.
+	OverflowSaturate OverflowPolicy = iota
+	// OverflowError rejects additions that would overflow the counter with ErrCounterOverflow.
+	// Concurrent additions from other sites may still overflow it, in which case the value
+	// saturates.
+	OverflowError
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowSaturate:
+		return "saturate"
+	case OverflowError:
+		return "error"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// MarshalText encodes the policy as "saturate" or "error".
+func (p OverflowPolicy) MarshalText() ([]byte, error) {
+	switch p {
+	case OverflowSaturate, OverflowError:
+		return []byte(p.String()), nil
+	}
+	return nil, fmt.Errorf("unknown overflow policy %d", int(p))
+}
+
+// UnmarshalText decodes a policy encoded with MarshalText.
+func (p *OverflowPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "saturate":
+		*p = OverflowSaturate
+	case "error":
+		*p = OverflowError
+	default:
+		return fmt.Errorf("unknown overflow policy %q", text)
+	}
+	return nil
+}
+
+// Exact sum of int64 values, stored as a wrapped int64 and the number of times it wrapped
+// around the int64 range.
+type counterSum struct {
+	sum   int64
+	wraps int64
+}
+
+func (s *counterSum) add(val int64) {
+	sum := s.sum + val
+	if val > 0 && sum < s.sum {
+		s.wraps++
+	} else if val < 0 && sum > s.sum {
+		s.wraps--
+	}
+	s.sum = sum
+}
+
+// Returns whether the exact sum is outside the int64 range.
+func (s counterSum) overflows() bool {
+	return s.wraps != 0
+}
+
+// Returns the sum, clamped to the int64 range.
+func (s counterSum) value() int64 {
+	switch {
+	case s.wraps > 0:
+		return math.MaxInt64
+	case s.wraps < 0:
+		return math.MinInt64
+	}
+	return s.sum
+}
+
+// ---- Counter value
+
+// Counter is a Value representing a sum of integers.
+type Counter struct{ treePosition }
+
+func (*Counter) isValue() {}
+
+// Invokes f with the weave position and value of each addition that wasn't reset, and with
+// each transfer of rights.
+func (c *Counter) walkOps(f func(pos int, atom Atom)) {
+	c.walk(func(pos int, atom Atom, isDeleted bool) bool {
+		switch atom.Value.(type) {
+		case InsertCounter:
+		case InsertAdd, InsertTransfer:
+			if !isDeleted {
+				f(pos, atom)
+			}
+		default:
+			panic(fmt.Sprintf("unexpected atom type in Counter: %T", atom.Value))
+		}
+		return true
+	})
+}
+
+// Returns the exact sum of all values added to the counter.
+func (c *Counter) sum() counterSum {
+	var sum counterSum
+	c.walkOps(func(pos int, atom Atom) {
+		if add, ok := atom.Value.(InsertAdd); ok {
+			sum.add(add.Value)
+		}
+	})
+	return sum
+}
+
+// Snapshot returns the sum of all values added to the counter, clamped to the int64 range.
+// Ignores whether the counter was deleted.
+func (c *Counter) Snapshot() int64 {
+	return c.sum().value()
+}
+
+func (c *Counter) value() InsertCounter {
+	return c.t.Weave[c.atomIndex()].Value.(InsertCounter)
+}
+
+// Policy returns the counter's overflow policy.
+func (c *Counter) Policy() OverflowPolicy {
+	return c.value().Overflow
+}
+
+// IsBounded returns whether the counter never goes below zero.
+func (c *Counter) IsBounded() bool {
+	return c.value().Bounded
+}
+
+// Add adds a value to the counter.
+// Returns an error if atom insertion failed, if the counter would overflow with the
+// OverflowError policy, or if the site doesn't have enough rights to decrement a bounded counter.
+func (c *Counter) Add(val int64) error {
+	_, err := c.add(val)
+	return err
+}
+
+// Adds a value to the counter, and returns the weave position of the new atom.
+func (c *Counter) add(val int64) (int, error) {
+	pos := c.atomIndex()
+	if c.Policy() == OverflowError {
+		sum := c.sum()
+		sum.add(val)
+		if sum.overflows() {
+			return -1, fmt.Errorf("%w: adding %d to %d", ErrCounterOverflow, val, c.Snapshot())
+		}
+	}
+	if val < 0 && c.IsBounded() {
+		if err := c.spendRights(-val); err != nil {
+			return -1, err
+		}
+	}
+	return c.t.addAtom(pos, InsertAdd{val})
+}
+
+// Reset zeroes the counter, by removing all additions seen by this site. Additions made
+// concurrently by other sites are kept.
+// Returns an error for bounded counters.
+func (c *Counter) Reset() error {
+	if c.IsBounded() {
+		return fmt.Errorf("%w: reset", ErrBoundedCounter)
+	}
+	var positions []int
+	c.walkOps(func(pos int, atom Atom) {
+		if _, ok := atom.Value.(InsertAdd); ok {
+			positions = append(positions, pos)
+		}
+	})
+	if len(positions) == 0 {
+		return nil
+	}
+	return c.t.deleteAtoms(positions)
+}
+
+// ---- Bounded counter rights
+
+// Returns the rights of a site, creating them if needed.
+func siteRights(rights map[uuid.UUID]*counterSum, site uuid.UUID) *counterSum {
+	if _, ok := rights[site]; !ok {
+		rights[site] = new(counterSum)
+	}
+	return rights[site]
+}
+
+// Returns the rights of each site, as seen by this site.
+func (c *Counter) rights() map[uuid.UUID]*counterSum {
+	rights := make(map[uuid.UUID]*counterSum)
+	c.walkOps(func(pos int, atom Atom) {
+		site := c.t.Sitemap[atom.ID.Site]
+		switch v := atom.Value.(type) {
+		case InsertAdd:
+			siteRights(rights, site).add(v.Value)
+		case InsertTransfer:
+			siteRights(rights, site).add(-v.Value)
+			siteRights(rights, v.To).add(v.Value)
+		}
+	})
+	return rights
+}
+
+// Rights returns the amount this site may decrement or transfer from a bounded counter.
+// Returns MaxInt64 for unbounded counters, that may be decremented freely.
+func (c *Counter) Rights() int64 {
+	if !c.IsBounded() {
+		return math.MaxInt64
+	}
+	if r, ok := c.rights()[c.t.SiteID]; ok {
+		return r.value()
+	}
+	return 0
+}
+
+// Returns an error if this site can't spend the given amount of rights.
+func (c *Counter) spendRights(val int64) error {
+	if r := c.Rights(); r < val {
+		return fmt.Errorf("%w: spending %d, but site has %d", ErrNotEnoughRights, val, r)
+	}
+	return nil
+}
+
+// Transfer gives decrement rights of a bounded counter from this site to another site, e.g., to
+// a site that needs to decrement it while disconnected.
+// Returns an error if the counter is unbounded, if the value is not positive, if the site is
+// this same site, or if this site doesn't have enough rights.
+func (c *Counter) Transfer(site uuid.UUID, val int64) error {
+	if !c.IsBounded() {
+		return fmt.Errorf("%w: counter is unbounded", ErrInvalidTransfer)
+	}
+	if val <= 0 {
+		return fmt.Errorf("%w: value %d is not positive", ErrInvalidTransfer, val)
+	}
+	if site == c.t.SiteID {
+		return fmt.Errorf("%w: can't transfer to own site", ErrInvalidTransfer)
+	}
+	if err := c.spendRights(val); err != nil {
+		return err
+	}
+	_, err := c.t.addAtom(c.atomIndex(), InsertTransfer{site, val})
+	return err
+}
+
+// Returns an error if the atom is an addition to a bounded counter, that can't be deleted
+// since that would revoke rights that other sites may have spent concurrently.
+func (t *CausalTree) checkDeleteAdd(atom Atom) error {
+	if _, ok := atom.Value.(InsertAdd); !ok {
+		return nil
+	}
+	head := atom
+	for {
+		if counter, ok := head.Value.(InsertCounter); ok {
+			if counter.Bounded {
+				return fmt.Errorf("%w: deleting addition %v", ErrBoundedCounter, atom.ID)
+			}
+			return nil
+		}
+		if head.Cause.Timestamp == 0 {
+			return nil
+		}
+		head = t.getAtom(head.Cause)
+	}
+}
+
+// ---- CausalTree methods
+
+// CounterValue returns a wrapper over InsertCounter.
+func (t *CausalTree) CounterValue(atomID AtomID) (*Counter, error) {
+	i, err := t.findAtom(atomID)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("%v is not an InsertCounter atom: root", atomID)
+	}
+	atom := t.Weave[i]
+	if _, ok := atom.Value.(InsertCounter); !ok {
+		return nil, fmt.Errorf("%v is not an InsertCounter atom: %T (%v)", atomID, atom, atom)
+	}
+	return &Counter{newTreePosition(t, i)}, nil
+}
+
+// SetCounter sets the tree register to a new saturating counter and returns it.
+func (t *CausalTree) SetCounter() (*Counter, error) {
+	return t.SetCounterWithOverflow(OverflowSaturate)
+}
+
+// SetCounterWithOverflow sets the tree register to a new counter with the given overflow
+// policy, and returns it.
+func (t *CausalTree) SetCounterWithOverflow(policy OverflowPolicy) (*Counter, error) {
+	return t.setCounter(InsertCounter{Overflow: policy})
+}
+
+// SetBoundedCounter sets the tree register to a new bounded counter, that never goes below
+// zero, and returns it.
+func (t *CausalTree) SetBoundedCounter() (*Counter, error) {
+	return t.setCounter(InsertCounter{Bounded: true})
+}
+
+func (t *CausalTree) setCounter(value InsertCounter) (*Counter, error) {
+	if _, err := value.Overflow.MarshalText(); err != nil {
+		return nil, err
+	}
+	i, err := t.addAtom(-1, value)
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{newTreePosition(t, i)}, nil
+}
@@ -0,0 +1,384 @@
+package crdt_test
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCounterOverflow(t *testing.T) {
+	tests := []struct {
+		desc   string
+		policy crdt.OverflowPolicy
+		vals   []int64
+		want   int64
+		// Index of the first rejected value, or -1.
+		errAt int
+	}{
+		{"saturate up", crdt.OverflowSaturate, []int64{math.MaxInt64, 1, 10}, math.MaxInt64, -1},
+		{"saturate down", crdt.OverflowSaturate, []int64{math.MinInt64, -1}, math.MinInt64, -1},
+		{"exact sum", crdt.OverflowSaturate, []int64{math.MaxInt64, 1, -1}, math.MaxInt64, -1},
+		{"back in range", crdt.OverflowSaturate, []int64{math.MaxInt64, math.MaxInt64, math.MinInt64, math.MinInt64}, -2, -1},
+		{"large values", crdt.OverflowError, []int64{1 << 40, 1 << 40}, 1 << 41, -1},
+		{"error up", crdt.OverflowError, []int64{math.MaxInt64, 1}, math.MaxInt64, 1},
+		{"error down", crdt.OverflowError, []int64{-1, math.MinInt64}, -1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			tree := crdt.NewCausalTree()
+			counter, err := tree.SetCounterWithOverflow(test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p := counter.Policy(); p != test.policy {
+				t.Errorf("Policy() = %v, want %v", p, test.policy)
+			}
+			for i, val := range test.vals {
+				err := counter.Add(val)
+				if i == test.errAt {
+					if !errors.Is(err, crdt.ErrCounterOverflow) {
+						t.Fatalf("Add(%d): want %v, got %v", val, crdt.ErrCounterOverflow, err)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatalf("Add(%d): %v", val, err)
+				}
+			}
+			if got := counter.Snapshot(); got != test.want {
+				t.Errorf("Snapshot() = %d, want %d", got, test.want)
+			}
+			// Counters are rendered without loss of precision.
+			want := strconv.FormatInt(test.want, 10)
+			if s := tree.ToString(); s != want {
+				t.Errorf("ToString() = %q, want %q", s, want)
+			}
+			bs, err := tree.ToJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []json.Number
+			if err := json.Unmarshal(bs, &got); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff([]json.Number{json.Number(want)}, got); diff != "" {
+				t.Errorf("ToJSON() (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCounterConcurrentOverflow(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	counter, err := tree.SetCounterWithOverflow(crdt.OverflowError)
+	must(err)
+	must(counter.Add(math.MaxInt64 - 10))
+	remote, err := tree.Fork()
+	must(err)
+	remoteCounter, err := remote.CounterValue(counter.ID())
+	must(err)
+	// Both additions are valid locally, but overflow once merged.
+	must(counter.Add(10))
+	must(remoteCounter.Add(10))
+	must(tree.Merge(remote))
+	if got := counter.Snapshot(); got != math.MaxInt64 {
+		t.Errorf("Snapshot() = %d, want %d", got, int64(math.MaxInt64))
+	}
+	if err := counter.Add(1); !errors.Is(err, crdt.ErrCounterOverflow) {
+		t.Errorf("Add(1): want %v, got %v", crdt.ErrCounterOverflow, err)
+	}
+	// Decrements bring the exact sum back in range.
+	must(counter.Add(-20))
+	if got, want := counter.Snapshot(), int64(math.MaxInt64-10); got != want {
+		t.Errorf("Snapshot() = %d, want %d", got, want)
+	}
+	// The policy is part of the counter, so it is the same in all replicas.
+	if p := remoteCounter.Policy(); p != crdt.OverflowError {
+		t.Errorf("remote Policy() = %v, want %v", p, crdt.OverflowError)
+	}
+}
+
+func TestCounterLegacyOverflow(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	counter, err := tree.SetCounterWithOverflow(crdt.OverflowError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The legacy API follows the counter's policy.
+	tree.Cursor = counter.ID()
+	if err := tree.InsertAdd(1 << 62); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := tree.InsertAdd(1 << 62); !errors.Is(err, crdt.ErrCounterOverflow) {
+			t.Errorf("InsertAdd #%d: want %v, got %v", i, crdt.ErrCounterOverflow, err)
+		}
+	}
+	if got, want := counter.Snapshot(), int64(1<<62); got != want {
+		t.Errorf("Snapshot() = %d, want %d", got, want)
+	}
+}
+
+func TestCounterInvalidPolicy(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	if _, err := tree.SetCounterWithOverflow(crdt.OverflowPolicy(42)); err == nil {
+		t.Errorf("want error for unknown policy")
+	}
+	if _, err := tree.SetCounterWithOverflow(crdt.OverflowError); err != nil {
+		t.Fatal(err)
+	}
+	setAtom(tree, 0, func(atom *crdt.Atom) { atom.Value = crdt.InsertCounter{Overflow: 42} })
+	if err := tree.Validate(); !errors.Is(err, crdt.ErrInvalidTree) {
+		t.Errorf("want %v, got %v", crdt.ErrInvalidTree, err)
+	}
+}
+
+func TestCounterReset(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	counter, err := tree.SetCounter()
+	must(err)
+	must(counter.Add(10))
+	must(counter.Add(-3))
+	remote, err := tree.Fork()
+	must(err)
+	remoteCounter, err := remote.CounterValue(counter.ID())
+	must(err)
+	// Remote increments concurrently with the reset.
+	must(remoteCounter.Add(5))
+	must(counter.Reset())
+	if got := counter.Snapshot(); got != 0 {
+		t.Errorf("after reset: Snapshot() = %d, want 0", got)
+	}
+	must(counter.Add(2))
+	other, err := remote.Fork()
+	must(err)
+	must(tree.Merge(remote))
+	must(other.Merge(tree))
+	otherCounter, err := other.CounterValue(counter.ID())
+	must(err)
+	// Only the increments unseen by the reset are kept.
+	for _, c := range []*crdt.Counter{counter, otherCounter} {
+		if got := c.Snapshot(); got != 7 {
+			t.Errorf("after merge: Snapshot() = %d, want 7", got)
+		}
+	}
+	if s := tree.ToString(); s != "7" {
+		t.Errorf("ToString() = %q, want %q", s, "7")
+	}
+	must(counter.Reset())
+	must(counter.Reset())
+	if got := counter.Snapshot(); got != 0 {
+		t.Errorf("after second reset: Snapshot() = %d, want 0", got)
+	}
+	must(tree.Validate())
+}
+
+func TestBoundedCounter(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	counter, err := tree.SetBoundedCounter()
+	must(err)
+	if !counter.IsBounded() {
+		t.Fatalf("IsBounded() = false")
+	}
+	must(counter.Add(10))
+	remote, err := tree.Fork()
+	must(err)
+	remoteCounter, err := remote.CounterValue(counter.ID())
+	must(err)
+	// Remote has no rights: increments are allowed, but not decrements beyond them.
+	if err := remoteCounter.Add(-1); !errors.Is(err, crdt.ErrNotEnoughRights) {
+		t.Errorf("remote Add(-1): want %v, got %v", crdt.ErrNotEnoughRights, err)
+	}
+	must(remoteCounter.Add(2))
+	must(remoteCounter.Add(-2))
+	// Local transfers some rights to remote.
+	must(counter.Transfer(remote.SiteID, 4))
+	if r := counter.Rights(); r != 6 {
+		t.Errorf("local Rights() = %d, want 6", r)
+	}
+	must(remote.Merge(tree))
+	if r := remoteCounter.Rights(); r != 4 {
+		t.Errorf("remote Rights() = %d, want 4", r)
+	}
+	// Both sites decrement concurrently as much as they can.
+	must(counter.Add(-6))
+	must(remoteCounter.Add(-4))
+	for _, c := range []*crdt.Counter{counter, remoteCounter} {
+		if err := c.Add(-1); !errors.Is(err, crdt.ErrNotEnoughRights) {
+			t.Errorf("Add(-1): want %v, got %v", crdt.ErrNotEnoughRights, err)
+		}
+	}
+	must(tree.Merge(remote))
+	if got := counter.Snapshot(); got != 0 {
+		t.Errorf("Snapshot() = %d, want 0", got)
+	}
+	// Bounded counters can't be reset.
+	if err := counter.Reset(); !errors.Is(err, crdt.ErrBoundedCounter) {
+		t.Errorf("Reset(): want %v, got %v", crdt.ErrBoundedCounter, err)
+	}
+	must(tree.Validate())
+}
+
+func TestBoundedCounterRightsBypass(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	counter, err := tree.SetBoundedCounter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The legacy API can't decrement beyond the site's rights.
+	tree.Cursor = counter.ID()
+	if err := tree.InsertAdd(-100); !errors.Is(err, crdt.ErrNotEnoughRights) {
+		t.Errorf("InsertAdd(-100): want %v, got %v", crdt.ErrNotEnoughRights, err)
+	}
+	if err := tree.InsertAdd(5); err != nil {
+		t.Fatal(err)
+	}
+	inc := tree.Cursor
+	if err := counter.Add(-5); err != nil {
+		t.Fatal(err)
+	}
+	// Deleting an increment would revoke spent rights.
+	if err := tree.DeleteAtom(inc); !errors.Is(err, crdt.ErrBoundedCounter) {
+		t.Errorf("DeleteAtom(%v): want %v, got %v", inc, crdt.ErrBoundedCounter, err)
+	}
+	if got := counter.Snapshot(); got != 0 {
+		t.Errorf("Snapshot() = %d, want 0", got)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateBoundedCounterDelete(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	counter, err := tree.SetCounter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := counter.Add(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := counter.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Deleted additions are only valid within unbounded counters.
+	setAtom(tree, 0, func(atom *crdt.Atom) { atom.Value = crdt.InsertCounter{Bounded: true} })
+	if err := tree.Validate(); !errors.Is(err, crdt.ErrInvalidTree) {
+		t.Errorf("want %v, got %v", crdt.ErrInvalidTree, err)
+	}
+}
+
+func TestValidateBoundedCounterRights(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	counter, err := tree.SetBoundedCounter()
+	must(err)
+	must(counter.Add(5))
+	remote, err := tree.Fork()
+	must(err)
+	remoteCounter, err := remote.CounterValue(counter.ID())
+	must(err)
+	must(remoteCounter.Add(2))
+	must(remoteCounter.Add(-2))
+	must(remote.Validate())
+	// Forge a decrement that spends rights from the local site. The counter stays positive, but
+	// the remote site has negative rights.
+	for i, atom := range remote.Weave {
+		if atom.Value == (crdt.InsertAdd{Value: -2}) {
+			setAtom(remote, i, func(atom *crdt.Atom) { atom.Value = crdt.InsertAdd{Value: -6} })
+		}
+	}
+	if err := tree.Merge(remote); !errors.Is(err, crdt.ErrInvalidTree) {
+		t.Errorf("Merge: want %v, got %v", crdt.ErrInvalidTree, err)
+	}
+	if got := counter.Snapshot(); got != 5 {
+		t.Errorf("Snapshot() = %d, want 5", got)
+	}
+}
+
+func TestCounterTransferErrors(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	unbounded, err := tree.SetCounter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounded, err := tree.SetBoundedCounter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bounded.Add(5); err != nil {
+		t.Fatal(err)
+	}
+	other := crdt.NewCausalTree().SiteID
+	tests := []struct {
+		desc string
+		f    func() error
+		want error
+	}{
+		{"unbounded", func() error { return unbounded.Transfer(other, 1) }, crdt.ErrInvalidTransfer},
+		{"zero", func() error { return bounded.Transfer(other, 0) }, crdt.ErrInvalidTransfer},
+		{"own site", func() error { return bounded.Transfer(tree.SiteID, 1) }, crdt.ErrInvalidTransfer},
+		{"not enough rights", func() error { return bounded.Transfer(other, 6) }, crdt.ErrNotEnoughRights},
+	}
+	for _, test := range tests {
+		if err := test.f(); !errors.Is(err, test.want) {
+			t.Errorf("%s: want %v, got %v", test.desc, test.want, err)
+		}
+	}
+	if r := unbounded.Rights(); r != math.MaxInt64 {
+		t.Errorf("unbounded Rights() = %d, want %d", r, int64(math.MaxInt64))
+	}
+}
+
+func TestValidateTransfer(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	counter, err := tree.SetBoundedCounter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := counter.Add(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := counter.Transfer(crdt.NewCausalTree().SiteID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Transfers are only valid within bounded counters.
+	setAtom(tree, 0, func(atom *crdt.Atom) { atom.Value = crdt.InsertCounter{} })
+	if err := tree.Validate(); !errors.Is(err, crdt.ErrInvalidTree) {
+		t.Errorf("want %v, got %v", crdt.ErrInvalidTree, err)
+	}
+}
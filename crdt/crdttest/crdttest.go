@@ -0,0 +1,524 @@
+// Package crdttest provides a property-based test harness for replicated causal trees.
+//
+// The harness drives a set of replicas with random local operations, forks and merges, while
+// the network is randomly partitioned and healed. After every action all replicas must be
+// valid, with no negative bounded counter, and in the end they must converge to the same
+// contents once fully synced. Merges are also checked to be commutative, associative and
+// idempotent.
+//
+// Actions are drawn with rapid, so failing cases are shrunk to a minimal sequence of actions.
+// New atom types should add their operations to DefaultOps, so that they are covered by the
+// harness.
+package crdttest
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/uuid"
+	"pgregory.net/rapid"
+
+	"github.com/brunokim/causal-tree/crdt"
+)
+
+// Op is a local operation on a replica, that draws its arguments from t.
+//
+// Operations that can't be applied to the replica's current state should call t.Skip, such
+// that another action is drawn. Any error returned fails the test.
+type Op struct {
+	Name string
+	Run  func(t *rapid.T, tree *crdt.CausalTree) error
+}
+
+// Operations for every atom type.
+var (
+	InsertCharOp = Op{"InsertChar", func(t *rapid.T, tree *crdt.CausalTree) error {
+		ch := rapid.RuneFrom([]rune("abcdefghijklmnopqrstuvwxyz")).Draw(t, "ch")
+		setCursorFor(t, tree, -1, crdt.InsertChar{Char: ch})
+		return tree.InsertChar(ch)
+	}}
+	DeleteOp = Op{"Delete", func(t *rapid.T, tree *crdt.CausalTree) error {
+		setCursorFor(t, tree, 0, crdt.Delete{})
+		err := tree.Delete()
+		if errors.Is(err, crdt.ErrBoundedCounter) {
+			t.Skip(err)
+		}
+		return err
+	}}
+	InsertStrOp = Op{"InsertStr", func(t *rapid.T, tree *crdt.CausalTree) error {
+		return tree.InsertStr()
+	}}
+	InsertCounterOp = Op{"InsertCounter", func(t *rapid.T, tree *crdt.CausalTree) error {
+		return tree.InsertCounter()
+	}}
+	InsertAddOp = Op{"InsertAdd", func(t *rapid.T, tree *crdt.CausalTree) error {
+		val := rapid.Int64Range(-100, 100).Draw(t, "val")
+		setCursorFor(t, tree, 0, crdt.InsertAdd{Value: val})
+		err := tree.InsertAdd(val)
+		if errors.Is(err, crdt.ErrNotEnoughRights) {
+			t.Skip(err)
+		}
+		return err
+	}}
+	StringInsertOp = Op{"String.Insert", func(t *rapid.T, tree *crdt.CausalTree) error {
+		str, err := tree.StringValue(drawAtom(t, tree, crdt.InsertStr{}))
+		if err != nil {
+			return err
+		}
+		cur := str.Cursor()
+		if err := cur.Index(rapid.IntRange(-1, str.Len()-1).Draw(t, "index")); err != nil {
+			return err
+		}
+		ch := rapid.RuneFrom([]rune("abcdefghijklmnopqrstuvwxyz\n")).Draw(t, "ch")
+		_, err = cur.Insert(ch)
+		return err
+	}}
+	StringDeleteOp = Op{"String.Delete", func(t *rapid.T, tree *crdt.CausalTree) error {
+		str, err := tree.StringValue(drawAtom(t, tree, crdt.InsertStr{}))
+		if err != nil {
+			return err
+		}
+		if str.Len() == 0 {
+			t.Skip("empty string")
+		}
+		cur := str.Cursor()
+		if err := cur.Index(rapid.IntRange(0, str.Len()-1).Draw(t, "index")); err != nil {
+			return err
+		}
+		return cur.Delete()
+	}}
+	StringReplaceRangeOp = Op{"String.ReplaceRange", func(t *rapid.T, tree *crdt.CausalTree) error {
+		str, err := tree.StringValue(drawAtom(t, tree, crdt.InsertStr{}))
+		if err != nil {
+			return err
+		}
+		start := rapid.IntRange(0, str.Len()).Draw(t, "start")
+		end := rapid.IntRange(start, str.Len()).Draw(t, "end")
+		text := rapid.StringMatching("[a-z\\n]{0,5}").Draw(t, "text")
+		_, err = str.ReplaceRange(start, end, text)
+		return err
+	}}
+	StringLinesOp = Op{"String.Lines", func(t *rapid.T, tree *crdt.CausalTree) error {
+		// Doesn't modify the tree, but builds its line index, that must be kept up-to-date.
+		str, err := tree.StringValue(drawAtom(t, tree, crdt.InsertStr{}))
+		if err != nil {
+			return err
+		}
+		lines := strings.Split(str.Snapshot(), "\n")
+		if n := str.LineCount(); n != len(lines) {
+			return fmt.Errorf("LineCount() = %d, want %d", n, len(lines))
+		}
+		var i int
+		for line, text := range lines {
+			for col := 0; col <= utf8.RuneCountInString(text); col++ {
+				if l, c, err := str.LineCol(i); err != nil || l != line || c != col {
+					return fmt.Errorf("LineCol(%d) = (%d, %d, %v), want (%d, %d)", i, l, c, err, line, col)
+				}
+				i++
+			}
+		}
+		return nil
+	}}
+	StringMarkOp = Op{"String.Mark", func(t *rapid.T, tree *crdt.CausalTree) error {
+		str, err := tree.StringValue(drawAtom(t, tree, crdt.InsertStr{}))
+		if err != nil {
+			return err
+		}
+		if str.Len() == 0 {
+			t.Skip("empty string")
+		}
+		start := rapid.IntRange(0, str.Len()-1).Draw(t, "start")
+		end := rapid.IntRange(start+1, str.Len()).Draw(t, "end")
+		name := rapid.StringMatching("bold|italic").Draw(t, "name")
+		value := rapid.StringMatching("|true").Draw(t, "value")
+		expand := crdt.Expand(rapid.IntRange(0, int(crdt.ExpandBoth)).Draw(t, "expand"))
+		if value == "" {
+			return str.RemoveMark(start, end, name, expand)
+		}
+		return str.AddMark(start, end, name, value, expand)
+	}}
+	StringAnnotateOp = Op{"String.Annotate", func(t *rapid.T, tree *crdt.CausalTree) error {
+		str, err := tree.StringValue(drawAtom(t, tree, crdt.InsertStr{}))
+		if err != nil {
+			return err
+		}
+		if str.Len() == 0 {
+			t.Skip("empty string")
+		}
+		start := rapid.IntRange(0, str.Len()-1).Draw(t, "start")
+		end := rapid.IntRange(start+1, str.Len()).Draw(t, "end")
+		a, err := str.Annotate(start, end)
+		if err != nil {
+			return err
+		}
+		// Nested strings are edited by the other string operations.
+		_, err = a.AddString()
+		return err
+	}}
+	CounterResetOp = Op{"Counter.Reset", func(t *rapid.T, tree *crdt.CausalTree) error {
+		counter, err := tree.CounterValue(drawAtom(t, tree, crdt.InsertCounter{}))
+		if err != nil {
+			return err
+		}
+		return counter.Reset()
+	}}
+	SetBoundedCounterOp = Op{"SetBoundedCounter", func(t *rapid.T, tree *crdt.CausalTree) error {
+		_, err := tree.SetBoundedCounter()
+		return err
+	}}
+	BoundedCounterAddOp = Op{"BoundedCounter.Add", func(t *rapid.T, tree *crdt.CausalTree) error {
+		counter, err := tree.CounterValue(drawAtom(t, tree, crdt.InsertCounter{Bounded: true}))
+		if err != nil {
+			return err
+		}
+		err = counter.Add(rapid.Int64Range(-100, 100).Draw(t, "val"))
+		if errors.Is(err, crdt.ErrNotEnoughRights) {
+			t.Skip(err)
+		}
+		return err
+	}}
+	BoundedCounterTransferOp = Op{"BoundedCounter.Transfer", func(t *rapid.T, tree *crdt.CausalTree) error {
+		counter, err := tree.CounterValue(drawAtom(t, tree, crdt.InsertCounter{Bounded: true}))
+		if err != nil {
+			return err
+		}
+		rights := counter.Rights()
+		if rights <= 0 || len(tree.Sitemap) < 2 {
+			t.Skip("no rights or sites to transfer to")
+		}
+		site := tree.Sitemap[rapid.IntRange(0, len(tree.Sitemap)-1).Draw(t, "site")]
+		if site == tree.SiteID {
+			t.Skip("transfer to own site")
+		}
+		return counter.Transfer(site, rapid.Int64Range(1, rights).Draw(t, "val"))
+	}}
+	SetSetOp = Op{"SetSet", func(t *rapid.T, tree *crdt.CausalTree) error {
+		_, err := tree.SetSet()
+		return err
+	}}
+	SetAddOp = Op{"Set.Add", func(t *rapid.T, tree *crdt.CausalTree) error {
+		set, err := tree.SetValue(drawAtom(t, tree, crdt.InsertSet{}))
+		if err != nil {
+			return err
+		}
+		return set.Add(drawSetElement(t))
+	}}
+	SetRemoveOp = Op{"Set.Remove", func(t *rapid.T, tree *crdt.CausalTree) error {
+		set, err := tree.SetValue(drawAtom(t, tree, crdt.InsertSet{}))
+		if err != nil {
+			return err
+		}
+		elem := drawSetElement(t)
+		if err := set.Remove(elem); err != nil {
+			return err
+		}
+		if set.Contains(elem) {
+			return fmt.Errorf("set contains %v after removal", elem)
+		}
+		return nil
+	}}
+	CounterAddOp = Op{"Counter.Add", func(t *rapid.T, tree *crdt.CausalTree) error {
+		counter, err := tree.CounterValue(drawAtom(t, tree, crdt.InsertCounter{}))
+		if err != nil {
+			return err
+		}
+		return counter.Add(rapid.Int64Range(-100, 100).Draw(t, "val"))
+	}}
+)
+
+// DefaultOps returns the operations for every atom type.
+func DefaultOps() []Op {
+	return []Op{
+		InsertCharOp, DeleteOp, InsertStrOp, InsertCounterOp, InsertAddOp,
+		StringInsertOp, StringDeleteOp, StringReplaceRangeOp, StringLinesOp,
+		StringMarkOp, StringAnnotateOp, CounterAddOp, CounterResetOp, SetBoundedCounterOp,
+		BoundedCounterAddOp, BoundedCounterTransferOp, SetSetOp, SetAddOp, SetRemoveOp,
+	}
+}
+
+// Returns the ID of a random atom with the given value. Skips the action if there's none.
+func drawAtom(t *rapid.T, tree *crdt.CausalTree, value crdt.AtomValue) crdt.AtomID {
+	var ids []crdt.AtomID
+	for _, atom := range tree.Weave {
+		if atom.Value == value {
+			ids = append(ids, atom.ID)
+		}
+	}
+	if len(ids) == 0 {
+		t.Skipf("no %v atoms", value)
+	}
+	return ids[rapid.IntRange(0, len(ids)-1).Draw(t, "atom")]
+}
+
+// Returns a random set element, from a small domain to cause conflicts.
+func drawSetElement(t *rapid.T) interface{} {
+	elems := []interface{}{false, true, int64(-1), int64(0), int64(1), "", "a", "b"}
+	return elems[rapid.IntRange(0, len(elems)-1).Draw(t, "elem")]
+}
+
+// Moves the cursor to a random position, starting from min, where value may be inserted.
+// Skips the action if there's none.
+func setCursorFor(t *rapid.T, tree *crdt.CausalTree, min int, value crdt.AtomValue) {
+	if min >= len(tree.Weave) {
+		t.Skip("no positions")
+	}
+	i := rapid.IntRange(min, len(tree.Weave)-1).Draw(t, "pos")
+	if err := tree.SetCursor(i); err != nil {
+		t.Skip("position out of range")
+	}
+	if tree.Cursor.Timestamp == 0 {
+		return
+	}
+	for _, atom := range tree.Weave {
+		if atom.ID == tree.Cursor {
+			if err := atom.Value.ValidateChild(value); err != nil {
+				t.Skip(err)
+			}
+			return
+		}
+	}
+	t.Fatalf("cursor %v not found in weave", tree.Cursor)
+}
+
+// Config sets up the harness.
+type Config struct {
+	// Maximum number of replicas, including the initial one. Defaults to 4.
+	MaxReplicas int
+	// Local operations applied to replicas. Defaults to DefaultOps().
+	Ops []Op
+}
+
+// Check runs the harness as a rapid property within a test.
+func Check(t *testing.T, cfg Config) {
+	rapid.Check(t, Property(cfg))
+}
+
+// Property returns the harness as a rapid property.
+func Property(cfg Config) func(*rapid.T) {
+	if cfg.MaxReplicas <= 0 {
+		cfg.MaxReplicas = 4
+	}
+	if cfg.Ops == nil {
+		cfg.Ops = DefaultOps()
+	}
+	return func(t *rapid.T) {
+		h := &harness{cfg: cfg}
+		h.replicas = []*crdt.CausalTree{crdt.NewCausalTreeWithSiteID(h.newSiteID())}
+		h.groups = []int{0}
+		t.Repeat(h.actions())
+		h.checkMergeLaws(t)
+		h.checkConvergence(t)
+	}
+}
+
+// -----
+
+type harness struct {
+	cfg      Config
+	replicas []*crdt.CausalTree
+	// Partition group of each replica. Replicas may only merge with others in the same group.
+	groups  []int
+	numSite uint32
+}
+
+// Returns deterministic site IDs, so that failures are reproducible.
+func (h *harness) newSiteID() uuid.UUID {
+	h.numSite++
+	var id uuid.UUID
+	id[0], id[1], id[2], id[3] = byte(h.numSite>>24), byte(h.numSite>>16), byte(h.numSite>>8), byte(h.numSite)
+	return id
+}
+
+func (h *harness) actions() map[string]func(*rapid.T) {
+	actions := map[string]func(*rapid.T){
+		"":          h.check,
+		"Fork":      h.fork,
+		"Merge":     h.merge,
+		"Partition": h.partition,
+		"Heal":      h.heal,
+	}
+	for _, op := range h.cfg.Ops {
+		op := op
+		actions[op.Name] = func(t *rapid.T) {
+			i := h.drawReplica(t, "replica")
+			if err := op.Run(t, h.replicas[i]); err != nil {
+				t.Fatalf("%s at replica #%d: %v", op.Name, i, err)
+			}
+		}
+	}
+	return actions
+}
+
+func (h *harness) drawReplica(t *rapid.T, label string) int {
+	return rapid.IntRange(0, len(h.replicas)-1).Draw(t, label)
+}
+
+func (h *harness) fork(t *rapid.T) {
+	if len(h.replicas) >= h.cfg.MaxReplicas {
+		t.Skip("too many replicas")
+	}
+	i := h.drawReplica(t, "replica")
+	remote, err := h.replicas[i].ForkWithSiteID(h.newSiteID())
+	if err != nil {
+		t.Fatalf("fork replica #%d: %v", i, err)
+	}
+	h.replicas = append(h.replicas, remote)
+	h.groups = append(h.groups, h.groups[i])
+}
+
+func (h *harness) merge(t *rapid.T) {
+	i := h.drawReplica(t, "local")
+	j := h.drawReplica(t, "remote")
+	if i == j {
+		t.Skip("same replica")
+	}
+	if h.groups[i] != h.groups[j] {
+		t.Skip("replicas are partitioned")
+	}
+	if err := h.replicas[i].Merge(h.replicas[j]); err != nil {
+		t.Fatalf("merge replica #%d into #%d: %v", j, i, err)
+	}
+}
+
+func (h *harness) partition(t *rapid.T) {
+	for i := range h.groups {
+		h.groups[i] = rapid.IntRange(0, 2).Draw(t, fmt.Sprintf("group #%d", i))
+	}
+}
+
+func (h *harness) heal(t *rapid.T) {
+	for i := range h.groups {
+		h.groups[i] = 0
+	}
+}
+
+func (h *harness) check(t *rapid.T) {
+	for i, tree := range h.replicas {
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("replica #%d: %v", i, err)
+		}
+		checkBoundedCounters(t, i, tree)
+	}
+}
+
+// Checks that bounded counters are never negative, even after merging concurrent decrements.
+func checkBoundedCounters(t *rapid.T, i int, tree *crdt.CausalTree) {
+	for _, atom := range tree.Weave {
+		if atom.Value != (crdt.InsertCounter{Bounded: true}) {
+			continue
+		}
+		counter, err := tree.CounterValue(atom.ID)
+		if err != nil {
+			t.Fatalf("replica #%d: %v", i, err)
+		}
+		if got := counter.Snapshot(); got < 0 {
+			t.Fatalf("replica #%d: bounded counter %v is negative: %d", i, atom.ID, got)
+		}
+	}
+}
+
+// -----
+
+// Returns a copy of the tree.
+func clone(t *rapid.T, tree *crdt.CausalTree) *crdt.CausalTree {
+	c, err := tree.ViewAt(tree.Now())
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	return c
+}
+
+// Returns the merge of two trees, without modifying them.
+func merged(t *rapid.T, a, b *crdt.CausalTree) *crdt.CausalTree {
+	c := clone(t, a)
+	if err := c.Merge(b); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+	return c
+}
+
+// Contents of a tree that must be equal in converged replicas.
+type state struct {
+	Sitemap []uuid.UUID
+	Yarns   [][]crdt.Atom
+	Weave   []crdt.Atom
+}
+
+func diffState(t1, t2 *crdt.CausalTree) string {
+	s1 := state{t1.Sitemap, t1.Yarns, t1.Weave}
+	s2 := state{t2.Sitemap, t2.Yarns, t2.Weave}
+	return cmp.Diff(s1, s2, cmpopts.EquateEmpty())
+}
+
+// Checks that merges are commutative, associative and idempotent for three replicas.
+func (h *harness) checkMergeLaws(t *rapid.T) {
+	a := h.replicas[h.drawReplica(t, "a")]
+	b := h.replicas[h.drawReplica(t, "b")]
+	c := h.replicas[h.drawReplica(t, "c")]
+	if diff := diffState(merged(t, a, b), merged(t, b, a)); diff != "" {
+		t.Fatalf("merge is not commutative (-a+b, +b+a):\n%s", diff)
+	}
+	abThenC := merged(t, merged(t, a, b), c)
+	aThenBC := merged(t, a, merged(t, b, c))
+	if diff := diffState(abThenC, aThenBC); diff != "" {
+		t.Fatalf("merge is not associative (-(a+b)+c, +a+(b+c)):\n%s", diff)
+	}
+	if diff := diffState(a, merged(t, a, a)); diff != "" {
+		t.Fatalf("merge is not idempotent (-a, +a+a):\n%s", diff)
+	}
+	ab := merged(t, a, b)
+	if diff := diffState(ab, merged(t, ab, b)); diff != "" {
+		t.Fatalf("merge is not idempotent (-a+b, +(a+b)+b):\n%s", diff)
+	}
+}
+
+// Fully syncs all replicas in a random order, and checks that they converge.
+func (h *harness) checkConvergence(t *rapid.T) {
+	n := len(h.replicas)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	for i := n - 1; i > 0; i-- {
+		j := rapid.IntRange(0, i).Draw(t, "shuffle")
+		order[i], order[j] = order[j], order[i]
+	}
+	// Gather all atoms in the first replica of the order, and then spread them.
+	first := h.replicas[order[0]]
+	for _, i := range order[1:] {
+		if err := first.Merge(h.replicas[i]); err != nil {
+			t.Fatalf("gather from replica #%d: %v", i, err)
+		}
+	}
+	for _, i := range order[1:] {
+		if err := h.replicas[i].Merge(first); err != nil {
+			t.Fatalf("spread to replica #%d: %v", i, err)
+		}
+	}
+	h.check(t)
+	wantJSON, err := first.ToJSON()
+	if err != nil {
+		t.Fatalf("replica #%d: %v", order[0], err)
+	}
+	wantString := first.ToString()
+	for i, tree := range h.replicas {
+		if diff := diffState(first, tree); diff != "" {
+			t.Fatalf("replica #%d diverges from #%d (-want, +got):\n%s", i, order[0], diff)
+		}
+		gotJSON, err := tree.ToJSON()
+		if err != nil {
+			t.Fatalf("replica #%d: %v", i, err)
+		}
+		if string(gotJSON) != string(wantJSON) {
+			t.Fatalf("replica #%d: got JSON %s, want %s", i, gotJSON, wantJSON)
+		}
+		if got := tree.ToString(); got != wantString {
+			t.Fatalf("replica #%d: got %q, want %q", i, got, wantString)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package crdttest_test
+
+import (
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt/crdttest"
+)
+
+func TestReplicas(t *testing.T) {
+	crdttest.Check(t, crdttest.Config{})
+}
+
+func TestCharReplicas(t *testing.T) {
+	crdttest.Check(t, crdttest.Config{
+		MaxReplicas: 6,
+		Ops:         []crdttest.Op{crdttest.InsertCharOp, crdttest.DeleteOp},
+	})
+}
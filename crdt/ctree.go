@@ -119,7 +119,8 @@ type AtomValue interface {
 type CausalTree struct {
 	// Weave is the flat representation of a causal tree.
 	Weave []Atom
-	// Cursor is the ID of the causing atom for the next operation.
+	// Cursor is the ID of the causing atom for the next operation of the legacy API (InsertChar,
+	// Delete, etc.). Value handles, like String and Counter, don't use nor modify it.
 	Cursor AtomID
 	// Yarns is the list of atoms, grouped by the site that created them.
 	Yarns [][]Atom
@@ -130,11 +131,21 @@ type CausalTree struct {
 	SiteID uuid.UUID
 	// Timestamp is this tree's Lamport timestamp.
 	Timestamp uint32
+
+	// Line indices of strings, kept up-to-date as atoms are inserted.
+	lineIndexes []*lineIndex
 }
 
 // NewCausalTree creates an initialized empty replicated tree.
 func NewCausalTree() *CausalTree {
-	siteID := uuidv1()
+	return NewCausalTreeWithSiteID(uuidv1())
+}
+
+// NewCausalTreeWithSiteID creates an initialized empty replicated tree with the given site ID.
+//
+// Site IDs must be unique among all replicas. This is mostly useful to reproduce a session,
+// prefer using NewCausalTree otherwise.
+func NewCausalTreeWithSiteID(siteID uuid.UUID) *CausalTree {
 	return &CausalTree{
 		Weave:     nil,
 		Cursor:    AtomID{},
@@ -183,6 +194,7 @@ func (t *CausalTree) insertAtom(atom Atom, i int) {
 	t.Weave = append(t.Weave, Atom{})
 	copy(t.Weave[i+1:], t.Weave[i:])
 	t.Weave[i] = atom
+	t.updateLineIndexes(i)
 }
 
 // +--------+
@@ -259,14 +271,43 @@ func (m indexMap) get(i int) int {
 // -----
 
 func (a Atom) remapSite(m indexMap) Atom {
+	value := a.Value
+	switch v := value.(type) {
+	case InsertMark:
+		// Marks also reference the atom where they end.
+		v.End = v.End.remapSite(m)
+		value = v
+	case InsertAnnotation:
+		// Annotations reference the chars where they start and end.
+		v.Start = v.Start.remapSite(m)
+		v.End = v.End.remapSite(m)
+		value = v
+	}
 	return Atom{
 		ID:    a.ID.remapSite(m),
 		Cause: a.Cause.remapSite(m),
-		Value: a.Value,
+		Value: value,
 	}
 }
 
+// Returns the IDs of the atoms referenced by this atom: its cause, and the ones referenced by
+// its value.
+func (a Atom) references() []AtomID {
+	refs := []AtomID{a.Cause}
+	switch v := a.Value.(type) {
+	case InsertMark:
+		refs = append(refs, v.End)
+	case InsertAnnotation:
+		refs = append(refs, v.Start, v.End)
+	}
+	return refs
+}
+
 func (id AtomID) remapSite(m indexMap) AtomID {
+	if id.Timestamp == 0 {
+		// The zero atom is the tree root, and doesn't belong to any site.
+		return AtomID{}
+	}
 	return AtomID{
 		Site:      uint16(m.get(int(id.Site))),
 		Index:     id.Index,
@@ -282,11 +323,23 @@ func (id AtomID) remapSite(m indexMap) AtomID {
 //
 // Time complexity: O(atoms)
 func (t *CausalTree) Fork() (*CausalTree, error) {
+	return t.ForkWithSiteID(uuidv1())
+}
+
+// ForkWithSiteID forks a replicated tree into an independent object with the given site ID.
+//
+// Site IDs must be unique among all replicas. This is mostly useful to reproduce a session,
+// prefer using Fork otherwise.
+//
+// Time complexity: O(atoms)
+func (t *CausalTree) ForkWithSiteID(newSiteID uuid.UUID) (*CausalTree, error) {
 	if len(t.Sitemap)-1 >= math.MaxUint16 {
 		return nil, ErrSiteLimitExceeded
 	}
-	newSiteID := uuidv1()
 	i := siteIndex(t.Sitemap, newSiteID)
+	if i < len(t.Sitemap) && t.Sitemap[i] == newSiteID {
+		return nil, ErrSiteIDExists
+	}
 	if i == len(t.Sitemap) {
 		t.Yarns = append(t.Yarns, nil)
 		t.Sitemap = append(t.Sitemap, newSiteID)
@@ -366,40 +419,43 @@ func mergeSitemaps(s1, s2 []uuid.UUID) []uuid.UUID {
 	return s
 }
 
+// Merges two valid weaves into a single weave, containing all atoms from both.
+//
+// Both weaves are depth-first traversals of their trees, so the merged prefix is also a traversal of
+// the merged tree, and the next atom from either weave is a child of some atom in its rightmost path.
+// When the next atoms are different, the one whose cause is deeper in this path goes first, since it
+// continues the current subtree. If both have the same cause, they are sorted as siblings.
+// In both cases, the chosen atom is unknown to the other weave, and so is its whole causal block.
+//
 // Time complexity: O(atoms)
 func mergeWeaves(w1, w2 []Atom) []Atom {
 	var i, j int
 	var weave []Atom
+	depth := make(map[AtomID]int)
+	appendAtoms := func(atoms []Atom) {
+		for _, atom := range atoms {
+			depth[atom.ID] = depth[atom.Cause] + 1
+		}
+		weave = append(weave, atoms...)
+	}
 	for i < len(w1) && j < len(w2) {
 		a1, a2 := w1[i], w2[j]
 		if a1 == a2 {
 			// Atoms are equal, append it to the weave.
-			weave = append(weave, a1)
+			appendAtoms(w1[i : i+1])
 			i++
 			j++
 			continue
 		}
-		if a1.ID.Site == a2.ID.Site {
-			// Atoms are from the same site and can be compared by timestamp.
-			// Insert younger one (larger timestamp) in weave.
-			if a1.ID.Timestamp < a2.ID.Timestamp {
-				weave = append(weave, a2)
-				j++
-			} else {
-				weave = append(weave, a1)
-				i++
-			}
+		d1, d2 := depth[a1.Cause], depth[a2.Cause]
+		if d1 > d2 || (d1 == d2 && a1.Compare(a2) >= 0) {
+			n1 := i + causalBlockSize(w1[i:])
+			appendAtoms(w1[i:n1])
+			i = n1
 		} else {
-			// Atoms are concurrent; append first causal block, according to heads' order.
-			if a1.Compare(a2) >= 0 {
-				n1 := i + causalBlockSize(w1[i:])
-				weave = append(weave, w1[i:n1]...)
-				i = n1
-			} else {
-				n2 := j + causalBlockSize(w2[j:])
-				weave = append(weave, w2[j:n2]...)
-				j = n2
-			}
+			n2 := j + causalBlockSize(w2[j:])
+			appendAtoms(w2[j:n2])
+			j = n2
 		}
 	}
 	if i < len(w1) {
@@ -414,8 +470,18 @@ func mergeWeaves(w1, w2 []Atom) []Atom {
 // Merge updates the current state with that of another remote tree.
 // Note that merge does not move the cursor.
 //
+// The remote tree is validated before merging, and must agree with the local tree about the
+// contents of every atom they both know. If it doesn't, an error is returned and the tree is left
+// untouched.
+//
 // Time complexity: O(atoms^2 + sites*log(sites))
-func (t *CausalTree) Merge(remote *CausalTree) {
+func (t *CausalTree) Merge(remote *CausalTree) error {
+	// 0. Validate remote.
+	// Time complexity: O(atoms + sites)
+	if err := remote.Validate(); err != nil {
+		return fmt.Errorf("remote: %w", err)
+	}
+
 	// 1. Merge sitemaps.
 	// Time complexity: O(sites)
 	sitemap := mergeSitemaps(t.Sitemap, remote.Sitemap)
@@ -434,6 +500,7 @@ func (t *CausalTree) Merge(remote *CausalTree) {
 	// 3. Remap atoms from local.
 	// Time complexity: O(atoms)
 	yarns := make([][]Atom, len(sitemap))
+	localWeave := t.Weave
 	if len(localRemap) > 0 {
 		for i, yarn := range t.Yarns {
 			i := localRemap.get(i)
@@ -442,8 +509,9 @@ func (t *CausalTree) Merge(remote *CausalTree) {
 				yarns[i][j] = atom.remapSite(localRemap)
 			}
 		}
+		localWeave = make([]Atom, len(t.Weave))
 		for i, atom := range t.Weave {
-			t.Weave[i] = atom.remapSite(localRemap)
+			localWeave[i] = atom.remapSite(localRemap)
 		}
 	} else {
 		for i, yarn := range t.Yarns {
@@ -452,12 +520,17 @@ func (t *CausalTree) Merge(remote *CausalTree) {
 		}
 	}
 
-	// 4. Merge yarns.
+	// 4. Merge yarns, checking known atoms for conflicts.
 	// Time complexity: O(atoms)
 	for i, yarn := range remote.Yarns {
 		i := remoteRemap.get(i)
 		start := len(yarns[i])
 		end := len(yarn)
+		for j := 0; j < start && j < end; j++ {
+			if atom := yarn[j].remapSite(remoteRemap); yarns[i][j] != atom {
+				return fmt.Errorf("%w: remote %v, local %v", ErrMergeConflict, atom, yarns[i][j])
+			}
+		}
 		if end > start {
 			// Grow yarn to accomodate remote atoms.
 			yarns[i] = append(yarns[i], make([]Atom, end-start)...)
@@ -470,11 +543,12 @@ func (t *CausalTree) Merge(remote *CausalTree) {
 
 	// 5. Merge weaves.
 	// Time complexity: O(atoms)
+	sizes := t.yarnSizes()
 	remoteWeave := make([]Atom, len(remote.Weave))
 	for i, atom := range remote.Weave {
 		remoteWeave[i] = atom.remapSite(remoteRemap)
 	}
-	t.Weave = mergeWeaves(t.Weave, remoteWeave)
+	t.Weave = mergeWeaves(localWeave, remoteWeave)
 
 	// Move created stuff to this tree.
 	t.Yarns = yarns
@@ -483,11 +557,14 @@ func (t *CausalTree) Merge(remote *CausalTree) {
 		t.Timestamp = remote.Timestamp
 	}
 	t.Timestamp++
+	t.replayNewAtoms(sizes)
 
 	// 6. Fix cursor if necessary.
 	// Time complexity: O(atoms^2)
 	t.Cursor = t.Cursor.remapSite(localRemap)
 	t.fixDeletedCursor()
+	t.mustValidate()
+	return nil
 }
 
 // -----
@@ -649,6 +726,16 @@ func (t *CausalTree) checkWeft(weft Weft) (indexWeft, error) {
 			if !limits.isInView(atom.Cause) {
 				return nil, ErrWeftDisconnected
 			}
+			switch v := atom.Value.(type) {
+			case InsertMark:
+				if !limits.isInView(v.End) {
+					return nil, ErrWeftDisconnected
+				}
+			case InsertAnnotation:
+				if !limits.isInView(v.Start) || !limits.isInView(v.End) {
+					return nil, ErrWeftDisconnected
+				}
+			}
 		}
 	}
 	return limits, nil
@@ -694,9 +781,13 @@ func (t *CausalTree) ViewAt(weft Weft) (*CausalTree, error) {
 	if !limits.isInView(cursor) {
 		cursor = AtomID{}
 	}
-	//
-	i := siteIndex(t.Sitemap, t.SiteID)
-	tmax := weft[i]
+	// Advance the view's clock past every atom in it, so that new atoms are younger than them.
+	var tmax uint32
+	for _, timestamp := range weft {
+		if timestamp > tmax {
+			tmax = timestamp
+		}
+	}
 	view := &CausalTree{
 		Weave:     weave,
 		Cursor:    cursor,
@@ -720,73 +811,240 @@ var (
 	ErrCursorOutOfRange   = errors.New("cursor index out of range")
 	ErrWeftInvalidLength  = errors.New("weft length doesn't match with number of sites")
 	ErrWeftDisconnected   = errors.New("weft disconnects some atom from its cause")
+	ErrSiteIDExists       = errors.New("site ID already exists in tree")
+	ErrMergeConflict      = errors.New("remote has an atom with same ID but different contents")
+	ErrAtomNotFound       = errors.New("atom not found in tree")
 )
 
 // +------------+
 // | Operations |
 // +------------+
 
+// Inserts an atom as a child of the atom at causePos, or of the root if causePos is -1.
+// Returns the atom's position in the weave.
+//
 // Time complexity: O(atoms), or, O(atoms + (avg. block size))
-func (t *CausalTree) insertAtomAtCursor(atom Atom) {
-	if t.Cursor.Timestamp == 0 {
-		// Cursor is at initial position.
-		t.insertAtom(atom, 0)
-		return
+func (t *CausalTree) insertAtomAfter(causePos int, atom Atom) int {
+	insertPos := childInsertPos(t.Weave, causePos, atom)
+	t.insertAtom(atom, insertPos)
+	return insertPos
+}
+
+// Returns the position in weave where a child of the atom at causePos, or of the root if causePos
+// is -1, should be inserted.
+//
+// Time complexity: O(atoms), or, O(avg. block size)
+func childInsertPos(weave []Atom, causePos int, atom Atom) int {
+	if causePos < 0 {
+		return rootInsertPos(weave, atom)
 	}
 	// Search for position in weave that atom should be inserted, in a way that it's sorted relative to
 	// other children in descending order.
 	//
-	//                                  causal block of cursor
+	//                                  causal block of cause
 	//                      ------------------------------------------------
-	// Weave:           ... [cursor] [child1] ... [child2] ... [child3] ... [not child]
-	// Block indices:           0         1          c2'          c3'           end'
-	// Weave indices:          c0        c1          c2           c3            end
-	c0 := t.atomIndex(t.Cursor)
-	var pos, i int
-	walkCausalBlock(t.Weave[c0:], func(a Atom) bool {
-		i++
-		if a.Cause == t.Cursor && a.Compare(atom) < 0 && pos == 0 {
-			// a is the first child smaller than atom.
-			pos = i
+	// Weave:           ... [cause]  [child1] ... [child2] ... [child3] ... [not child]
+	// Weave indices:     causePos     c1          c2           c3            end
+	causeID := weave[causePos].ID
+	insertPos := causePos + 1
+	walkCausalBlock(weave[causePos:], func(a Atom) bool {
+		if a.Cause == causeID && a.Compare(atom) < 0 {
+			// a is the first child smaller than atom, break.
+			return false
 		}
+		insertPos++
 		return true
 	})
-	index := c0 + i + 1
-	if pos > 0 {
-		index = c0 + pos
+	return insertPos
+}
+
+// Returns the position in weave where a child of the root should be inserted, in a way that it's
+// sorted relative to other root children in descending order.
+//
+// Time complexity: O(atoms)
+func rootInsertPos(weave []Atom, atom Atom) int {
+	var i int
+	for i < len(weave) && weave[i].Compare(atom) > 0 {
+		i += causalBlockSize(weave[i:])
 	}
-	t.insertAtom(atom, index)
+	return i
 }
 
-// Inserts the atom as a child of the cursor, and returns its ID.
+// Inserts an atom as a child of the atom at causePos, or of the root if causePos is -1.
+// Returns the atom's position in the weave.
 //
 // Time complexity: O(atoms + log(sites))
-func (t *CausalTree) addAtom(value AtomValue) (AtomID, error) {
-	t.Timestamp++
-	if t.Timestamp == 0 {
-		// Overflow
-		return AtomID{}, ErrStateLimitExceeded
-	}
-	if t.Cursor.Timestamp > 0 {
-		cursorAtom := t.getAtom(t.Cursor)
-		if err := cursorAtom.Value.ValidateChild(value); err != nil {
-			return AtomID{}, err
+func (t *CausalTree) addAtom(causePos int, value AtomValue) (int, error) {
+	var causeID AtomID
+	if causePos >= 0 {
+		cause := t.Weave[causePos]
+		causeID = cause.ID
+		if err := cause.Value.ValidateChild(value); err != nil {
+			return -1, err
+		}
+		if _, ok := value.(Delete); ok {
+			if err := t.checkDeleteAdd(cause); err != nil {
+				return -1, err
+			}
 		}
 	}
-	i := siteIndex(t.Sitemap, t.SiteID)
-	atomID := AtomID{
-		Site:      uint16(i),
-		Index:     uint32(len(t.Yarns[i])),
-		Timestamp: t.Timestamp,
+	if t.Timestamp == math.MaxUint32 {
+		return -1, ErrStateLimitExceeded
 	}
+	t.Timestamp++
+	i := siteIndex(t.Sitemap, t.SiteID)
 	atom := Atom{
-		ID:    atomID,
-		Cause: t.Cursor,
+		ID: AtomID{
+			Site:      uint16(i),
+			Index:     uint32(len(t.Yarns[i])),
+			Timestamp: t.Timestamp,
+		},
+		Cause: causeID,
 		Value: value,
 	}
-	t.insertAtomAtCursor(atom)
+	atomPos := t.insertAtomAfter(causePos, atom)
 	t.Yarns[i] = append(t.Yarns[i], atom)
-	return atomID, nil
+	return atomPos, nil
+}
+
+// Inserts a chain of atoms, where the first is a child of the atom at causePos, and each other
+// atom is a child of the previous one. Returns the position of the first atom in the weave.
+//
+// Since every atom is the newest child of its cause, the chain is contiguous in the weave and
+// is inserted all at once.
+//
+// Time complexity: O(atoms + chain size + log(sites))
+func (t *CausalTree) addAtomChain(causePos int, values []AtomValue) (int, error) {
+	if len(values) == 0 {
+		return -1, nil
+	}
+	var prev AtomValue
+	if causePos >= 0 {
+		prev = t.Weave[causePos].Value
+	}
+	for _, value := range values {
+		if prev != nil {
+			if err := prev.ValidateChild(value); err != nil {
+				return -1, err
+			}
+		}
+		prev = value
+	}
+	causeID := AtomID{}
+	if causePos >= 0 {
+		causeID = t.Weave[causePos].ID
+	}
+	atoms, err := t.newAtomChain(causeID, values)
+	if err != nil {
+		return -1, err
+	}
+	insertPos := childInsertPos(t.Weave, causePos, atoms[0])
+	weave := make([]Atom, len(t.Weave)+len(atoms))
+	copy(weave, t.Weave[:insertPos])
+	copy(weave[insertPos:], atoms)
+	copy(weave[insertPos+len(atoms):], t.Weave[insertPos:])
+	t.Weave = weave
+	t.replayLineIndexes(func(pos int) bool {
+		return pos >= insertPos && pos < insertPos+len(atoms)
+	})
+	return insertPos, nil
+}
+
+// Creates a chain of atoms, where the first is a child of causeID, and each other atom is a
+// child of the previous one. Atoms are appended to this site's yarn, but not to the weave.
+//
+// Time complexity: O(chain size + log(sites))
+func (t *CausalTree) newAtomChain(causeID AtomID, values []AtomValue) ([]Atom, error) {
+	if uint64(t.Timestamp)+uint64(len(values)) > math.MaxUint32 {
+		return nil, ErrStateLimitExceeded
+	}
+	i := siteIndex(t.Sitemap, t.SiteID)
+	atoms := make([]Atom, len(values))
+	for j, value := range values {
+		t.Timestamp++
+		atoms[j] = Atom{
+			ID: AtomID{
+				Site:      uint16(i),
+				Index:     uint32(len(t.Yarns[i]) + j),
+				Timestamp: t.Timestamp,
+			},
+			Cause: causeID,
+			Value: value,
+		}
+		causeID = atoms[j].ID
+	}
+	t.Yarns[i] = append(t.Yarns[i], atoms...)
+	return atoms, nil
+}
+
+// Deletes the atoms at the given positions, in ascending order. Since a new Delete is always the
+// first child of its cause, all of them are inserted in a single pass over the weave.
+//
+// Time complexity: O(atoms + log(sites))
+func (t *CausalTree) deleteAtoms(positions []int) error {
+	for _, pos := range positions {
+		if err := t.Weave[pos].Value.ValidateChild(Delete{}); err != nil {
+			return err
+		}
+		if err := t.checkDeleteAdd(t.Weave[pos]); err != nil {
+			return err
+		}
+	}
+	if uint64(t.Timestamp)+uint64(len(positions)) > math.MaxUint32 {
+		return ErrStateLimitExceeded
+	}
+	i := siteIndex(t.Sitemap, t.SiteID)
+	firstIndex := uint32(len(t.Yarns[i]))
+	weave := make([]Atom, 0, len(t.Weave)+len(positions))
+	var start int
+	for _, pos := range positions {
+		t.Timestamp++
+		atom := Atom{
+			ID: AtomID{
+				Site:      uint16(i),
+				Index:     uint32(len(t.Yarns[i])),
+				Timestamp: t.Timestamp,
+			},
+			Cause: t.Weave[pos].ID,
+			Value: Delete{},
+		}
+		weave = append(weave, t.Weave[start:pos+1]...)
+		weave = append(weave, atom)
+		t.Yarns[i] = append(t.Yarns[i], atom)
+		start = pos + 1
+	}
+	t.Weave = append(weave, t.Weave[start:]...)
+	t.replayLineIndexes(func(pos int) bool {
+		id := t.Weave[pos].ID
+		return id.Site == uint16(i) && id.Index >= firstIndex
+	})
+	return nil
+}
+
+// Returns the position of an atom in the weave, or -1 for the root.
+//
+// Time complexity: O(atoms)
+func (t *CausalTree) findAtom(atomID AtomID) (int, error) {
+	i := t.atomIndex(atomID)
+	if i == len(t.Weave) {
+		return -1, fmt.Errorf("%w: %v", ErrAtomNotFound, atomID)
+	}
+	return i, nil
+}
+
+// Inserts an atom as a child of the cursor, for the cursor-based API. Returns its ID.
+//
+// Time complexity: O(atoms + log(sites))
+func (t *CausalTree) addAtomAtCursor(value AtomValue) (AtomID, error) {
+	causePos, err := t.findAtom(t.Cursor)
+	if err != nil {
+		return AtomID{}, err
+	}
+	atomPos, err := t.addAtom(causePos, value)
+	if err != nil {
+		return AtomID{}, err
+	}
+	return t.Weave[atomPos].ID, nil
 }
 
 // +-------------------------+
@@ -796,7 +1054,7 @@ func (t *CausalTree) addAtom(value AtomValue) (AtomID, error) {
 // Auxiliary function that checks if 'atom' is a container.
 func isContainer(atom Atom) bool {
 	switch atom.Value.(type) {
-	case InsertStr, InsertCounter:
+	case InsertStr, InsertCounter, InsertAnnotation, InsertSet:
 		return true
 	default:
 		return false
@@ -813,18 +1071,22 @@ func deleteDescendants(block []Atom, atomIndex int) {
 	}
 }
 
+// Returns the weave without deleted atoms and marks. Marks only format the chars of a string,
+// so they don't occupy a (tree) position.
+//
 // Time complexity: O(atoms)
 func (t *CausalTree) filterDeleted() []Atom {
 	atoms := make([]Atom, len(t.Weave))
 	copy(atoms, t.Weave)
 	indices := make(map[AtomID]int)
-	var hasDelete bool
+	var hasHoles bool
 	for i, atom := range t.Weave {
 		indices[atom.ID] = i
 	}
 	for i, atom := range t.Weave {
-		if _, ok := atom.Value.(Delete); ok {
-			hasDelete = true
+		switch atom.Value.(type) {
+		case Delete:
+			hasHoles = true
 			// Deletion must always come after deleted atom, so
 			// indices map must have the cause location.
 			deletedAtomIdx := indices[atom.Cause]
@@ -834,10 +1096,13 @@ func (t *CausalTree) filterDeleted() []Atom {
 				atoms[i] = Atom{}              //Delete the "Delete" atom
 				atoms[deletedAtomIdx] = Atom{} //Delete the target atom
 			}
+		case InsertMark:
+			hasHoles = true
+			atoms[i] = Atom{}
 		}
 	}
-	if !hasDelete {
-		// Cheap optimization for case where there are no deletions.
+	if !hasHoles {
+		// Cheap optimization for case where there are no deletions nor marks.
 		return atoms
 	}
 	// Move chars to fill in holes of empty atoms.
@@ -876,11 +1141,16 @@ func (t *CausalTree) SetCursor(i int) error {
 // + Operations - Atom Priority constants |
 // +--------------------------------------+
 const (
-	insertCharPriority    = 0
-	insertStrPriority     = 30
-	deletePriority        = 100
-	insertCounterPriority = 30
-	insertAddPriority     = 30
+	insertCharPriority       = 0
+	insertStrPriority        = 30
+	deletePriority           = 100
+	insertCounterPriority    = 30
+	insertAddPriority        = 30
+	insertMarkPriority       = 50
+	insertAnnotationPriority = 30
+	insertSetPriority        = 30
+	insertSetAddPriority     = 30
+	insertTransferPriority   = 30
 )
 
 // +--------------------------+
@@ -901,20 +1171,47 @@ func (v InsertChar) String() string { return string([]rune{v.Char}) }
 
 func (v InsertChar) ValidateChild(child AtomValue) error {
 	switch child.(type) {
-	case InsertChar, Delete:
+	case InsertChar, Delete, InsertMark:
 		return nil
 	default:
 		return fmt.Errorf("invalid atom value after InsertChar: %T (%v)", child, child)
 	}
 }
 
-// InsertChar inserts a char after the cursor position and advances the cursor.
+// InsertChar inserts a char after the cursor position and advances the cursor. Within a string,
+// the char is inserted with a StringCursor at the cursor position.
+//
+// Prefer StringCursor.Insert, that doesn't depend on the tree's cursor.
 func (t *CausalTree) InsertChar(ch rune) error {
-	atomID, err := t.addAtom(InsertChar{ch})
+	i, err := t.findAtom(t.Cursor)
+	if err != nil {
+		return err
+	}
+	var cur *StringCursor
+	if i >= 0 {
+		switch t.Weave[i].Value.(type) {
+		case InsertStr:
+			cur = (&String{newTreePosition(t, i)}).Cursor()
+		case InsertChar:
+			if headPos := t.charStringPos(i); headPos >= 0 {
+				cur = &StringCursor{newTreePosition(t, i), headPos}
+			}
+		}
+	}
+	if cur == nil {
+		// Legacy trees have chars outside of strings, as children of the root.
+		atomID, err := t.addAtomAtCursor(InsertChar{ch})
+		if err != nil {
+			return err
+		}
+		t.Cursor = atomID
+		return nil
+	}
+	char, err := cur.Insert(ch)
 	if err != nil {
 		return err
 	}
-	t.Cursor = atomID
+	t.Cursor = char.ID()
 	return nil
 }
 
@@ -944,15 +1241,10 @@ func (v Delete) ValidateChild(child AtomValue) error {
 }
 
 // Delete deletes the char at the cursor position, and relocates the cursor to its cause.
+//
+// Prefer DeleteAtom or StringCursor.Delete, that don't depend on the tree's cursor.
 func (t *CausalTree) Delete() error {
-	if t.Cursor.Timestamp == 0 {
-		return ErrNoAtomToDelete
-	}
-	if _, err := t.addAtom(Delete{}); err != nil {
-		return err
-	}
-	t.fixDeletedCursor()
-	return nil
+	return t.DeleteAtom(t.Cursor)
 }
 
 // DeleteAt deletes the char at the given (tree) position.
@@ -979,7 +1271,7 @@ func (v InsertStr) String() string { return "STR: " }
 
 func (v InsertStr) ValidateChild(child AtomValue) error {
 	switch child.(type) {
-	case InsertChar, Delete:
+	case InsertChar, Delete, InsertMark:
 		return nil
 	default:
 		return fmt.Errorf("invalid atom value after InsertStr: %T (%v)", child, child)
@@ -987,11 +1279,84 @@ func (v InsertStr) ValidateChild(child AtomValue) error {
 }
 
 // InsertStr inserts a Str container after the root and advances the cursor.
+//
+// Prefer SetString, that doesn't depend on the tree's cursor.
 func (t *CausalTree) InsertStr() error {
-	t.Cursor = AtomID{}
-	atomID, err := t.addAtom(InsertStr{})
-	t.Cursor = atomID
-	return err
+	s, err := t.SetString()
+	if err != nil {
+		return err
+	}
+	t.Cursor = s.ID()
+	return nil
+}
+
+// +-------------------------------+
+// | Operations - Insert mark atom |
+// +-------------------------------+
+
+// InsertMark represents formatting a range of a string with an attribute.
+//
+// The range starts at the mark's cause, that may be a char or the string head, and ends at the
+// char or head given by End. Each side sticks to its atom according to its bias, like an Anchor.
+type InsertMark struct {
+	// Name of the attribute, e.g., "bold".
+	Name string
+	// Value of the attribute. An empty value removes the attribute from the range.
+	Value string
+	// StartBias defines to which side of the cause the range start sticks to.
+	StartBias Bias
+	// End is the char, or string head, where the range ends.
+	End AtomID
+	// EndBias defines to which side of End the range end sticks to.
+	EndBias Bias
+}
+
+func (v InsertMark) AtomPriority() int { return insertMarkPriority }
+func (v InsertMark) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func (v InsertMark) String() string {
+	return fmt.Sprintf("mark %s=%q until %v", v.Name, v.Value, v.End)
+}
+
+// InsertMark atoms don't accept children, not even a Delete. Marks are removed by other marks.
+func (v InsertMark) ValidateChild(child AtomValue) error {
+	return fmt.Errorf("invalid atom value after InsertMark: %T (%v)", child, child)
+}
+
+// +------------------------------------------+
+// | Operations - Insert annotation container |
+// +------------------------------------------+
+
+// InsertAnnotation represents a side-channel annotation over a range of a string, like a thread
+// of comments. It's inserted as a child of the root atom, and contains its own values.
+//
+// The range goes from the char Start to the char End, inclusive, and contains all chars inserted
+// between them.
+type InsertAnnotation struct {
+	// Start is the first char of the annotated range.
+	Start AtomID
+	// End is the last char of the annotated range.
+	End AtomID
+}
+
+func (v InsertAnnotation) AtomPriority() int { return insertAnnotationPriority }
+func (v InsertAnnotation) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func (v InsertAnnotation) String() string {
+	return fmt.Sprintf("annotation %v..%v", v.Start, v.End)
+}
+
+func (v InsertAnnotation) ValidateChild(child AtomValue) error {
+	switch child.(type) {
+	case InsertStr, InsertCounter, Delete:
+		return nil
+	default:
+		return fmt.Errorf("invalid atom value after InsertAnnotation: %T (%v)", child, child)
+	}
 }
 
 // +------------------------------+
@@ -1001,7 +1366,7 @@ func (t *CausalTree) InsertStr() error {
 // Inserts an add atom as a child of the atom pointed by cursor.
 type InsertAdd struct {
 	//Value inserted into the counter container
-	Value int32
+	Value int64
 }
 
 func (v InsertAdd) AtomPriority() int { return insertAddPriority }
@@ -1009,30 +1374,48 @@ func (v InsertAdd) MarshalJSON() ([]byte, error) {
 	return json.Marshal(fmt.Sprintf("insert %d", v.Value))
 }
 
-func (v InsertAdd) String() string { return strconv.FormatInt(int64(v.Value), 10) }
+func (v InsertAdd) String() string { return strconv.FormatInt(v.Value, 10) }
 
-// InsertAdd atoms only accept child of type InsertAdd.
+// InsertAdd atoms only accept child of type InsertAdd, or a Delete when the counter is reset.
+// Additions to bounded counters can't be deleted, which is checked by the tree.
 func (v InsertAdd) ValidateChild(child AtomValue) error {
 	switch child.(type) {
-	case InsertAdd:
+	case InsertAdd, Delete:
 		return nil
 	default:
 		return fmt.Errorf("invalid atom value after InsertAdd: %T (%v)", child, child)
 	}
 }
 
-// InsertAdd inserts an InsertAdd atom after the cursor position and advances the cursor.
-func (t *CausalTree) InsertAdd(val int32) error {
-	atomID, err := t.addAtom(InsertAdd{val})
+// InsertAdd adds a value to the counter at the cursor position, that may be the counter itself
+// or one of its additions, and advances the cursor to the new addition.
+// Returns an error in the same cases as Counter.Add.
+//
+// Prefer Counter.Add, that doesn't depend on the tree's cursor.
+func (t *CausalTree) InsertAdd(val int64) error {
+	// Older trees may have additions caused by other additions.
+	headID := t.Cursor
+	for headID.Timestamp != 0 {
+		atom := t.getAtom(headID)
+		if _, ok := atom.Value.(InsertAdd); !ok {
+			break
+		}
+		headID = atom.Cause
+	}
+	counter, err := t.CounterValue(headID)
+	if err != nil {
+		return err
+	}
+	pos, err := counter.add(val)
 	if err != nil {
 		return err
 	}
-	t.Cursor = atomID
+	t.Cursor = t.Weave[pos].ID
 	return nil
 }
 
 // InsertAddAt inserts an InsertAdd atom after the given (tree) position.
-func (t *CausalTree) InsertAddAt(val int32, i int) error {
+func (t *CausalTree) InsertAddAt(val int64, i int) error {
 	if err := t.SetCursor(i); err != nil {
 		return err
 	}
@@ -1044,7 +1427,13 @@ func (t *CausalTree) InsertAddAt(val int32, i int) error {
 // +---------------------------------------+
 
 // Inserts a counter container as a child of the root atom.
-type InsertCounter struct{}
+type InsertCounter struct {
+	// Overflow is the counter's policy for additions beyond the int64 range.
+	Overflow OverflowPolicy
+	// Bounded is whether the counter never goes below zero, with decrement rights allocated
+	// per site.
+	Bounded bool
+}
 
 func (v InsertCounter) AtomPriority() int { return insertCounterPriority }
 func (v InsertCounter) MarshalJSON() ([]byte, error) {
@@ -1055,7 +1444,7 @@ func (v InsertCounter) String() string { return "Counter: " }
 
 func (v InsertCounter) ValidateChild(child AtomValue) error {
 	switch child.(type) {
-	case InsertAdd, Delete:
+	case InsertAdd, Delete, InsertTransfer:
 		return nil
 	default:
 		return fmt.Errorf("invalid atom value after InsertCounter: %T (%v)", child, child)
@@ -1063,11 +1452,90 @@ func (v InsertCounter) ValidateChild(child AtomValue) error {
 }
 
 // InsertCounter inserts a Counter container after the root and advances the cursor.
+//
+// Prefer SetCounter, that doesn't depend on the tree's cursor.
 func (t *CausalTree) InsertCounter() error {
-	t.Cursor = AtomID{}
-	atomID, err := t.addAtom(InsertCounter{})
-	t.Cursor = atomID
-	return err
+	c, err := t.SetCounter()
+	if err != nil {
+		return err
+	}
+	t.Cursor = c.ID()
+	return nil
+}
+
+// +-----------------------------------+
+// | Operations - Insert transfer atom |
+// +-----------------------------------+
+
+// InsertTransfer transfers decrement rights of a bounded counter, from the site that created
+// this atom to another site.
+type InsertTransfer struct {
+	// To is the site receiving the rights.
+	To uuid.UUID
+	// Value is the amount of rights transferred.
+	Value int64
+}
+
+func (v InsertTransfer) AtomPriority() int { return insertTransferPriority }
+func (v InsertTransfer) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func (v InsertTransfer) String() string { return fmt.Sprintf("transfer %d to %v", v.Value, v.To) }
+
+// InsertTransfer atoms don't accept children, since bounded counters can't be reset.
+func (v InsertTransfer) ValidateChild(child AtomValue) error {
+	return fmt.Errorf("invalid atom value after InsertTransfer: %T (%v)", child, child)
+}
+
+// +-----------------------------------+
+// | Operations - Insert set container |
+// +-----------------------------------+
+
+// Inserts a set container as a child of the root atom.
+type InsertSet struct{}
+
+func (v InsertSet) AtomPriority() int { return insertSetPriority }
+func (v InsertSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal("insert set container")
+}
+
+func (v InsertSet) String() string { return "SET: " }
+
+func (v InsertSet) ValidateChild(child AtomValue) error {
+	switch child.(type) {
+	case InsertSetAdd, Delete:
+		return nil
+	default:
+		return fmt.Errorf("invalid atom value after InsertSet: %T (%v)", child, child)
+	}
+}
+
+// +-------------------------------------+
+// | Operations - Insert set add element |
+// +-------------------------------------+
+
+// InsertSetAdd adds an element to a set. Removing the element deletes this atom.
+type InsertSetAdd struct {
+	// Value is the element added to the set: a bool, int64 or string.
+	Value interface{}
+}
+
+func (v InsertSetAdd) AtomPriority() int { return insertSetAddPriority }
+func (v InsertSetAdd) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.String())
+}
+
+func (v InsertSetAdd) String() string { return fmt.Sprintf("add %#v", v.Value) }
+
+// InsertSetAdd atoms only accept Delete as a child.
+func (v InsertSetAdd) ValidateChild(child AtomValue) error {
+	switch child.(type) {
+	case Delete:
+		return nil
+	default:
+		return fmt.Errorf("invalid atom value after InsertSetAdd: %T (%v)", child, child)
+	}
 }
 
 // +------------+
@@ -1076,10 +1544,13 @@ func (t *CausalTree) InsertCounter() error {
 
 func toString(data interface{}) string {
 	switch v := data.(type) {
-	case int32:
-		return strconv.FormatInt(data.(int64), 10)
+	case json.Number:
+		// Numbers are decoded as json.Number, as float64 would lose precision for large counters.
+		return v.String()
 	case string:
 		return data.(string)
+	case bool:
+		return strconv.FormatBool(v)
 	case []interface{}:
 		var b strings.Builder
 		for _, element := range data.([]interface{}) {
@@ -1098,7 +1569,9 @@ func (t *CausalTree) ToString() string {
 	if err != nil {
 		panic(fmt.Sprintf("ToString: %v", err))
 	}
-	err = json.Unmarshal(jsonData, &data)
+	dec := json.NewDecoder(bytes.NewReader(jsonData))
+	dec.UseNumber()
+	err = dec.Decode(&data)
 	if err != nil {
 		panic(fmt.Sprintf("ToString: %v", err))
 	}
@@ -1107,6 +1580,20 @@ func (t *CausalTree) ToString() string {
 
 }
 
+// CharIDs returns the IDs of the visible chars in the tree, in the same order as they appear
+// in ToString.
+//
+// Time complexity: O(atoms)
+func (t *CausalTree) CharIDs() []AtomID {
+	var ids []AtomID
+	for _, atom := range t.filterDeleted() {
+		if _, ok := atom.Value.(InsertChar); ok {
+			ids = append(ids, atom.ID)
+		}
+	}
+	return ids
+}
+
 // this interface represents a generic type.
 type generic interface{}
 
@@ -1114,6 +1601,21 @@ type generic interface{}
 func (t *CausalTree) ToJSON() ([]byte, error) {
 	tab := "    "
 	atoms := t.filterDeleted()
+	// Container blocks are computed over the weave, since deleted atoms may be needed to
+	// tell where a block ends.
+	positions := make(map[AtomID]int, len(t.Weave))
+	for i, atom := range t.Weave {
+		positions[atom.ID] = i
+	}
+	containerSize := func(i int) int {
+		pos := positions[atoms[i].ID]
+		end := pos + causalBlockSize(t.Weave[pos:])
+		j := i + 1
+		for j < len(atoms) && positions[atoms[j].ID] < end {
+			j++
+		}
+		return j - i - 1
+	}
 	var elements []generic
 	for i := 0; i < len(atoms); {
 		currentAtomValue := atoms[i].Value
@@ -1122,23 +1624,37 @@ func (t *CausalTree) ToJSON() ([]byte, error) {
 			elements = append(elements, string(value.Char))
 			i++
 		case InsertStr:
-			strSize := causalBlockSize(atoms[i:]) - 1
-			strChars := make([]rune, strSize)
+			strSize := containerSize(i)
+			strChars := make([]rune, 0, strSize)
 
-			for j, atom := range atoms[i+1 : i+strSize+1] {
-				strChars[j] = atom.Value.(InsertChar).Char
+			for _, atom := range atoms[i+1 : i+strSize+1] {
+				if ch, ok := atom.Value.(InsertChar); ok {
+					strChars = append(strChars, ch.Char)
+				}
 			}
 			elements = append(elements, string(strChars))
 			i = i + strSize + 1
 		case InsertCounter:
-			counterSize := causalBlockSize(atoms[i:]) - 1
-			var counterValue int32 = 0
-
+			counterSize := containerSize(i)
+			var sum counterSum
 			for _, atom := range atoms[i+1 : i+counterSize+1] {
-				counterValue += atom.Value.(InsertAdd).Value
+				if add, ok := atom.Value.(InsertAdd); ok {
+					sum.add(add.Value)
+				}
 			}
-			elements = append(elements, counterValue)
+			elements = append(elements, sum.value())
 			i = i + counterSize + 1
+		case InsertSet:
+			setSize := containerSize(i)
+			members := []interface{}{}
+			for _, atom := range atoms[i+1 : i+setSize+1] {
+				members = insertMember(members, atom.Value.(InsertSetAdd).Value)
+			}
+			elements = append(elements, members)
+			i = i + setSize + 1
+		case InsertAnnotation:
+			// Annotations are a side channel, and are not part of the tree contents.
+			i = i + containerSize(i) + 1
 		default:
 			return nil, fmt.Errorf("ToJSON: type not specified")
 		}
@@ -1151,6 +1667,106 @@ func (t *CausalTree) ToJSON() ([]byte, error) {
 	return finalJSON, nil
 }
 
+// FromString creates a tree containing the chars of s, as if they were typed with InsertChar
+// into a new tree.
+//
+// Time complexity: O(chars)
+func FromString(s string) (*CausalTree, error) {
+	t := NewCausalTree()
+	values := charValues(s)
+	if len(values) == 0 {
+		return t, nil
+	}
+	atoms, err := t.newAtomChain(AtomID{}, values)
+	if err != nil {
+		return nil, err
+	}
+	t.Weave = atoms
+	t.Cursor = atoms[len(atoms)-1].ID
+	t.mustValidate()
+	return t, nil
+}
+
+// FromJSON creates a tree from a JSON array in the format returned by ToJSON, where each string
+// is a Str container, each integer is a Counter container, and each array of bools, integers and
+// strings is a Set container.
+//
+// The result is the same as creating each container with SetString, SetCounter or SetSet, and
+// filling it with StringCursor.InsertString, Counter.Add or Set.Add, from the last element to the
+// first.
+//
+// Time complexity: O(chars + containers)
+func FromJSON(data []byte) (*CausalTree, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var elements []interface{}
+	if err := dec.Decode(&elements); err != nil {
+		return nil, fmt.Errorf("FromJSON: %w", err)
+	}
+	chains := make([][]AtomValue, len(elements))
+	// Set additions are children of the set head, instead of a chain.
+	setAdds := make([][]AtomValue, len(elements))
+	for i, element := range elements {
+		switch v := element.(type) {
+		case string:
+			chains[i] = append([]AtomValue{InsertStr{}}, charValues(v)...)
+		case json.Number:
+			n, err := strconv.ParseInt(v.String(), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("FromJSON: invalid counter value at #%d: %w", i, err)
+			}
+			chains[i] = []AtomValue{InsertCounter{}}
+			if n != 0 {
+				chains[i] = append(chains[i], InsertAdd{n})
+			}
+		case []interface{}:
+			chains[i] = []AtomValue{InsertSet{}}
+			for _, x := range v {
+				if n, ok := x.(json.Number); ok {
+					var err error
+					if x, err = strconv.ParseInt(n.String(), 10, 64); err != nil {
+						return nil, fmt.Errorf("FromJSON: invalid set element at #%d: %w", i, err)
+					}
+				}
+				if err := checkSetElement(x); err != nil {
+					return nil, fmt.Errorf("FromJSON: invalid set element at #%d: %w", i, err)
+				}
+				setAdds[i] = append(setAdds[i], InsertSetAdd{x})
+			}
+		default:
+			return nil, fmt.Errorf("FromJSON: invalid json element at #%d (%T)", i, v)
+		}
+	}
+	t := NewCausalTree()
+	// Containers are created from last to first, since newer root children are sorted first
+	// in the weave.
+	blocks := make([][]Atom, len(chains))
+	var size int
+	for i := len(chains) - 1; i >= 0; i-- {
+		atoms, err := t.newAtomChain(AtomID{}, chains[i])
+		if err != nil {
+			return nil, err
+		}
+		// Newer set additions are sorted first among the head's children.
+		adds := make([]Atom, len(setAdds[i]))
+		for j, add := range setAdds[i] {
+			addAtoms, err := t.newAtomChain(atoms[0].ID, []AtomValue{add})
+			if err != nil {
+				return nil, err
+			}
+			adds[len(adds)-1-j] = addAtoms[0]
+		}
+		blocks[i] = append(atoms, adds...)
+		size += len(blocks[i])
+	}
+	t.Weave = make([]Atom, 0, size)
+	for _, block := range blocks {
+		t.Weave = append(t.Weave, block...)
+	}
+	t.mustValidate()
+	return t, nil
+}
+
 // +-----------+
 // | Utilities |
 // +-----------+
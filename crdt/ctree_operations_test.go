@@ -76,7 +76,7 @@ type operation struct {
 	char          rune
 	pos           int
 	str           string
-	val           int32
+	val           int64
 }
 
 func (op operation) String() string {
@@ -195,7 +195,7 @@ func testOperations(t *testing.T, ops []operation) []*crdt.CausalTree {
 			must(err)
 			trees = append(trees, remote)
 		case merge:
-			tree.Merge(trees[op.remote])
+			must(tree.Merge(trees[op.remote]))
 		case check:
 			s, _ := tree.ToJSON()
 			assert.JSONEq(t, op.str, string(s), "%d: got tree[%d] = %q, want equivalent of %q", i, op.local, s, op.str)
@@ -206,6 +206,9 @@ func testOperations(t *testing.T, ops []operation) []*crdt.CausalTree {
 		case insertCounter:
 			must(tree.InsertCounter())
 		}
+		if err := tree.Validate(); err != nil {
+			t.Fatalf("%d: %v: %v", i, op, err)
+		}
 		// Dump trees into testfile.
 		if f != nil && op.op != check {
 			bs, err := json.Marshal(map[string]interface{}{
@@ -269,8 +272,8 @@ func validateOperations(ops []operation) error {
 		case merge:
 			if op.remote >= len(trees) {
 				return fmt.Errorf("invalid remote index %d (len: %d), op: %v", op.remote, len(trees), op)
-			} else {
-				tree.Merge(trees[op.remote])
+			} else if err := tree.Merge(trees[op.remote]); err != nil {
+				return fmt.Errorf("%v: %v", op, err)
 			}
 		case insertStr:
 			if err := tree.InsertStr(); err != nil {
@@ -279,6 +282,9 @@ func validateOperations(ops []operation) error {
 		default:
 			return fmt.Errorf("invalid op %v", op.op)
 		}
+		if err := tree.Validate(); err != nil {
+			return fmt.Errorf("%v: %w", op, err)
+		}
 	}
 	return nil
 }
@@ -329,7 +335,9 @@ func makeRandomTree(size int, r *rand.Rand) (*crdt.CausalTree, error) {
 		i := r.Intn(numLists)
 		t := trees[i]
 		if i > 0 {
-			t.Merge(trees[0])
+			if err := t.Merge(trees[0]); err != nil {
+				return nil, err
+			}
 		}
 		// Insert or deletes 2-5 chars at tree.
 		// 40%: inserts char at random.
@@ -361,7 +369,9 @@ func makeRandomTree(size int, r *rand.Rand) (*crdt.CausalTree, error) {
 			}
 		}
 		if i > 0 {
-			trees[0].Merge(t)
+			if err := trees[0].Merge(t); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return trees[0], nil
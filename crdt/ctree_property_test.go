@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/uuid"
 	"pgregory.net/rapid"
 )
 
@@ -55,6 +56,9 @@ func (m *runesModel) DeleteCharAt(t *rapid.T) {
 }
 
 func (m *runesModel) Check(t *rapid.T) {
+	if err := m.t.Validate(); err != nil {
+		t.Fatal(err)
+	}
 	got := m.t.ToString()
 	want := string(m.chars)
 	if got != want {
@@ -81,8 +85,9 @@ type cursorModel struct {
 }
 
 type multipleRunesModel struct {
-	t     *crdt.CausalTree
-	model []*cursorModel
+	t       *crdt.CausalTree
+	model   []*cursorModel
+	numSite int
 }
 
 func newMultipleRunesModel() *multipleRunesModel {
@@ -109,7 +114,7 @@ func (m *multipleRunesModel) DeleteString(t *rapid.T) {
 		t.Skip("no strings")
 	}
 	i := rapid.IntRange(0, n-1).Draw(t, "i")
-	if err := m.t.DeleteAtom(m.model[i].cursor.GetString().ID); err != nil {
+	if err := m.t.DeleteAtom(m.model[i].cursor.GetString().ID()); err != nil {
 		t.Fatal("(*multipleRunesModel).DeleteString:", err)
 	}
 	if i < n-1 {
@@ -149,10 +154,33 @@ func (m *multipleRunesModel) InsertChar(t *rapid.T) {
 	if char.Snapshot() != ch {
 		t.Error("(*multipleRunesModel).InsertChar: Snapshot:", err)
 	}
-	j := model.index + 1
+	// Chars inserted in the middle of a grapheme cluster are placed after it.
+	j := clusterEnd(t, model.chars, model.index) + 1
 	tail := append([]rune{ch}, model.chars[j:]...)
 	model.chars = append(model.chars[:j], tail...)
-	model.index++
+	model.index = j
+}
+
+// Returns the index of the last char in the grapheme cluster of chars[i], or -1 if i is -1.
+func clusterEnd(t *rapid.T, chars []rune, i int) int {
+	if i < 0 {
+		return i
+	}
+	str, err := crdt.NewCausalTree().SetString()
+	if err != nil {
+		t.Fatal("clusterEnd: SetString:", err)
+	}
+	if _, err := str.Cursor().InsertString(string(chars)); err != nil {
+		t.Fatal("clusterEnd: InsertString:", err)
+	}
+	var end int
+	for _, cluster := range str.Graphemes() {
+		end += len([]rune(cluster))
+		if i < end {
+			break
+		}
+	}
+	return end - 1
 }
 
 func (m *multipleRunesModel) DeleteChar(t *rapid.T) {
@@ -173,7 +201,33 @@ func (m *multipleRunesModel) DeleteChar(t *rapid.T) {
 	model.index--
 }
 
+// Forks the tree into a site that may be sorted before the local one, creates a string there
+// and merges it back. Cursors must keep working after sites are remapped.
+func (m *multipleRunesModel) ForkAndMerge(t *rapid.T) {
+	m.numSite++
+	var siteID uuid.UUID
+	siteID[0] = byte(rapid.IntRange(0, 255).Draw(t, "site"))
+	siteID[1], siteID[2] = byte(m.numSite>>8), byte(m.numSite)
+	remote, err := m.t.ForkWithSiteID(siteID)
+	if err != nil {
+		t.Skip(err)
+	}
+	s, err := remote.SetString()
+	if err != nil {
+		t.Fatal("(*multipleRunesModel).ForkAndMerge: SetString:", err)
+	}
+	if _, err := s.Cursor().Insert('x'); err != nil {
+		t.Fatal("(*multipleRunesModel).ForkAndMerge: Insert:", err)
+	}
+	if err := m.t.Merge(remote); err != nil {
+		t.Fatal("(*multipleRunesModel).ForkAndMerge: Merge:", err)
+	}
+}
+
 func (m *multipleRunesModel) Check(t *rapid.T) {
+	if err := m.t.Validate(); err != nil {
+		t.Fatal(err)
+	}
 	for i, model := range m.model {
 		got := model.cursor.GetString().Snapshot()
 		want := string(model.chars)
@@ -1,13 +1,18 @@
 package crdt_test
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/uuid"
 )
 
@@ -203,6 +208,27 @@ func TestSetCursor(t *testing.T) {
 	})
 }
 
+func TestCharIDs(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	var ids []crdt.AtomID
+	for _, ch := range "abcd" {
+		if err := tree.InsertChar(ch); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, tree.Cursor)
+	}
+	if err := tree.DeleteAt(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.InsertCharAt('x', -1); err != nil {
+		t.Fatal(err)
+	}
+	want := []crdt.AtomID{tree.Cursor, ids[0], ids[2], ids[3]}
+	if diff := cmp.Diff(want, tree.CharIDs()); diff != "" {
+		t.Errorf("CharIDs() (-want, +got):\n%s", diff)
+	}
+}
+
 func TestDeleteAfterMerge(t *testing.T) {
 	teardown := crdt.MockUUIDs(
 		uuid.MustParse("00000001-8891-11ec-a04c-67855c00505b"),
@@ -341,6 +367,9 @@ func TestViewAt(t *testing.T) {
 		if err != nil {
 			t.Fatalf("%v: got err, want nil: %v", test.weft, err)
 		}
+		if err := view.Validate(); err != nil {
+			t.Errorf("%v: %v", test.weft, err)
+		}
 		got := view.ToString()
 		if got != test.want {
 			t.Errorf("%v: got %q, want %q", test.weft, got, test.want)
@@ -508,6 +537,20 @@ func TestMergeMultipleStrContainers(t *testing.T) {
 	})
 }
 
+func TestMergeIntoNestedBlock(t *testing.T) {
+	testOperations(t, []operation{
+		{op: insertCounter, local: 0},
+		{op: insertStr, local: 0},
+		{op: fork, local: 0, remote: 1},
+		// Site #1: insert char into str container, which is not the last root child.
+		{op: insertCharAt, local: 1, char: 'a', pos: 0},
+		{op: check, local: 1, str: `["a", 0]`},
+		// Merge site #1 -> site #0
+		{op: merge, local: 0, remote: 1},
+		{op: check, local: 0, str: `["a", 0]`},
+	})
+}
+
 // -----
 
 //Tests for insertCounter
@@ -635,6 +678,172 @@ func TestInsertCounterDomainCases(t *testing.T) {
 
 /*--------*/
 
+func TestForkWithSiteID(t *testing.T) {
+	id1 := uuid.MustParse("00000001-8891-11ec-a04c-67855c00505b")
+	id2 := uuid.MustParse("00000002-8891-11ec-a04c-67855c00505b")
+	t1 := crdt.NewCausalTreeWithSiteID(id2)
+	t1.InsertChar('a')
+	t2, err := t1.ForkWithSiteID(id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if t2.SiteID != id1 {
+		t.Errorf("got site ID %v, want %v", t2.SiteID, id1)
+	}
+	want := []uuid.UUID{id1, id2}
+	if diff := cmp.Diff(want, t1.Sitemap); diff != "" {
+		t.Errorf("sitemap (-want, +got):\n%s", diff)
+	}
+	t2.InsertChar('b')
+	if err := t1.Merge(t2); err != nil {
+		t.Fatal(err)
+	}
+	if got := t1.ToString(); got != "ab" {
+		t.Errorf("got %q, want %q", got, "ab")
+	}
+	if _, err := t1.ForkWithSiteID(id1); !errors.Is(err, crdt.ErrSiteIDExists) {
+		t.Errorf("want ErrSiteIDExists, got %v", err)
+	}
+}
+
+func TestMergeInvalidRemote(t *testing.T) {
+	tests := []struct {
+		desc    string
+		corrupt func(remote *crdt.CausalTree)
+		wantErr error
+	}{
+		{"bad cause", func(remote *crdt.CausalTree) {
+			setAtom(remote, len(remote.Weave)-1, func(atom *crdt.Atom) {
+				atom.Cause = crdt.AtomID{Site: 1, Index: 50, Timestamp: 2}
+			})
+		}, crdt.ErrInvalidTree},
+		{"forged yarn index", func(remote *crdt.CausalTree) {
+			remote.Yarns[0][0].ID.Index = 1
+		}, crdt.ErrInvalidTree},
+		{"reused atom ID", func(remote *crdt.CausalTree) {
+			setAtom(remote, 0, func(atom *crdt.Atom) {
+				atom.Value = crdt.InsertChar{Char: 'q'}
+			})
+		}, crdt.ErrMergeConflict},
+		{"invalid child", func(remote *crdt.CausalTree) {
+			setAtom(remote, len(remote.Weave)-1, func(atom *crdt.Atom) {
+				atom.Value = crdt.InsertCounter{}
+			})
+		}, crdt.ErrInvalidTree},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			local := makeValidateTree(t)
+			// Remote site is the first in the sitemap, so that merging remaps local sites.
+			remote, err := local.ForkWithSiteID(uuid.MustParse("00000000-0000-0000-0000-000000000001"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote.InsertChar('z')
+			test.corrupt(remote)
+			before := local.Clone()
+			if err := local.Merge(remote); !errors.Is(err, test.wantErr) {
+				t.Fatalf("want %v, got %v", test.wantErr, err)
+			}
+			if diff := cmp.Diff(before, local, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(crdt.CausalTree{})); diff != "" {
+				t.Errorf("local tree changed after rejected merge (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+/*--------*/
+
+func TestFromString(t *testing.T) {
+	for _, s := range []string{"", "a", "crdt", "ação 🎉"} {
+		got, err := crdt.FromString(s)
+		if err != nil {
+			t.Fatalf("%q: %v", s, err)
+		}
+		want := crdt.NewCausalTreeWithSiteID(got.SiteID)
+		for _, ch := range s {
+			if err := want.InsertChar(ch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if diff := cmp.Diff(want, got, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(crdt.CausalTree{})); diff != "" {
+			t.Errorf("%q: (-want, +got):\n%s", s, diff)
+		}
+		if err := got.Validate(); err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
+		if ts := got.ToString(); ts != s {
+			t.Errorf("ToString() = %q (!= %q)", ts, s)
+		}
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	data := `["crdt", 42, "", 0, "olá", -7, [false, 3, "x"], []]`
+	got, err := crdt.FromJSON([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := crdt.NewCausalTreeWithSiteID(got.SiteID)
+	must := func(err error) {
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	addCounter := func(val int64) {
+		c, err := want.SetCounter()
+		must(err)
+		if val != 0 {
+			must(c.Add(val))
+		}
+	}
+	addString := func(s string) {
+		str, err := want.SetString()
+		must(err)
+		_, err = str.Cursor().InsertString(s)
+		must(err)
+	}
+	addSet := func(elems ...interface{}) {
+		set, err := want.SetSet()
+		must(err)
+		for _, elem := range elems {
+			must(set.Add(elem))
+		}
+	}
+	// Create containers from last to first with handles.
+	addSet()
+	addSet(false, 3, "x")
+	addCounter(-7)
+	addString("olá")
+	addCounter(0)
+	addString("")
+	addCounter(42)
+	addString("crdt")
+	if diff := cmp.Diff(want, got, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(crdt.CausalTree{})); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+	bs, err := got.ToJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wantData, gotData interface{}
+	must(json.Unmarshal([]byte(data), &wantData))
+	must(json.Unmarshal(bs, &gotData))
+	if diff := cmp.Diff(wantData, gotData); diff != "" {
+		t.Errorf("ToJSON (-want, +got):\n%s", diff)
+	}
+}
+
+func TestFromJSONError(t *testing.T) {
+	for _, data := range []string{`{}`, `[true]`, `[1.5]`, `[9223372036854775808]`, `[[["a"]]]`, `[[1.5]]`, `[[null]]`, `["a"`} {
+		if _, err := crdt.FromJSON([]byte(data)); err == nil {
+			t.Errorf("%s: want err, got nil", data)
+		}
+	}
+}
+
+/*--------*/
+
 func TestValidateFuzzList(t *testing.T) {
 	f, err := os.Open("testdata/fuzz/FuzzList")
 	defer f.Close()
@@ -779,3 +988,17 @@ func BenchmarkMerge(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkFromString(b *testing.B) {
+	for _, size := range sizes {
+		s := strings.Repeat("x", size)
+		name := fmt.Sprintf("size=%d", size)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := crdt.FromString(s); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
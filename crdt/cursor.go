@@ -3,6 +3,9 @@ package crdt
 import (
 	"fmt"
 	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
 )
 
 // Invokes the closure f for each atom of the causal block, including the head and except for Deletes.
@@ -60,23 +63,68 @@ type Value interface {
 // The atom is always defined by its ID, but we also store its last known position to
 // speed up searching for it. Since trees are insert-only, the atom can only be at this
 // position or to its right.
+//
+// The ID's site index may change when a fork or merge inserts a new site before it in the
+// sitemap, so we also store the site UUID to recompute it.
 type treePosition struct {
-	// ID is the underlying atom ID for this struct.
-	ID AtomID
+	id   AtomID
+	site uuid.UUID
 
 	t            *CausalTree
 	lastKnownPos int
 }
 
+func newTreePosition(t *CausalTree, pos int) treePosition {
+	p := treePosition{t: t}
+	p.setPos(pos)
+	return p
+}
+
+// Points to the atom at the given position.
+func (p *treePosition) setPos(pos int) {
+	p.id = p.t.Weave[pos].ID
+	p.site = p.t.Sitemap[p.id.Site]
+	p.lastKnownPos = pos
+}
+
+// Updates the ID's site index, if the sitemap was remapped since the last usage.
+//
+// Time complexity: O(1), or, O(log(sites)) after a remapping
+func (p *treePosition) remap() {
+	sitemap := p.t.Sitemap
+	if i := int(p.id.Site); i < len(sitemap) && sitemap[i] == p.site {
+		return
+	}
+	p.id.Site = uint16(siteIndex(sitemap, p.site))
+}
+
+// ID returns the underlying atom ID.
+func (p *treePosition) ID() AtomID {
+	p.remap()
+	return p.id
+}
+
 func (p *treePosition) atomIndex() int {
+	p.remap()
 	size := len(p.t.Weave)
 	for i := p.lastKnownPos; i < size; i++ {
-		if p.t.Weave[i].ID == p.ID {
+		if p.t.Weave[i].ID == p.id {
 			p.lastKnownPos = i
 			return i
 		}
 	}
-	panic(fmt.Sprintf("atomID %v not found after position %d (weave size: %d)", p.ID, p.lastKnownPos, size))
+	panic(fmt.Sprintf("atomID %v not found after position %d (weave size: %d)", p.id, p.lastKnownPos, size))
+}
+
+// IsDeleted returns whether the atom has been deleted.
+func (p *treePosition) IsDeleted() bool {
+	i := p.atomIndex()
+	weave := p.t.Weave
+	if i+1 >= len(weave) {
+		return false
+	}
+	_, ok := weave[i+1].Value.(Delete)
+	return ok
 }
 
 func (p *treePosition) walk(f func(pos int, atom Atom, isDeleted bool) bool) {
@@ -95,7 +143,7 @@ func (*String) isValue() {}
 func (s *String) walkChars(f func(i int, atom Atom, isDeleted bool) bool) {
 	s.walk(func(pos int, atom Atom, isDeleted bool) bool {
 		switch atom.Value.(type) {
-		case InsertStr:
+		case InsertStr, InsertMark:
 			return true
 		case InsertChar:
 			return f(pos, atom, isDeleted)
@@ -105,17 +153,24 @@ func (s *String) walkChars(f func(i int, atom Atom, isDeleted bool) bool) {
 	})
 }
 
-// IsDeleted returns whether the string has been deleted.
-func (s *String) IsDeleted() bool {
-	i := s.atomIndex()
-	weave := s.t.Weave
-	if i+1 >= len(weave) {
-		return false
-	}
-	if _, ok := weave[i+1].Value.(Delete); ok {
+// Returns the weave position of the i-th non-deleted char, or -1 if it's out of range.
+func (s *String) charPos(i int) int {
+	// Walk the string starting from head to find the char at position i.
+	indexPos := -1
+	var count int
+	s.walkChars(func(pos int, atom Atom, isDeleted bool) bool {
+		if isDeleted {
+			return true
+		}
+		if count == i {
+			// Found the i-th char, break.
+			indexPos = pos
+			return false
+		}
+		count++
 		return true
-	}
-	return false
+	})
+	return indexPos
 }
 
 // Snapshot returns the string represented by the atom.
@@ -149,6 +204,101 @@ func (s *String) Cursor() *StringCursor {
 	return &StringCursor{s.treePosition, s.treePosition.lastKnownPos}
 }
 
+// ---- String offsets
+
+// Strings are indexed by codepoint (rune), but other systems may count positions in other units,
+// like UTF-16 code units in Javascript, or bytes in a UTF-8 encoded Go string.
+
+func runeUnits(ch rune) int { return 1 }
+
+func utf16Units(ch rune) int {
+	if ch >= 0x10000 && ch <= unicode.MaxRune {
+		// Encoded as a surrogate pair.
+		return 2
+	}
+	return 1
+}
+
+func utf8Units(ch rune) int {
+	if n := utf8.RuneLen(ch); n > 0 {
+		return n
+	}
+	// Invalid runes are encoded as RuneError.
+	return utf8.RuneLen(utf8.RuneError)
+}
+
+// Converts a position measured in 'from' units into 'to' units. The position must be at a char
+// boundary, in range [0:length].
+func (s *String) convertOffset(i int, from, to func(ch rune) int) (int, error) {
+	if i < 0 {
+		return -1, fmt.Errorf("out of bounds")
+	}
+	var a, b int
+	s.walkChars(func(pos int, atom Atom, isDeleted bool) bool {
+		if isDeleted {
+			return true
+		}
+		if a >= i {
+			return false
+		}
+		ch := atom.Value.(InsertChar).Char
+		a += from(ch)
+		b += to(ch)
+		return true
+	})
+	if a < i {
+		return -1, fmt.Errorf("out of bounds")
+	}
+	if a > i {
+		return -1, fmt.Errorf("offset %d is within a char", i)
+	}
+	return b, nil
+}
+
+// Returns the string length in the given units.
+func (s *String) unitLen(units func(ch rune) int) int {
+	var size int
+	s.walkChars(func(pos int, atom Atom, isDeleted bool) bool {
+		if !isDeleted {
+			size += units(atom.Value.(InsertChar).Char)
+		}
+		return true
+	})
+	return size
+}
+
+// UTF16Len returns the size of the string in UTF-16 code units.
+func (s *String) UTF16Len() int {
+	return s.unitLen(utf16Units)
+}
+
+// UTF8Len returns the size of the string in UTF-8 bytes.
+func (s *String) UTF8Len() int {
+	return s.unitLen(utf8Units)
+}
+
+// UTF16Offset converts a string position, in range [0:Len()], into a UTF-16 offset.
+func (s *String) UTF16Offset(i int) (int, error) {
+	return s.convertOffset(i, runeUnits, utf16Units)
+}
+
+// UTF8Offset converts a string position, in range [0:Len()], into a UTF-8 byte offset.
+func (s *String) UTF8Offset(i int) (int, error) {
+	return s.convertOffset(i, runeUnits, utf8Units)
+}
+
+// IndexOfUTF16 converts a UTF-16 offset, in range [0:UTF16Len()], into a string position.
+// Returns an error if the offset is within a surrogate pair.
+func (s *String) IndexOfUTF16(off int) (int, error) {
+	return s.convertOffset(off, utf16Units, runeUnits)
+}
+
+// IndexOfUTF8 converts a UTF-8 byte offset, in range [0:UTF8Len()], into a string position.
+// Returns an error if the offset is within a multi-byte char.
+func (s *String) IndexOfUTF8(off int) (int, error) {
+	return s.convertOffset(off, utf8Units, runeUnits)
+}
+
 // ---- String cursor
 
 // StringCursor is a mutable tree location, initialized to before the first char.
@@ -164,6 +314,11 @@ type StringCursor struct {
 
 // GetString returns a pointer to the cursor's owner string.
 func (cur *StringCursor) GetString() *String {
+	return findString(&cur.treePosition, &cur.lastKnownHeadPos)
+}
+
+// Returns the string containing the atom at p, updating the last known position of its head.
+func findString(p *treePosition, lastKnownHeadPos *int) *String {
 	// Find head.
 	//
 	// Given c0 as the last known position of the pointed-to atom, and c1 its
@@ -173,25 +328,19 @@ func (cur *StringCursor) GetString() *String {
 	//
 	// We search backwards from the end of the range. The first InsertStr atom found
 	// must be the head of the char's string.
-	c0 := cur.lastKnownPos
-	c1 := cur.atomIndex()
-	s0 := cur.lastKnownHeadPos
+	c0 := p.lastKnownPos
+	c1 := p.atomIndex()
+	s0 := *lastKnownHeadPos
 	headPos := -1
 	for j := s0 + (c1 - c0); j >= s0; j-- {
-		atom := cur.t.Weave[j]
+		atom := p.t.Weave[j]
 		if _, ok := atom.Value.(InsertStr); ok {
 			headPos = j
-			cur.lastKnownHeadPos = j
+			*lastKnownHeadPos = j
 			break
 		}
 	}
-	return &String{
-		treePosition{
-			ID:           cur.t.Weave[headPos].ID,
-			t:            cur.t,
-			lastKnownPos: headPos,
-		},
-	}
+	return &String{newTreePosition(p.t, headPos)}
 }
 
 // Index moves the cursor to the given string position.
@@ -203,33 +352,40 @@ func (cur *StringCursor) Index(i int) error {
 	s := cur.GetString()
 	if i == -1 {
 		// Move cursor to string head.
-		cur.ID = s.ID
-		cur.lastKnownPos = s.lastKnownPos
+		cur.treePosition = s.treePosition
 		return nil
 	}
-	// Walk the string starting from head to find the char at position i.
-	indexPos := -1
-	var count int
-	s.walkChars(func(pos int, atom Atom, isDeleted bool) bool {
-		if isDeleted {
-			return true
-		}
-		if count == i {
-			// Found the i-th char, break.
-			indexPos = pos
-			return false
-		}
-		count++
-		return true
-	})
+	indexPos := s.charPos(i)
 	if indexPos == -1 {
 		return fmt.Errorf("out of bounds")
 	}
-	cur.ID = cur.t.Weave[indexPos].ID
-	cur.lastKnownPos = indexPos
+	cur.setPos(indexPos)
 	return nil
 }
 
+// IndexUTF16 moves the cursor to the char starting at the given UTF-16 offset, or to the
+// string head if off is -1. Returns an error if no char starts at this offset.
+func (cur *StringCursor) IndexUTF16(off int) error {
+	return cur.indexOffset(off, utf16Units)
+}
+
+// IndexUTF8 moves the cursor to the char starting at the given UTF-8 byte offset, or to the
+// string head if off is -1. Returns an error if no char starts at this offset.
+func (cur *StringCursor) IndexUTF8(off int) error {
+	return cur.indexOffset(off, utf8Units)
+}
+
+func (cur *StringCursor) indexOffset(off int, units func(ch rune) int) error {
+	if off == -1 {
+		return cur.Index(-1)
+	}
+	i, err := cur.GetString().convertOffset(off, units, runeUnits)
+	if err != nil {
+		return err
+	}
+	return cur.Index(i)
+}
+
 // Value returns the character pointed by the cursor.
 // Returns an error if cursor is pointing to the string head.
 func (cur *StringCursor) Value() (rune, error) {
@@ -245,21 +401,56 @@ func (cur *StringCursor) Value() (rune, error) {
 	}
 }
 
-// Insert inserts a new character after the cursor.
-// The cursor is moved to the new character.
+// Char returns the char pointed by the cursor.
+// Returns an error if cursor is pointing to the string head.
+func (cur *StringCursor) Char() (*Char, error) {
+	pos := cur.atomIndex()
+	if _, ok := cur.t.Weave[pos].Value.(InsertStr); ok {
+		return nil, fmt.Errorf("out of bounds")
+	}
+	return &Char{cur.treePosition, cur.lastKnownHeadPos}, nil
+}
+
+// Insert inserts a new character after the cursor, or after its grapheme cluster if the cursor is
+// in the middle of one. The cursor is moved to the new character.
 // Returns an error if atom insertion failed.
 func (cur *StringCursor) Insert(ch rune) (*Char, error) {
-	pos := cur.atomIndex()
-	atomPos, err := cur.t.addAtom2(pos, InsertChar{ch})
+	s := cur.GetString()
+	pos := s.insertPos(cur.atomIndex())
+	atomPos, err := cur.t.addAtom(pos, InsertChar{ch})
 	if err != nil {
 		return nil, err
 	}
 	// Move cursor to new atom.
-	cur.lastKnownPos = atomPos
-	cur.ID = cur.t.Weave[atomPos].ID
+	cur.setPos(atomPos)
 	return &Char{cur.treePosition, cur.lastKnownHeadPos}, nil
 }
 
+// InsertString inserts all characters of str after the cursor, or after its grapheme cluster if
+// the cursor is in the middle of one, as a single operation.
+// The cursor is moved to the last inserted character, which is returned, or nil if str is empty.
+// Returns an error if atom insertion failed.
+func (cur *StringCursor) InsertString(str string) (*Char, error) {
+	s := cur.GetString()
+	pos := s.insertPos(cur.atomIndex())
+	values := charValues(str)
+	atomPos, err := cur.t.addAtomChain(pos, values)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	// Move cursor to last new atom.
+	cur.setPos(atomPos + len(values) - 1)
+	return &Char{cur.treePosition, cur.lastKnownHeadPos}, nil
+}
+
+func charValues(str string) []AtomValue {
+	var values []AtomValue
+	for _, ch := range str {
+		values = append(values, InsertChar{ch})
+	}
+	return values
+}
+
 // Delete removes the character pointed by the cursor.
 // Returns an error if cursor is pointing to the string head.
 func (cur *StringCursor) Delete() error {
@@ -268,9 +459,10 @@ func (cur *StringCursor) Delete() error {
 	if _, ok := atom.Value.(InsertStr); ok {
 		return fmt.Errorf("out of bounds")
 	}
-	if _, err := cur.t.addAtom2(pos, Delete{}); err != nil {
+	if _, err := cur.t.addAtom(pos, Delete{}); err != nil {
 		return err
 	}
+	cur.t.fixDeletedCursor()
 	// Fix cursor position, moving it one to the left.
 	// In this sense, "delete" is like the backspace key.
 	//    v
@@ -282,10 +474,8 @@ func (cur *StringCursor) Delete() error {
 	s := cur.GetString()
 	prevPos := cur.lastKnownHeadPos
 	s.walkChars(func(pos int, atom Atom, isDeleted bool) bool {
-		if atom.ID == cur.ID {
-			prev := cur.t.Weave[prevPos]
-			cur.ID = prev.ID
-			cur.lastKnownPos = prevPos
+		if atom.ID == cur.id {
+			cur.setPos(prevPos)
 			return false
 		}
 		if !isDeleted {
@@ -296,9 +486,71 @@ func (cur *StringCursor) Delete() error {
 	return nil
 }
 
+// ---- String bulk operations
+
+// DeleteRange removes the characters in range [start:end) of the string, as a single operation.
+// Returns an error if range is out of bounds [0:Len()].
+func (s *String) DeleteRange(start, end int) error {
+	if start < 0 || start > end {
+		return fmt.Errorf("out of bounds")
+	}
+	var positions []int
+	var count int
+	s.walkChars(func(pos int, atom Atom, isDeleted bool) bool {
+		if isDeleted {
+			return true
+		}
+		if count >= end {
+			return false
+		}
+		if count >= start {
+			positions = append(positions, pos)
+		}
+		count++
+		return true
+	})
+	if count < end {
+		return fmt.Errorf("out of bounds")
+	}
+	if err := s.t.deleteAtoms(positions); err != nil {
+		return err
+	}
+	s.t.fixDeletedCursor()
+	return nil
+}
+
+// ReplaceRange replaces the characters in range [start:end) of the string with str, as a single
+// operation. Returns the last inserted character, or nil if str is empty.
+// Returns an error if range is out of bounds [0:Len()].
+func (s *String) ReplaceRange(start, end int, str string) (*Char, error) {
+	// Insert after the last char before the range, or the head.
+	causePos := s.atomIndex()
+	if start > 0 {
+		causePos = s.charPos(start - 1)
+		if causePos < 0 {
+			return nil, fmt.Errorf("out of bounds")
+		}
+	}
+	if err := s.DeleteRange(start, end); err != nil {
+		return nil, err
+	}
+	// Deleted atoms are all after the cause, so its position is unchanged. Chars are inserted
+	// after the cause's grapheme cluster, as in StringCursor.Insert.
+	causePos = s.insertPos(causePos)
+	values := charValues(str)
+	atomPos, err := s.t.addAtomChain(causePos, values)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	return &Char{newTreePosition(s.t, atomPos+len(values)-1), s.lastKnownPos}, nil
+}
+
 // ---- String char
 
 // Char is an immutable tree location, pointing to an InsertChar atom.
+//
+// It remains valid after the char is deleted, and may be used as an anchor to the place where
+// the char was.
 type Char struct {
 	treePosition
 
@@ -306,99 +558,118 @@ type Char struct {
 	lastKnownHeadPos int
 }
 
+// Snapshot returns the char value, even if it was deleted.
 func (ch *Char) Snapshot() rune {
 	pos := ch.atomIndex()
 	return ch.t.Weave[pos].Value.(InsertChar).Char
 }
 
-// TODO: (*Char).IsDeleted() bool
-// TODO: (*Char).GetString() *String
-// TODO: (*Char).GetStringCursor() *StringCursor
+// GetString returns a pointer to the char's owner string.
+func (ch *Char) GetString() *String {
+	return findString(&ch.treePosition, &ch.lastKnownHeadPos)
+}
+
+// GetStringCursor returns a cursor pointing to this char.
+//
+// If the char is deleted, the cursor still points to it, and inserted chars will be placed
+// where it was.
+func (ch *Char) GetStringCursor() *StringCursor {
+	ch.GetString()
+	return &StringCursor{ch.treePosition, ch.lastKnownHeadPos}
+}
+
+// Index returns the char position within its string.
+//
+// If the char is deleted, returns the position of the closest non-deleted char before it,
+// or -1 if there's none.
+func (ch *Char) Index() int {
+	i := -1
+	ch.GetString().walkChars(func(pos int, atom Atom, isDeleted bool) bool {
+		if !isDeleted {
+			i++
+		}
+		return atom.ID != ch.id
+	})
+	return i
+}
 
 // ---- CausalTree methods
 
 // StringValue returns a wrapper over InsertStr.
 func (t *CausalTree) StringValue(atomID AtomID) (*String, error) {
-	i := t.atomIndex(atomID)
+	i, err := t.findAtom(atomID)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("%v is not an InsertStr atom: root", atomID)
+	}
 	atom := t.Weave[i]
 	if _, ok := atom.Value.(InsertStr); !ok {
 		return nil, fmt.Errorf("%v is not an InsertStr atom: %T (%v)", atomID, atom, atom)
 	}
-	return &String{treePosition{
-		ID:           atomID,
-		t:            t,
-		lastKnownPos: i,
-	}}, nil
+	return &String{newTreePosition(t, i)}, nil
 }
 
-// SetString sets the tree register to a new string and returns it.
-func (t *CausalTree) SetString() (*String, error) {
-	// TODO: change implementation to remove internal cursor from CausalTree.
-	if err := t.InsertStr(); err != nil {
+// CharValue returns a wrapper over InsertChar, that may be deleted.
+// Returns an error if the char isn't within a string.
+func (t *CausalTree) CharValue(atomID AtomID) (*Char, error) {
+	i, err := t.findAtom(atomID)
+	if err != nil {
 		return nil, err
 	}
-	return t.StringValue(t.Cursor)
-}
-
-// DeleteAtom deletes the given atom from the tree.
-func (t *CausalTree) DeleteAtom(atomID AtomID) error {
-	// TODO: change implementation to remove internal cursor from CausalTree.
-	t.Cursor = atomID
-	return t.Delete()
+	if i < 0 {
+		return nil, fmt.Errorf("%v is not an InsertChar atom: root", atomID)
+	}
+	atom := t.Weave[i]
+	if _, ok := atom.Value.(InsertChar); !ok {
+		return nil, fmt.Errorf("%v is not an InsertChar atom: %T (%v)", atomID, atom, atom)
+	}
+	headPos := t.charStringPos(i)
+	if headPos < 0 {
+		return nil, fmt.Errorf("char %v is not within a string", atomID)
+	}
+	return &Char{newTreePosition(t, i), headPos}, nil
 }
 
-// TODO: MOVE THIS TO ctree.go AFTER ISSUE #5.
-//
-// This is a copy of addAtom, but using the known position of the cause.
-func (t *CausalTree) addAtom2(causePos int, value AtomValue) (int, error) {
-	t.Timestamp++
-	if t.Timestamp == 0 {
-		// Overflow
-		return -1, ErrStateLimitExceeded
-	}
-	var causeID AtomID
-	if causePos >= 0 {
-		cause := t.Weave[causePos]
-		causeID = cause.ID
-		if err := cause.Value.ValidateChild(value); err != nil {
-			return -1, err
+// Returns the position of the string containing the char at position i, or -1 if the char
+// descends from the root, as in trees built by the legacy API.
+func (t *CausalTree) charStringPos(i int) int {
+	head := t.Weave[i]
+	for {
+		if head.Cause.Timestamp == 0 {
+			return -1
+		}
+		head = t.getAtom(head.Cause)
+		if _, ok := head.Value.(InsertStr); ok {
+			return t.atomIndex(head.ID)
 		}
 	}
-	i := siteIndex(t.Sitemap, t.SiteID)
-	atomID := AtomID{
-		Site:      uint16(i),
-		Index:     uint32(len(t.Yarns[i])),
-		Timestamp: t.Timestamp,
-	}
-	atom := Atom{
-		ID:    atomID,
-		Cause: causeID,
-		Value: value,
+}
+
+// SetString sets the tree register to a new string and returns it.
+func (t *CausalTree) SetString() (*String, error) {
+	i, err := t.addAtom(-1, InsertStr{})
+	if err != nil {
+		return nil, err
 	}
-	atomPos := t.insertAtomAtCursor2(causePos, atom)
-	t.Yarns[i] = append(t.Yarns[i], atom)
-	return atomPos, nil
+	return &String{newTreePosition(t, i)}, nil
 }
 
-// TODO: MOVE THIS TO ctree.go AFTER ISSUE #5.
+// DeleteAtom deletes the given atom from the tree.
 //
-// This is a copy of insertAtomAtCursor, but using the known position of the cause.
-func (t *CausalTree) insertAtomAtCursor2(causePos int, atom Atom) int {
-	if causePos < 0 {
-		// Cursor is at initial position.
-		t.insertAtom(atom, 0)
-		return 0
+// If the tree's cursor is deleted, it's relocated to its first non-deleted ancestor.
+func (t *CausalTree) DeleteAtom(atomID AtomID) error {
+	i, err := t.findAtom(atomID)
+	if err != nil {
+		return err
 	}
-	causeID := t.Weave[causePos].ID
-	insertPos := causePos + 1
-	walkCausalBlock(t.Weave[causePos:], func(a Atom) bool {
-		if a.Cause == causeID && a.Compare(atom) < 0 {
-			// a is the first child smaller than atom, break.
-			return false
-		}
-		insertPos++
-		return true
-	})
-	t.insertAtom(atom, insertPos)
-	return insertPos
+	if i < 0 {
+		return ErrNoAtomToDelete
+	}
+	if _, err := t.addAtom(i, Delete{}); err != nil {
+		return err
+	}
+	t.fixDeletedCursor()
+	return nil
 }
@@ -1,10 +1,14 @@
 package crdt_test
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
 )
 
 func TestString(t *testing.T) {
@@ -328,3 +332,610 @@ func TestStringCursorDelete(t *testing.T) {
 		})
 	}
 }
+
+func TestIndependentStringCursors(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	str, err := tree.SetString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two parts of an app editing the same string, with their own cursors.
+	cur1, cur2 := str.Cursor(), str.Cursor()
+	for _, ch := range "ace" {
+		if _, err := cur1.Insert(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cur2.Index(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cur2.Insert('b'); err != nil {
+		t.Fatal(err)
+	}
+	// cur1 is still at the end of the string.
+	if _, err := cur1.Insert('f'); err != nil {
+		t.Fatal(err)
+	}
+	if err := cur2.Index(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cur2.Insert('d'); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := str.Snapshot(), "abcdef"; got != want {
+		t.Errorf("str.Snapshot() = %q (!= %q)", got, want)
+	}
+	if err := cur1.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := str.Snapshot(), "abcde"; got != want {
+		t.Errorf("str.Snapshot() = %q (!= %q)", got, want)
+	}
+	// Handles don't use the tree's cursor.
+	if tree.Cursor != (crdt.AtomID{}) {
+		t.Errorf("tree.Cursor = %v, want root", tree.Cursor)
+	}
+	if err := tree.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	counter, err := tree.SetCounter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, val := range []int64{10, -3, 5} {
+		if err := counter.Add(val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remote, err := tree.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteCounter, err := remote.CounterValue(counter.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remoteCounter.Add(20); err != nil {
+		t.Fatal(err)
+	}
+	if err := counter.Add(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Merge(remote); err != nil {
+		t.Fatal(err)
+	}
+	counter, err = tree.CounterValue(counter.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := counter.Snapshot(), int64(33); got != want {
+		t.Errorf("counter.Snapshot() = %d (!= %d)", got, want)
+	}
+	if counter.IsDeleted() {
+		t.Errorf("counter.IsDeleted() = true")
+	}
+	if err := tree.DeleteAtom(counter.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if !counter.IsDeleted() {
+		t.Errorf("counter.IsDeleted() = false")
+	}
+	if tree.Cursor != (crdt.AtomID{}) {
+		t.Errorf("tree.Cursor = %v, want root", tree.Cursor)
+	}
+	if _, err := tree.StringValue(counter.ID()); err == nil {
+		t.Errorf("StringValue(counter): want err, got nil")
+	}
+	if _, err := tree.CounterValue(crdt.AtomID{0, 99, 99}); !errors.Is(err, crdt.ErrAtomNotFound) {
+		t.Errorf("CounterValue(unknown): want ErrAtomNotFound, got %v", err)
+	}
+}
+
+func TestCursorAcrossMerges(t *testing.T) {
+	// Every fork creates a site sorted before the previous ones, so that local atoms are remapped.
+	siteID := func(i byte) uuid.UUID { return uuid.UUID{0xff - i} }
+	local := crdt.NewCausalTreeWithSiteID(siteID(0))
+	str, err := local.SetString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := str.Cursor()
+	first, err := cur.Insert('a')
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := byte(1); i <= 3; i++ {
+		remote, err := local.ForkWithSiteID(siteID(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		remoteStr, err := remote.StringValue(str.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := remoteStr.Cursor().Insert('-'); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cur.Insert('b' + rune(i-1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := local.Merge(remote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := str.Snapshot(), "---abcd"; got != want {
+		t.Errorf("str.Snapshot() = %q (!= %q)", got, want)
+	}
+	if got, want := cur.ID().Site, uint16(3); got != want {
+		t.Errorf("cur.ID().Site = %d (!= %d)", got, want)
+	}
+	if got, want := first.Snapshot(), 'a'; got != want {
+		t.Errorf("first.Snapshot() = %c (!= %c)", got, want)
+	}
+	if _, err := cur.Insert('e'); err != nil {
+		t.Fatal(err)
+	}
+	if err := cur.Index(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := cur.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := str.Snapshot(), "---bcde"; got != want {
+		t.Errorf("str.Snapshot() = %q (!= %q)", got, want)
+	}
+	if err := local.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChar(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	str, err := tree.SetString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur := str.Cursor()
+	var chars []*crdt.Char
+	for _, ch := range "crdt" {
+		char, err := cur.Insert(ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chars = append(chars, char)
+	}
+	// Delete 'r' at a remote, and insert a char before it locally.
+	remote, err := tree.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteStr, err := remote.StringValue(str.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteCur := remoteStr.Cursor()
+	if err := remoteCur.Index(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := remoteCur.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Cursor().Insert('>'); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Merge(remote); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := str.Snapshot(), ">cdt"; got != want {
+		t.Fatalf("str.Snapshot() = %q (!= %q)", got, want)
+	}
+	tests := []struct {
+		char      rune
+		isDeleted bool
+		index     int
+	}{
+		{'c', false, 1},
+		{'r', true, 1},
+		{'d', false, 2},
+		{'t', false, 3},
+	}
+	for i, test := range tests {
+		char := chars[i]
+		if got := char.Snapshot(); got != test.char {
+			t.Errorf("chars[%d].Snapshot() = %c (!= %c)", i, got, test.char)
+		}
+		if got := char.IsDeleted(); got != test.isDeleted {
+			t.Errorf("chars[%d].IsDeleted() = %t (!= %t)", i, got, test.isDeleted)
+		}
+		if got := char.Index(); got != test.index {
+			t.Errorf("chars[%d].Index() = %d (!= %d)", i, got, test.index)
+		}
+		if got := char.GetString().ID(); got != str.ID() {
+			t.Errorf("chars[%d].GetString().ID() = %v (!= %v)", i, got, str.ID())
+		}
+	}
+	// Insert where the deleted char was.
+	if _, err := chars[1].GetStringCursor().Insert('R'); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := str.Snapshot(), ">cRdt"; got != want {
+		t.Errorf("str.Snapshot() = %q (!= %q)", got, want)
+	}
+	cur = chars[3].GetStringCursor()
+	if err := cur.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	char, err := cur.Char()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := char.Snapshot(); got != 'd' {
+		t.Errorf("cur.Char().Snapshot() = %c (!= d)", got)
+	}
+	if err := cur.Index(-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cur.Char(); err == nil {
+		t.Errorf("cur.Char() at string head: want err, got nil")
+	}
+}
+
+func TestCharValue(t *testing.T) {
+	tree, str := makeString(t, "crdt")
+	cur := str.Cursor()
+	if err := cur.Index(1); err != nil {
+		t.Fatal(err)
+	}
+	r, err := cur.Char()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cur.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	// Get a deleted char by its ID, and insert where it was.
+	char, err := tree.CharValue(r.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := char.Snapshot(); got != 'r' {
+		t.Errorf("char.Snapshot() = %c (!= r)", got)
+	}
+	if !char.IsDeleted() {
+		t.Errorf("char.IsDeleted() = false (!= true)")
+	}
+	if _, err := char.GetStringCursor().Insert('R'); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := str.Snapshot(), "cRdt"; got != want {
+		t.Errorf("str.Snapshot() = %q (!= %q)", got, want)
+	}
+	if _, err := tree.CharValue(str.ID()); err == nil {
+		t.Errorf("CharValue(str): want err, got nil")
+	}
+	// Chars inserted by the legacy API at the root aren't within a string.
+	legacy := crdt.NewCausalTree()
+	if err := legacy.InsertChar('x'); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := legacy.CharValue(legacy.Cursor); err == nil {
+		t.Errorf("CharValue(root char): want err, got nil")
+	}
+}
+
+// Returns a tree with a string "hello world", where "big " was inserted and deleted by another site.
+func makeBulkTree(t *testing.T) (*crdt.CausalTree, crdt.AtomID) {
+	tree, str := makeString(t, "hello world")
+	editRemote(t, tree, str, func(cur *crdt.StringCursor) error {
+		if err := cur.Index(5); err != nil {
+			return err
+		}
+		if _, err := cur.InsertString("big "); err != nil {
+			return err
+		}
+		for i := 0; i < 4; i++ {
+			if err := cur.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return tree, str.ID()
+}
+
+func TestBulkOperations(t *testing.T) {
+	tests := []struct {
+		desc      string
+		bulk      func(s *crdt.String) error
+		perRune   func(s *crdt.String) error
+		wantValue string
+	}{
+		{
+			"insert string",
+			func(s *crdt.String) error {
+				cur := s.Cursor()
+				if err := cur.Index(4); err != nil {
+					return err
+				}
+				char, err := cur.InsertString(", dear")
+				if err == nil && char.Snapshot() != 'r' {
+					return fmt.Errorf("want last char 'r', got %c", char.Snapshot())
+				}
+				return err
+			},
+			func(s *crdt.String) error {
+				cur := s.Cursor()
+				if err := cur.Index(4); err != nil {
+					return err
+				}
+				for _, ch := range ", dear" {
+					if _, err := cur.Insert(ch); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			"hello, dear world",
+		},
+		{
+			"delete range",
+			func(s *crdt.String) error {
+				return s.DeleteRange(3, 8)
+			},
+			func(s *crdt.String) error {
+				cur := s.Cursor()
+				for i := 3; i < 8; i++ {
+					if err := cur.Index(3); err != nil {
+						return err
+					}
+					if err := cur.Delete(); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			"helrld",
+		},
+		{
+			"replace range",
+			func(s *crdt.String) error {
+				_, err := s.ReplaceRange(6, 11, "there")
+				return err
+			},
+			func(s *crdt.String) error {
+				if err := s.DeleteRange(6, 11); err != nil {
+					return err
+				}
+				cur := s.Cursor()
+				if err := cur.Index(5); err != nil {
+					return err
+				}
+				for _, ch := range "there" {
+					if _, err := cur.Insert(ch); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			"hello there",
+		},
+		{
+			"empty operations",
+			func(s *crdt.String) error {
+				if char, err := s.Cursor().InsertString(""); err != nil || char != nil {
+					return fmt.Errorf("InsertString: got (%v, %v), want (nil, nil)", char, err)
+				}
+				if err := s.DeleteRange(11, 11); err != nil {
+					return err
+				}
+				_, err := s.ReplaceRange(0, 0, "")
+				return err
+			},
+			func(s *crdt.String) error { return nil },
+			"hello world",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			tree1, id := makeBulkTree(t)
+			tree2 := tree1.Clone()
+			s1, err := tree1.StringValue(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s2, err := tree2.StringValue(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.bulk(s1); err != nil {
+				t.Fatalf("bulk: %v", err)
+			}
+			if err := test.perRune(s2); err != nil {
+				t.Fatalf("per rune: %v", err)
+			}
+			if err := tree1.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := s1.Snapshot(); got != test.wantValue {
+				t.Errorf("got %q, want %q", got, test.wantValue)
+			}
+			// Bulk operations must be indistinguishable from their per-rune counterparts.
+			if diff := cmp.Diff(tree2.Weave, tree1.Weave); diff != "" {
+				t.Errorf("weave mismatch (-per rune, +bulk):\n%s", diff)
+			}
+			if diff := cmp.Diff(tree2.Yarns, tree1.Yarns); diff != "" {
+				t.Errorf("yarns mismatch (-per rune, +bulk):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBulkOperationsOutOfBounds(t *testing.T) {
+	tree, id := makeBulkTree(t)
+	str, err := tree.StringValue(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]int{{-1, 2}, {3, 2}, {5, 12}} {
+		if err := str.DeleteRange(r[0], r[1]); err == nil {
+			t.Errorf("DeleteRange(%d, %d): want err, got nil", r[0], r[1])
+		}
+		if _, err := str.ReplaceRange(r[0], r[1], "x"); err == nil {
+			t.Errorf("ReplaceRange(%d, %d): want err, got nil", r[0], r[1])
+		}
+	}
+	if got, want := str.Snapshot(), "hello world"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// -----
+
+var bulkText = strings.Repeat("lorem ipsum ", 1000)
+
+// Pastes a text in the middle of a string with the same size.
+func BenchmarkInsertString(b *testing.B) {
+	tree := crdt.NewCausalTree()
+	str, _ := tree.SetString()
+	str.Cursor().InsertString(bulkText)
+	n := len(bulkText)
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			t1 := tree.Clone()
+			s1, _ := t1.StringValue(str.ID())
+			cur := s1.Cursor()
+			cur.Index(n / 2)
+			if _, err := cur.InsertString(bulkText); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("per-rune", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			t1 := tree.Clone()
+			s1, _ := t1.StringValue(str.ID())
+			cur := s1.Cursor()
+			cur.Index(n / 2)
+			for _, ch := range bulkText {
+				if _, err := cur.Insert(ch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+// Deletes half of a string.
+func BenchmarkDeleteRange(b *testing.B) {
+	tree := crdt.NewCausalTree()
+	str, _ := tree.SetString()
+	str.Cursor().InsertString(bulkText)
+	n := len(bulkText)
+	b.Run("bulk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			t1 := tree.Clone()
+			s1, _ := t1.StringValue(str.ID())
+			if err := s1.DeleteRange(n/4, 3*n/4); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("per-rune", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			t1 := tree.Clone()
+			s1, _ := t1.StringValue(str.ID())
+			cur := s1.Cursor()
+			for j := n / 4; j < 3*n/4; j++ {
+				cur.Index(n / 4)
+				if err := cur.Delete(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestStringOffsets(t *testing.T) {
+	// Chars with 1, 2 (surrogate pair), 1 and 2 UTF-16 units, and 1, 4, 2 and 3 UTF-8 bytes.
+	tree, str := makeString(t, "a🎉ç€x")
+	editRemote(t, tree, str, func(cur *crdt.StringCursor) error {
+		// Delete 'x', which shouldn't be counted.
+		if err := cur.Index(4); err != nil {
+			return err
+		}
+		return cur.Delete()
+	})
+	if got, want := str.UTF16Len(), 5; got != want {
+		t.Errorf("UTF16Len() = %d (!= %d)", got, want)
+	}
+	if got, want := str.UTF8Len(), len("a🎉ç€"); got != want {
+		t.Errorf("UTF8Len() = %d (!= %d)", got, want)
+	}
+	tests := []struct {
+		index, utf16, utf8 int
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{2, 3, 5},
+		{3, 4, 7},
+		{4, 5, 10},
+	}
+	for _, test := range tests {
+		if got, err := str.UTF16Offset(test.index); got != test.utf16 || err != nil {
+			t.Errorf("UTF16Offset(%d) = (%d, %v) (!= %d)", test.index, got, err, test.utf16)
+		}
+		if got, err := str.UTF8Offset(test.index); got != test.utf8 || err != nil {
+			t.Errorf("UTF8Offset(%d) = (%d, %v) (!= %d)", test.index, got, err, test.utf8)
+		}
+		if got, err := str.IndexOfUTF16(test.utf16); got != test.index || err != nil {
+			t.Errorf("IndexOfUTF16(%d) = (%d, %v) (!= %d)", test.utf16, got, err, test.index)
+		}
+		if got, err := str.IndexOfUTF8(test.utf8); got != test.index || err != nil {
+			t.Errorf("IndexOfUTF8(%d) = (%d, %v) (!= %d)", test.utf8, got, err, test.index)
+		}
+	}
+	// Offsets within a char, or out of bounds.
+	for _, off := range []int{-1, 2, 6} {
+		if _, err := str.IndexOfUTF16(off); err == nil {
+			t.Errorf("IndexOfUTF16(%d): want err, got nil", off)
+		}
+	}
+	for _, off := range []int{-1, 2, 3, 4, 6, 8, 11} {
+		if _, err := str.IndexOfUTF8(off); err == nil {
+			t.Errorf("IndexOfUTF8(%d): want err, got nil", off)
+		}
+	}
+	if _, err := str.UTF16Offset(5); err == nil {
+		t.Errorf("UTF16Offset(5): want err, got nil")
+	}
+	// Move cursor by offsets.
+	cur := str.Cursor()
+	if err := cur.IndexUTF16(3); err != nil {
+		t.Fatal(err)
+	}
+	if ch, _ := cur.Value(); ch != 'ç' {
+		t.Errorf("IndexUTF16(3): got char %c, want ç", ch)
+	}
+	if err := cur.IndexUTF8(1); err != nil {
+		t.Fatal(err)
+	}
+	if ch, _ := cur.Value(); ch != '🎉' {
+		t.Errorf("IndexUTF8(1): got char %c, want 🎉", ch)
+	}
+	if err := cur.IndexUTF16(2); err == nil {
+		t.Errorf("IndexUTF16(2): want err, got nil")
+	}
+	if err := cur.IndexUTF8(10); err == nil {
+		t.Errorf("IndexUTF8(10): want err, got nil")
+	}
+	if err := cur.IndexUTF16(-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cur.Value(); err == nil {
+		t.Errorf("IndexUTF16(-1): want cursor at head")
+	}
+}
@@ -0,0 +1,519 @@
+package crdt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// +-------+
+// | Delta |
+// +-------+
+
+// Delta is a set of atoms extracted from a tree, which may be applied to another replica.
+//
+// Atoms in a delta refer to sites by their index in the delta's own Sitemap, so that it
+// may be exchanged between trees with different sitemaps. Each yarn holds a contiguous
+// range of a site's atoms, not necessarily starting from its first atom.
+type Delta struct {
+	// Sitemap is the ordered list of site IDs referenced by atoms in this delta.
+	Sitemap []uuid.UUID
+	// Yarns is the list of atoms, grouped by the site that created them.
+	Yarns [][]Atom
+}
+
+// Errors returned by Delta operations.
+var (
+	ErrDeltaInvalid      = errors.New("delta is malformed")
+	ErrDeltaGap          = errors.New("delta doesn't continue from the last known atom of a site")
+	ErrDeltaConflict     = errors.New("delta has an atom with same ID but different contents")
+	ErrDeltaMissingCause = errors.New("delta has an atom whose cause is unknown")
+)
+
+// Len returns the number of atoms in the delta.
+func (d *Delta) Len() int {
+	var n int
+	for _, yarn := range d.Yarns {
+		n += len(yarn)
+	}
+	return n
+}
+
+// DeltaSince returns the atoms that are not known by a replica whose state is given by its
+// sitemap and Now() weft. Use nil for both to get every atom in the tree.
+//
+// Time complexity: O(atoms + sites*log(sites))
+func (t *CausalTree) DeltaSince(sitemap []uuid.UUID, weft Weft) (*Delta, error) {
+	if len(sitemap) != len(weft) {
+		return nil, ErrWeftInvalidLength
+	}
+	// 1. Find the first unknown atom at each local yarn.
+	starts := make([]int, len(t.Yarns))
+	for i, yarn := range t.Yarns {
+		j := siteIndex(sitemap, t.Sitemap[i])
+		if j == len(sitemap) || sitemap[j] != t.Sitemap[i] {
+			continue
+		}
+		tmax := weft[j]
+		starts[i] = sort.Search(len(yarn), func(k int) bool {
+			return yarn[k].ID.Timestamp > tmax
+		})
+	}
+	// 2. Select sites that have unknown atoms, or that are referenced by them.
+	used := make([]bool, len(t.Yarns))
+	for i, yarn := range t.Yarns {
+		for _, atom := range yarn[starts[i]:] {
+			used[i] = true
+			for _, ref := range atom.references() {
+				if ref.Timestamp > 0 {
+					used[ref.Site] = true
+				}
+			}
+		}
+	}
+	// 3. Build delta with a compact sitemap.
+	remap := make(indexMap)
+	d := &Delta{}
+	for i, isUsed := range used {
+		if isUsed {
+			remap.set(i, len(d.Sitemap))
+			d.Sitemap = append(d.Sitemap, t.Sitemap[i])
+		}
+	}
+	d.Yarns = make([][]Atom, len(d.Sitemap))
+	for i, yarn := range t.Yarns {
+		if !used[i] {
+			continue
+		}
+		atoms := make([]Atom, 0, len(yarn)-starts[i])
+		for _, atom := range yarn[starts[i]:] {
+			atoms = append(atoms, atom.remapSite(remap))
+		}
+		d.Yarns[remap.get(i)] = atoms
+	}
+	return d, nil
+}
+
+// Checks that the delta is well-formed on its own, without considering any tree.
+//
+// Time complexity: O(atoms + sites)
+func (d *Delta) check() error {
+	if len(d.Sitemap) != len(d.Yarns) {
+		return fmt.Errorf("%w: sitemap has %d sites, but there are %d yarns", ErrDeltaInvalid, len(d.Sitemap), len(d.Yarns))
+	}
+	for i := 1; i < len(d.Sitemap); i++ {
+		if bytes.Compare(d.Sitemap[i-1][:], d.Sitemap[i][:]) >= 0 {
+			return fmt.Errorf("%w: sitemap is not sorted at index %d", ErrDeltaInvalid, i)
+		}
+	}
+	for i, yarn := range d.Yarns {
+		for j, atom := range yarn {
+			if int(atom.ID.Site) != i {
+				return fmt.Errorf("%w: atom %v is in yarn #%d", ErrDeltaInvalid, atom.ID, i)
+			}
+			if j > 0 && atom.ID.Index != yarn[j-1].ID.Index+1 {
+				return fmt.Errorf("%w: yarn #%d is not contiguous at %v", ErrDeltaInvalid, i, atom.ID)
+			}
+			if j > 0 && atom.ID.Timestamp <= yarn[j-1].ID.Timestamp {
+				return fmt.Errorf("%w: yarn #%d is not sorted by timestamp at %v", ErrDeltaInvalid, i, atom.ID)
+			}
+			if atom.ID.Timestamp == 0 || atom.Cause.Timestamp >= atom.ID.Timestamp {
+				return fmt.Errorf("%w: atom %v has invalid timestamp relative to cause %v", ErrDeltaInvalid, atom.ID, atom.Cause)
+			}
+			for _, ref := range atom.references() {
+				if int(ref.Site) >= len(d.Sitemap) {
+					return fmt.Errorf("%w: atom %v references %v, from an unknown site", ErrDeltaInvalid, atom.ID, ref)
+				}
+			}
+			if atom.Value == nil {
+				return fmt.Errorf("%w: atom %v has no value", ErrDeltaInvalid, atom.ID)
+			}
+			if add, ok := atom.Value.(InsertSetAdd); ok {
+				if err := checkSetElement(add.Value); err != nil {
+					return fmt.Errorf("%w: atom %v: %v", ErrDeltaInvalid, atom.ID, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyDelta integrates the atoms of a delta into this tree. Atoms that are already known
+// are ignored.
+//
+// The delta must continue from the last known atom of each site, every atom's cause
+// must be either in the tree or in the delta, and the resulting tree must be valid, as
+// checked by Validate. If the delta can't be applied, an error is returned and the tree is
+// left untouched.
+// Note that, as with Merge, applying a delta does not move the cursor.
+//
+// Time complexity: O(atoms*log(atoms) + sites*log(sites))
+func (t *CausalTree) ApplyDelta(d *Delta) error {
+	if err := d.check(); err != nil {
+		return err
+	}
+	// 1. Merge sitemaps and compute site index remapping.
+	// Time complexity: O(sites*log(sites))
+	sitemap := mergeSitemaps(t.Sitemap, d.Sitemap)
+	localRemap := make(indexMap)
+	deltaRemap := make(indexMap)
+	for i, site := range t.Sitemap {
+		localRemap.set(i, siteIndex(sitemap, site))
+	}
+	for i, site := range d.Sitemap {
+		deltaRemap.set(i, siteIndex(sitemap, site))
+	}
+	// 2. Copy local yarns, remapping them if necessary.
+	// Time complexity: O(atoms)
+	yarns := make([][]Atom, len(sitemap))
+	for i, yarn := range t.Yarns {
+		i := localRemap.get(i)
+		yarns[i] = make([]Atom, len(yarn))
+		for j, atom := range yarn {
+			yarns[i][j] = atom.remapSite(localRemap)
+		}
+	}
+	// 3. Append unknown atoms to yarns, checking known ones for conflicts.
+	// Time complexity: O(atoms)
+	var maxTimestamp uint32
+	for i, yarn := range d.Yarns {
+		i := deltaRemap.get(i)
+		for _, atom := range yarn {
+			atom := atom.remapSite(deltaRemap)
+			n := uint32(len(yarns[i]))
+			switch {
+			case atom.ID.Index < n:
+				if yarns[i][atom.ID.Index] != atom {
+					return fmt.Errorf("%w: %v", ErrDeltaConflict, atom)
+				}
+			case atom.ID.Index == n:
+				yarns[i] = append(yarns[i], atom)
+				if atom.ID.Timestamp > maxTimestamp {
+					maxTimestamp = atom.ID.Timestamp
+				}
+			default:
+				return fmt.Errorf("%w: expecting index %d for site %v, got %v", ErrDeltaGap, n, sitemap[i], atom.ID)
+			}
+		}
+	}
+	// 4. Rebuild weave from yarns.
+	// Time complexity: O(atoms*log(atoms))
+	weave, err := buildWeave(yarns)
+	if err != nil {
+		return err
+	}
+	// 5. Validate the resulting tree before changing anything, as Merge does with the remote.
+	// Time complexity: O(atoms + sites)
+	timestamp := t.Timestamp
+	if timestamp < maxTimestamp {
+		timestamp = maxTimestamp
+	}
+	timestamp++
+	candidate := &CausalTree{
+		Weave:     weave,
+		Cursor:    t.Cursor.remapSite(localRemap),
+		Yarns:     yarns,
+		Sitemap:   sitemap,
+		SiteID:    t.SiteID,
+		Timestamp: timestamp,
+	}
+	if err := candidate.Validate(); err != nil {
+		return fmt.Errorf("delta: %w", err)
+	}
+	// Move created stuff to this tree.
+	sizes := t.yarnSizes()
+	t.Weave = weave
+	t.Yarns = yarns
+	t.Sitemap = sitemap
+	t.Timestamp = timestamp
+	t.replayNewAtoms(sizes)
+	// 6. Fix cursor if necessary.
+	// Time complexity: O(atoms^2)
+	t.Cursor = candidate.Cursor
+	t.fixDeletedCursor()
+	t.mustValidate()
+	return nil
+}
+
+// Builds the weave from a set of yarns, ordering each atom's children in descending order.
+//
+// Returns an error if some atom's cause is missing, or if it's not a valid child.
+//
+// Time complexity: O(atoms*log(atoms))
+func buildWeave(yarns [][]Atom) ([]Atom, error) {
+	var n int
+	children := make(map[AtomID][]Atom)
+	for _, yarn := range yarns {
+		for _, atom := range yarn {
+			cause := atom.Cause
+			if cause.Timestamp > 0 {
+				if int(cause.Site) >= len(yarns) || int(cause.Index) >= len(yarns[cause.Site]) {
+					return nil, fmt.Errorf("%w: %v", ErrDeltaMissingCause, atom)
+				}
+				causeAtom := yarns[cause.Site][cause.Index]
+				if causeAtom.ID != cause {
+					return nil, fmt.Errorf("%w: %v", ErrDeltaMissingCause, atom)
+				}
+				if err := causeAtom.Value.ValidateChild(atom.Value); err != nil {
+					return nil, err
+				}
+			}
+			children[cause] = append(children[cause], atom)
+			n++
+		}
+	}
+	for _, atoms := range children {
+		sort.Slice(atoms, func(i, j int) bool {
+			return atoms[i].Compare(atoms[j]) > 0
+		})
+	}
+	// Depth-first traversal, using an explicit stack to handle long chains of atoms.
+	weave := make([]Atom, 0, n)
+	stack := make([]Atom, 0, len(children[AtomID{}]))
+	roots := children[AtomID{}]
+	for i := len(roots) - 1; i >= 0; i-- {
+		stack = append(stack, roots[i])
+	}
+	for len(stack) > 0 {
+		atom := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		weave = append(weave, atom)
+		atoms := children[atom.ID]
+		for i := len(atoms) - 1; i >= 0; i-- {
+			stack = append(stack, atoms[i])
+		}
+	}
+	return weave, nil
+}
+
+// +--------------+
+// | Delta - JSON |
+// +--------------+
+
+type deltaJSON struct {
+	Sitemap []uuid.UUID  `json:"sitemap"`
+	Yarns   [][]atomJSON `json:"yarns"`
+}
+
+type atomJSON struct {
+	ID    [3]uint32       `json:"id"`
+	Cause [3]uint32       `json:"cause"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type markJSON struct {
+	Name      string    `json:"name"`
+	Value     string    `json:"value"`
+	StartBias Bias      `json:"startBias"`
+	End       [3]uint32 `json:"end"`
+	EndBias   Bias      `json:"endBias"`
+}
+
+type counterJSON struct {
+	Overflow OverflowPolicy `json:"overflow"`
+	Bounded  bool           `json:"bounded,omitempty"`
+}
+
+type transferJSON struct {
+	To    uuid.UUID `json:"to"`
+	Value int64     `json:"value"`
+}
+
+type annotationJSON struct {
+	Start [3]uint32 `json:"start"`
+	End   [3]uint32 `json:"end"`
+}
+
+func encodeAtomID(id AtomID) [3]uint32 {
+	return [3]uint32{uint32(id.Site), id.Index, id.Timestamp}
+}
+
+func decodeAtomID(x [3]uint32) (AtomID, error) {
+	if x[0] > 0xffff {
+		return AtomID{}, fmt.Errorf("%w: site index %d is too large", ErrDeltaInvalid, x[0])
+	}
+	return AtomID{Site: uint16(x[0]), Index: x[1], Timestamp: x[2]}, nil
+}
+
+// Encodes an atom value as a type name and its (optional) parameters.
+func encodeAtomValue(value AtomValue) (string, json.RawMessage, error) {
+	var params interface{}
+	var typ string
+	switch v := value.(type) {
+	case InsertChar:
+		typ, params = "char", v.Char
+	case Delete:
+		typ = "delete"
+	case InsertStr:
+		typ = "str"
+	case InsertCounter:
+		typ = "counter"
+		if v != (InsertCounter{}) {
+			params = counterJSON{v.Overflow, v.Bounded}
+		}
+	case InsertTransfer:
+		typ, params = "transfer", transferJSON{v.To, v.Value}
+	case InsertAdd:
+		typ, params = "add", v.Value
+	case InsertMark:
+		typ, params = "mark", markJSON{v.Name, v.Value, v.StartBias, encodeAtomID(v.End), v.EndBias}
+	case InsertSet:
+		typ = "set"
+	case InsertSetAdd:
+		typ, params = "setAdd", v.Value
+	case InsertAnnotation:
+		typ, params = "annotation", annotationJSON{encodeAtomID(v.Start), encodeAtomID(v.End)}
+	default:
+		return "", nil, fmt.Errorf("can't encode atom value %T (%v)", value, value)
+	}
+	if params == nil {
+		return typ, nil, nil
+	}
+	bs, err := json.Marshal(params)
+	return typ, bs, err
+}
+
+// Decodes an atom value from its type name and parameters.
+func decodeAtomValue(typ string, params json.RawMessage) (AtomValue, error) {
+	unmarshal := func(x interface{}) error {
+		if err := json.Unmarshal(params, x); err != nil {
+			return fmt.Errorf("%w: decoding %q value: %v", ErrDeltaInvalid, typ, err)
+		}
+		return nil
+	}
+	switch typ {
+	case "char":
+		var v InsertChar
+		err := unmarshal(&v.Char)
+		return v, err
+	case "delete":
+		return Delete{}, nil
+	case "str":
+		return InsertStr{}, nil
+	case "counter":
+		var c counterJSON
+		if len(params) == 0 {
+			return InsertCounter{}, nil
+		}
+		err := unmarshal(&c)
+		return InsertCounter{c.Overflow, c.Bounded}, err
+	case "transfer":
+		var tr transferJSON
+		err := unmarshal(&tr)
+		return InsertTransfer{tr.To, tr.Value}, err
+	case "add":
+		var v InsertAdd
+		err := unmarshal(&v.Value)
+		return v, err
+	case "mark":
+		var m markJSON
+		if err := unmarshal(&m); err != nil {
+			return nil, err
+		}
+		end, err := decodeAtomID(m.End)
+		if err != nil {
+			return nil, err
+		}
+		return InsertMark{m.Name, m.Value, m.StartBias, end, m.EndBias}, nil
+	case "set":
+		return InsertSet{}, nil
+	case "setAdd":
+		// Decode numbers as int64, instead of float64.
+		var x interface{}
+		dec := json.NewDecoder(bytes.NewReader(params))
+		dec.UseNumber()
+		if err := dec.Decode(&x); err != nil {
+			return nil, fmt.Errorf("%w: decoding %q value: %v", ErrDeltaInvalid, typ, err)
+		}
+		if n, ok := x.(json.Number); ok {
+			i, err := n.Int64()
+			if err != nil {
+				return nil, fmt.Errorf("%w: decoding %q value: %v", ErrDeltaInvalid, typ, err)
+			}
+			x = i
+		}
+		elem, err := setElement(x)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDeltaInvalid, err)
+		}
+		return InsertSetAdd{elem}, nil
+	case "annotation":
+		var a annotationJSON
+		if err := unmarshal(&a); err != nil {
+			return nil, err
+		}
+		start, err := decodeAtomID(a.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := decodeAtomID(a.End)
+		if err != nil {
+			return nil, err
+		}
+		return InsertAnnotation{start, end}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown atom type %q", ErrDeltaInvalid, typ)
+	}
+}
+
+// MarshalJSON encodes the delta in a format that may be decoded back with UnmarshalJSON.
+func (d *Delta) MarshalJSON() ([]byte, error) {
+	data := deltaJSON{
+		Sitemap: d.Sitemap,
+		Yarns:   make([][]atomJSON, len(d.Yarns)),
+	}
+	if data.Sitemap == nil {
+		data.Sitemap = []uuid.UUID{}
+	}
+	for i, yarn := range d.Yarns {
+		data.Yarns[i] = make([]atomJSON, len(yarn))
+		for j, atom := range yarn {
+			typ, params, err := encodeAtomValue(atom.Value)
+			if err != nil {
+				return nil, err
+			}
+			data.Yarns[i][j] = atomJSON{
+				ID:    encodeAtomID(atom.ID),
+				Cause: encodeAtomID(atom.Cause),
+				Type:  typ,
+				Value: params,
+			}
+		}
+	}
+	return json.Marshal(data)
+}
+
+// UnmarshalJSON decodes a delta encoded with MarshalJSON.
+func (d *Delta) UnmarshalJSON(bs []byte) error {
+	var data deltaJSON
+	if err := json.Unmarshal(bs, &data); err != nil {
+		return err
+	}
+	yarns := make([][]Atom, len(data.Yarns))
+	for i, yarn := range data.Yarns {
+		yarns[i] = make([]Atom, len(yarn))
+		for j, x := range yarn {
+			id, err := decodeAtomID(x.ID)
+			if err != nil {
+				return err
+			}
+			cause, err := decodeAtomID(x.Cause)
+			if err != nil {
+				return err
+			}
+			value, err := decodeAtomValue(x.Type, x.Value)
+			if err != nil {
+				return err
+			}
+			yarns[i][j] = Atom{ID: id, Cause: cause, Value: value}
+		}
+	}
+	d.Sitemap = data.Sitemap
+	d.Yarns = yarns
+	return nil
+}
@@ -0,0 +1,430 @@
+package crdt_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/uuid"
+
+	"github.com/brunokim/causal-tree/crdt"
+)
+
+// Returns the weave atoms identified by their site ID, since sitemaps may be different
+// even if they have the same atoms.
+func weaveSiteIDs(t *crdt.CausalTree) []string {
+	ids := make([]string, len(t.Weave))
+	for i, atom := range t.Weave {
+		ids[i] = fmt.Sprintf("%v:%d %v", t.Sitemap[atom.ID.Site], atom.ID.Index, atom.Value)
+	}
+	return ids
+}
+
+// Sends every atom from remote that local doesn't know.
+func applyDelta(local, remote *crdt.CausalTree) error {
+	d, err := remote.DeltaSince(local.Sitemap, local.Now())
+	if err != nil {
+		return err
+	}
+	return local.ApplyDelta(d)
+}
+
+func TestApplyDelta(t *testing.T) {
+	teardown := crdt.MockUUIDs(
+		uuid.MustParse("00000001-8891-11ec-a04c-67855c00505b"),
+		uuid.MustParse("00000002-8891-11ec-a04c-67855c00505b"),
+		uuid.MustParse("00000003-8891-11ec-a04c-67855c00505b"),
+	)
+	defer teardown()
+
+	// Same sequence as TestCausalTree, but using deltas instead of merges.
+	trees := testOperations(t, []operation{
+		{op: insertChar, local: 0, char: 'C'},
+		{op: insertChar, local: 0, char: 'M'},
+		{op: insertChar, local: 0, char: 'D'},
+		{op: fork, local: 0, remote: 1},
+		{op: fork, local: 1, remote: 2},
+		{op: deleteChar, local: 0},
+		{op: deleteChar, local: 0},
+		{op: insertChar, local: 0, char: 'T'},
+		{op: insertChar, local: 0, char: 'R'},
+		{op: insertChar, local: 0, char: 'L'},
+		{op: insertChar, local: 1, char: 'A'},
+		{op: insertChar, local: 1, char: 'L'},
+		{op: insertChar, local: 1, char: 'T'},
+		{op: insertChar, local: 2, char: 'D'},
+		{op: insertChar, local: 2, char: 'E'},
+		{op: insertChar, local: 2, char: 'L'},
+	})
+	t0, t1, t2 := trees[0], trees[1], trees[2]
+	merged := t0.Clone()
+	if err := merged.Merge(t1); err != nil {
+		t.Fatal(err)
+	}
+	if err := merged.Merge(t2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyDelta(t0, t1); err != nil {
+		t.Fatalf("t0 <- t1: %v", err)
+	}
+	if err := applyDelta(t0, t2); err != nil {
+		t.Fatalf("t0 <- t2: %v", err)
+	}
+	if err := applyDelta(t2, t0); err != nil {
+		t.Fatalf("t2 <- t0: %v", err)
+	}
+	want := "CTRLALTDEL"
+	for i, tree := range []*crdt.CausalTree{t0, t2} {
+		if got := tree.ToString(); got != want {
+			t.Errorf("tree #%d: got %q, want %q", i, got, want)
+		}
+		if err := tree.Validate(); err != nil {
+			t.Errorf("tree #%d: %v", i, err)
+		}
+		if diff := cmp.Diff(merged.Weave, tree.Weave); diff != "" {
+			t.Errorf("tree #%d: weave differs from merge (-want, +got):\n%s", i, diff)
+		}
+	}
+	// Applying the same atoms again is a no-op.
+	if err := applyDelta(t0, t2); err != nil {
+		t.Fatalf("t0 <- t2 (again): %v", err)
+	}
+	d, _ := t2.DeltaSince(nil, nil)
+	if err := t0.ApplyDelta(d); err != nil {
+		t.Fatalf("t0 <- t2 (everything): %v", err)
+	}
+	if got := t0.ToString(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestApplyDeltaRandom(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		t.Run(fmt.Sprintf("seed=%d", i), func(t *testing.T) {
+			r := newRand()
+			r.Seed(int64(i))
+			t1, err := makeRandomTree(64, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t2, err := makeRandomTree(64, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			merged := t1.Clone()
+			if err := merged.Merge(t2); err != nil {
+				t.Fatal(err)
+			}
+			if err := applyDelta(t1, t2); err != nil {
+				t.Fatal(err)
+			}
+			if err := t1.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(weaveSiteIDs(merged), weaveSiteIDs(t1)); diff != "" {
+				t.Errorf("weave differs from merge (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// Sends every atom from remote that local doesn't know, encoded as JSON.
+func applyDeltaJSON(t *testing.T, local, remote *crdt.CausalTree) {
+	t.Helper()
+	d, err := remote.DeltaSince(local.Sitemap, local.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(crdt.Delta)
+	if err := json.Unmarshal(bs, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.ApplyDelta(got); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeltaCrossSiteMark(t *testing.T) {
+	tree, str := makeString(t, "abc")
+	remote, remoteStr := forkString(t, tree, str)
+	if _, err := remoteStr.Cursor().InsertString("xy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Merge(remote); err != nil {
+		t.Fatal(err)
+	}
+	// Mark is caused by a remote char, but ends at a local char, so the delta only has atoms
+	// from remote.
+	if err := remoteStr.AddMark(1, 4, "bold", "true", crdt.ExpandNone); err != nil {
+		t.Fatal(err)
+	}
+	applyDeltaJSON(t, tree, remote)
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(remoteStr.Spans(), str.Spans()); diff != "" {
+		t.Errorf("Spans (-remote, +local):\n%s", diff)
+	}
+}
+
+func TestDeltaCrossSiteAnnotation(t *testing.T) {
+	tree, str := makeString(t, "abc")
+	remote, remoteStr := forkString(t, tree, str)
+	if _, err := remoteStr.Cursor().InsertString("xy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Merge(remote); err != nil {
+		t.Fatal(err)
+	}
+	// Annotation is a child of the root, and references a remote char and a local char, so the
+	// delta only has atoms from remote.
+	annotation, err := remoteStr.Annotate(1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyDeltaJSON(t, tree, remote)
+	if err := tree.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	local, err := tree.AnnotationValue(annotation.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start, end := local.Range(); start != 1 || end != 4 {
+		t.Errorf("Range() = (%d, %d), want (1, 4)", start, end)
+	}
+}
+
+func TestApplyDeltaErrors(t *testing.T) {
+	t0 := crdt.NewCausalTree()
+	for _, ch := range "abc" {
+		t0.InsertChar(ch)
+	}
+	t1, _ := t0.Fork()
+	t1.InsertChar('d')
+	t1.InsertChar('e')
+
+	tests := []struct {
+		desc    string
+		local   *crdt.CausalTree
+		modify  func(d *crdt.Delta, k0, k1 int)
+		wantErr error
+	}{
+		{"gap", t0, func(d *crdt.Delta, k0, k1 int) {
+			// Remove 'd' from delta.
+			d.Yarns[k1] = d.Yarns[k1][1:]
+		}, crdt.ErrDeltaGap},
+		{"conflict", t0, func(d *crdt.Delta, k0, k1 int) {
+			d.Yarns[k0][0].Value = crdt.InsertChar{'x'}
+		}, crdt.ErrDeltaConflict},
+		{"missing sitemap", nil, func(d *crdt.Delta, k0, k1 int) {
+			d.Sitemap = d.Sitemap[1:]
+		}, crdt.ErrDeltaInvalid},
+		{"not contiguous", nil, func(d *crdt.Delta, k0, k1 int) {
+			d.Yarns[k0] = append(d.Yarns[k0][:1], d.Yarns[k0][2:]...)
+		}, crdt.ErrDeltaInvalid},
+		{"unknown mark end site", nil, func(d *crdt.Delta, k0, k1 int) {
+			d.Yarns[k0][1].Value = crdt.InsertMark{Name: "bold", End: crdt.AtomID{Site: 2, Index: 0, Timestamp: 1}}
+		}, crdt.ErrDeltaInvalid},
+		{"unknown annotation start site", nil, func(d *crdt.Delta, k0, k1 int) {
+			d.Yarns[k0][2].Value = crdt.InsertAnnotation{
+				Start: crdt.AtomID{Site: 2, Index: 0, Timestamp: 1},
+				End:   d.Yarns[k0][0].ID,
+			}
+		}, crdt.ErrDeltaInvalid},
+		{"missing cause", nil, func(d *crdt.Delta, k0, k1 int) {
+			// Make 'a' be caused by an unknown atom from t1.
+			d.Yarns[k0][0].Cause = crdt.AtomID{Site: uint16(k1), Index: 10, Timestamp: 1}
+		}, crdt.ErrDeltaMissingCause},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			local := crdt.NewCausalTree()
+			if test.local != nil {
+				local = test.local.Clone()
+			}
+			// Send everything from t1.
+			d, err := t1.DeltaSince(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			k0, k1 := 0, 1
+			if d.Sitemap[0] == t1.SiteID {
+				k0, k1 = 1, 0
+			}
+			test.modify(d, k0, k1)
+			want := local.Clone()
+			err = local.ApplyDelta(d)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("want %v, got %v", test.wantErr, err)
+			}
+			if diff := cmp.Diff(want, local, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(crdt.CausalTree{})); diff != "" {
+				t.Errorf("tree was modified after error (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestApplyDeltaInvalidTree(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	str, err := tree.SetString()
+	must(err)
+	_, err = str.Cursor().InsertString("abc")
+	must(err)
+	must(str.AddMark(0, 2, "bold", "true", crdt.ExpandNone))
+	_, err = str.Annotate(0, 2)
+	must(err)
+	counter, err := tree.SetCounter()
+	must(err)
+	// Returns the last atom in the tree with the given value type.
+	lastAtom := func(value crdt.AtomValue) crdt.Atom {
+		var last crdt.Atom
+		for _, atom := range tree.Yarns[0] {
+			if fmt.Sprintf("%T", atom.Value) == fmt.Sprintf("%T", value) {
+				last = atom
+			}
+		}
+		return last
+	}
+	unknown := crdt.AtomID{Site: 0, Index: 100, Timestamp: 1}
+
+	tests := []struct {
+		desc   string
+		modify func(d *crdt.Delta)
+	}{
+		{"dangling mark", func(d *crdt.Delta) {
+			mark := lastAtom(crdt.InsertMark{})
+			v := mark.Value.(crdt.InsertMark)
+			v.End = unknown
+			d.Yarns[0][mark.ID.Index].Value = v
+		}},
+		{"dangling annotation", func(d *crdt.Delta) {
+			annotation := lastAtom(crdt.InsertAnnotation{})
+			v := annotation.Value.(crdt.InsertAnnotation)
+			v.Start = unknown
+			d.Yarns[0][annotation.ID.Index].Value = v
+		}},
+		{"delete root", func(d *crdt.Delta) {
+			last := d.Yarns[0][len(d.Yarns[0])-1].ID
+			d.Yarns[0] = append(d.Yarns[0], crdt.Atom{
+				ID:    crdt.AtomID{Site: 0, Index: last.Index + 1, Timestamp: last.Timestamp + 1},
+				Value: crdt.Delete{},
+			})
+		}},
+		{"transfer in unbounded counter", func(d *crdt.Delta) {
+			last := d.Yarns[0][len(d.Yarns[0])-1].ID
+			d.Yarns[0] = append(d.Yarns[0], crdt.Atom{
+				ID:    crdt.AtomID{Site: 0, Index: last.Index + 1, Timestamp: last.Timestamp + 1},
+				Cause: counter.ID(),
+				Value: crdt.InsertTransfer{To: uuid.New(), Value: 1},
+			})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			d, err := tree.DeltaSince(nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.modify(d)
+			local := crdt.NewCausalTree()
+			want := local.Clone()
+			if err := local.ApplyDelta(d); !errors.Is(err, crdt.ErrInvalidTree) {
+				t.Fatalf("want %v, got %v", crdt.ErrInvalidTree, err)
+			}
+			if diff := cmp.Diff(want, local, cmpopts.EquateEmpty(), cmpopts.IgnoreUnexported(crdt.CausalTree{})); diff != "" {
+				t.Errorf("tree was modified after error (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDeltaJSON(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	tree.InsertChar('😀')
+	tree.InsertStr()
+	tree.InsertChar('x')
+	tree.Delete()
+	tree.InsertCounter()
+	tree.InsertAdd(-42)
+	str, err := tree.SetString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Cursor().InsertString("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := str.AddMark(1, 3, "link", "https://example.com", crdt.ExpandBefore); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Annotate(0, 2); err != nil {
+		t.Fatal(err)
+	}
+	set, err := tree.SetSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, elem := range []interface{}{false, 1 << 60, "x"} {
+		if err := set.Add(elem); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counter, err := tree.SetCounterWithOverflow(crdt.OverflowError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := counter.Add(1 << 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := counter.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	bounded, err := tree.SetBoundedCounter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bounded.Add(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := bounded.Transfer(uuid.MustParse("00000001-8891-11ec-a04c-67855c00505b"), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := tree.DeltaSince(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := new(crdt.Delta)
+	if err := json.Unmarshal(bs, got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(d, got); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+
+	other := crdt.NewCausalTree()
+	if err := other.ApplyDelta(got); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(tree.Weave, other.Weave); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
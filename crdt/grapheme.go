@@ -0,0 +1,330 @@
+package crdt
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// +-------------------+
+// | Grapheme clusters |
+// +-------------------+
+
+// A grapheme cluster is a sequence of codepoints that is perceived by users as a single character,
+// like a letter followed by combining accents, a pair of regional indicators forming a flag, or an
+// emoji sequence joined by ZWJ (zero-width joiners).
+//
+// Clusters are segmented following the extended grapheme cluster rules from Unicode's UAX #29,
+// with codepoint properties approximated from the standard library tables.
+//
+// Cursors edit strings by codepoint, but they may also move and delete by grapheme cluster. New
+// chars are never inserted as children of a char in the middle of a cluster: grapheme operations
+// always place the cursor at the end of a cluster, and inserts from a cursor in the middle of a
+// cluster are placed after its last char. A cluster typed as a unit is a chain of atoms, where each
+// char is the cause of the next, so concurrent inserts from other sites can only be placed before
+// or after the whole chain, and never split it.
+
+type graphemeProp int
+
+const (
+	gpOther graphemeProp = iota
+	gpCR
+	gpLF
+	gpControl
+	gpExtend
+	gpZWJ
+	gpRegionalIndicator
+	gpSpacingMark
+	gpL
+	gpV
+	gpT
+	gpLV
+	gpLVT
+	gpExtendedPictographic
+)
+
+// Approximation of the Extended_Pictographic property, which is not available in package unicode.
+var extendedPictographic = &unicode.RangeTable{
+	LatinOffset: 1,
+	R16: []unicode.Range16{
+		{Lo: 0x00a9, Hi: 0x00ae, Stride: 5},
+		{Lo: 0x203c, Hi: 0x2049, Stride: 13},
+		{Lo: 0x2122, Hi: 0x2139, Stride: 23},
+		{Lo: 0x2194, Hi: 0x2199, Stride: 1},
+		{Lo: 0x21a9, Hi: 0x21aa, Stride: 1},
+		{Lo: 0x231a, Hi: 0x231b, Stride: 1},
+		{Lo: 0x2328, Hi: 0x23cf, Stride: 167},
+		{Lo: 0x23e9, Hi: 0x23f3, Stride: 1},
+		{Lo: 0x23f8, Hi: 0x23fa, Stride: 1},
+		{Lo: 0x24c2, Hi: 0x24c2, Stride: 1},
+		{Lo: 0x25aa, Hi: 0x25ab, Stride: 1},
+		{Lo: 0x25b6, Hi: 0x25c0, Stride: 10},
+		{Lo: 0x25fb, Hi: 0x25fe, Stride: 1},
+		{Lo: 0x2600, Hi: 0x27bf, Stride: 1},
+		{Lo: 0x2934, Hi: 0x2935, Stride: 1},
+		{Lo: 0x2b05, Hi: 0x2b07, Stride: 1},
+		{Lo: 0x2b1b, Hi: 0x2b1c, Stride: 1},
+		{Lo: 0x2b50, Hi: 0x2b55, Stride: 5},
+		{Lo: 0x3030, Hi: 0x303d, Stride: 13},
+		{Lo: 0x3297, Hi: 0x3299, Stride: 2},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f000, Hi: 0x1faff, Stride: 1},
+		{Lo: 0x1fc00, Hi: 0x1fffd, Stride: 1},
+	},
+}
+
+// Returns the Grapheme_Cluster_Break property of a codepoint. Properties that overlap with
+// Extended_Pictographic, like emoji modifiers and regional indicators, are checked first.
+func graphemeProperty(ch rune) graphemeProp {
+	switch {
+	case ch == '\r':
+		return gpCR
+	case ch == '\n':
+		return gpLF
+	case ch == 0x200d:
+		return gpZWJ
+	case ch == 0x200c,
+		ch >= 0x1f3fb && ch <= 0x1f3ff, // Emoji modifiers
+		ch >= 0xe0020 && ch <= 0xe007f, // Tags
+		ch >= 0xff9e && ch <= 0xff9f,   // Halfwidth Katakana sound marks
+		unicode.In(ch, unicode.Mn, unicode.Me):
+		return gpExtend
+	case ch >= 0x1f1e6 && ch <= 0x1f1ff:
+		return gpRegionalIndicator
+	case unicode.In(ch, unicode.Cc, unicode.Cf, unicode.Zl, unicode.Zp):
+		return gpControl
+	case unicode.Is(unicode.Mc, ch):
+		return gpSpacingMark
+	case ch >= 0x1100 && ch <= 0x115f, ch >= 0xa960 && ch <= 0xa97c:
+		return gpL
+	case ch >= 0x1160 && ch <= 0x11a7, ch >= 0xd7b0 && ch <= 0xd7c6:
+		return gpV
+	case ch >= 0x11a8 && ch <= 0x11ff, ch >= 0xd7cb && ch <= 0xd7fb:
+		return gpT
+	case ch >= 0xac00 && ch <= 0xd7a3:
+		if (ch-0xac00)%28 == 0 {
+			return gpLV
+		}
+		return gpLVT
+	case unicode.Is(extendedPictographic, ch):
+		return gpExtendedPictographic
+	}
+	return gpOther
+}
+
+// graphemeSegmenter finds cluster boundaries in a sequence of codepoints.
+type graphemeSegmenter struct {
+	started bool
+	prev    graphemeProp
+	// Number of consecutive regional indicators, up to prev.
+	numRI int
+	// Whether the sequence up to prev matches ExtPict Extend*.
+	inPict bool
+	// Whether the sequence up to prev matches ExtPict Extend* ZWJ.
+	inPictZWJ bool
+}
+
+// Returns whether there's a cluster boundary before ch, and advances the segmenter.
+func (s *graphemeSegmenter) isBoundary(ch rune) bool {
+	p := graphemeProperty(ch)
+	isBoundary := s.isBoundaryBefore(p)
+	s.started = true
+	s.inPictZWJ = p == gpZWJ && s.inPict
+	s.inPict = p == gpExtendedPictographic || (p == gpExtend && s.inPict)
+	if p == gpRegionalIndicator {
+		s.numRI++
+	} else {
+		s.numRI = 0
+	}
+	s.prev = p
+	return isBoundary
+}
+
+func (s *graphemeSegmenter) isBoundaryBefore(p graphemeProp) bool {
+	prev := s.prev
+	switch {
+	case !s.started: // GB1
+		return true
+	case prev == gpCR && p == gpLF: // GB3
+		return false
+	case prev == gpCR || prev == gpLF || prev == gpControl: // GB4
+		return true
+	case p == gpCR || p == gpLF || p == gpControl: // GB5
+		return true
+	case prev == gpL && (p == gpL || p == gpV || p == gpLV || p == gpLVT): // GB6
+		return false
+	case (prev == gpLV || prev == gpV) && (p == gpV || p == gpT): // GB7
+		return false
+	case (prev == gpLVT || prev == gpT) && p == gpT: // GB8
+		return false
+	case p == gpExtend || p == gpZWJ || p == gpSpacingMark: // GB9, GB9a
+		return false
+	case s.inPictZWJ && p == gpExtendedPictographic: // GB11
+		return false
+	case prev == gpRegionalIndicator && p == gpRegionalIndicator: // GB12, GB13
+		return s.numRI%2 == 0
+	}
+	return true // GB999
+}
+
+// Returns the end of each cluster in chars, as an exclusive index.
+func graphemeEnds(chars []rune) []int {
+	var ends []int
+	var seg graphemeSegmenter
+	for i, ch := range chars {
+		if seg.isBoundary(ch) && i > 0 {
+			ends = append(ends, i)
+		}
+	}
+	if len(chars) > 0 {
+		ends = append(ends, len(chars))
+	}
+	return ends
+}
+
+// ---- String graphemes
+
+// Returns the weave positions and values of non-deleted chars.
+func (s *String) visibleChars() (positions []int, chars []rune) {
+	s.walkChars(func(pos int, atom Atom, isDeleted bool) bool {
+		if !isDeleted {
+			positions = append(positions, pos)
+			chars = append(chars, atom.Value.(InsertChar).Char)
+		}
+		return true
+	})
+	return positions, chars
+}
+
+// Graphemes returns the string split in grapheme clusters.
+// Ignores whether the string was deleted.
+func (s *String) Graphemes() []string {
+	_, chars := s.visibleChars()
+	var clusters []string
+	var start int
+	for _, end := range graphemeEnds(chars) {
+		clusters = append(clusters, string(chars[start:end]))
+		start = end
+	}
+	return clusters
+}
+
+// GraphemeLen returns the size of the string in grapheme clusters.
+// Ignores whether the string was deleted.
+func (s *String) GraphemeLen() int {
+	_, chars := s.visibleChars()
+	return len(graphemeEnds(chars))
+}
+
+// Returns the position after which chars are inserted, given the position of a char or the head.
+// If the char is in the middle of a cluster, returns the position of the cluster's last char, so
+// that the cluster isn't split. If the char is deleted, the cluster is the one of the closest
+// visible char before it.
+func (s *String) insertPos(pos int) int {
+	positions, chars := s.visibleChars()
+	i := -1
+	for i+1 < len(positions) && positions[i+1] <= pos {
+		i++
+	}
+	if i < 0 {
+		return pos
+	}
+	ends := graphemeEnds(chars)
+	if last := ends[graphemeAt(ends, i)] - 1; last != i {
+		return positions[last]
+	}
+	return pos
+}
+
+// ---- StringCursor graphemes
+
+// Returns the string's visible chars, their cluster ends, and the index of the char pointed to by
+// the cursor. If the cursor points to a deleted char, returns the closest visible char before it,
+// or -1 for the head.
+func (cur *StringCursor) graphemes() (s *String, positions []int, ends []int, i int) {
+	s = cur.GetString()
+	positions, chars := s.visibleChars()
+	pos := cur.atomIndex()
+	i = -1
+	for i+1 < len(positions) && positions[i+1] <= pos {
+		i++
+	}
+	return s, positions, graphemeEnds(chars), i
+}
+
+// Moves the cursor to the last char of the k-th cluster, or to the head if k is -1.
+func (cur *StringCursor) setGrapheme(s *String, positions, ends []int, k int) {
+	if k < 0 {
+		cur.treePosition = s.treePosition
+		return
+	}
+	cur.setPos(positions[ends[k]-1])
+}
+
+// Returns the index of the cluster containing the i-th visible char.
+func graphemeAt(ends []int, i int) int {
+	for k, end := range ends {
+		if i < end {
+			return k
+		}
+	}
+	return len(ends)
+}
+
+// IndexGrapheme moves the cursor to the end of the given cluster, that is, to its last char.
+// Returns an error if index is out of range [-1:GraphemeLen()-1]. Ignores whether string is deleted.
+func (cur *StringCursor) IndexGrapheme(k int) error {
+	s, positions, ends, _ := cur.graphemes()
+	if k < -1 || k >= len(ends) {
+		return fmt.Errorf("out of bounds")
+	}
+	cur.setGrapheme(s, positions, ends, k)
+	return nil
+}
+
+// NextGrapheme moves the cursor to the end of the next cluster. If the cursor is in the middle
+// of a cluster, it's moved to the end of the same cluster.
+// Returns an error if the cursor is at the end of the string.
+func (cur *StringCursor) NextGrapheme() error {
+	s, positions, ends, i := cur.graphemes()
+	k := graphemeAt(ends, i+1)
+	if k >= len(ends) {
+		return fmt.Errorf("out of bounds")
+	}
+	cur.setGrapheme(s, positions, ends, k)
+	return nil
+}
+
+// PrevGrapheme moves the cursor to the end of the previous cluster, or to the string head. If the
+// cursor is in the middle of a cluster, it's moved to the end of the cluster before it.
+// Returns an error if the cursor is pointing to the string head.
+func (cur *StringCursor) PrevGrapheme() error {
+	s, positions, ends, i := cur.graphemes()
+	if i < 0 {
+		return fmt.Errorf("out of bounds")
+	}
+	cur.setGrapheme(s, positions, ends, graphemeAt(ends, i)-1)
+	return nil
+}
+
+// DeleteGrapheme removes all characters from the cluster pointed by the cursor, as a single
+// operation. The cursor is moved to the end of the previous cluster, like the backspace key.
+// Returns an error if cursor is pointing to the string head.
+func (cur *StringCursor) DeleteGrapheme() error {
+	s, positions, ends, i := cur.graphemes()
+	if i < 0 {
+		return fmt.Errorf("out of bounds")
+	}
+	k := graphemeAt(ends, i)
+	start := 0
+	if k > 0 {
+		start = ends[k-1]
+	}
+	if err := cur.t.deleteAtoms(positions[start:ends[k]]); err != nil {
+		return err
+	}
+	cur.t.fixDeletedCursor()
+	// Deleted atoms are all after the previous cluster, so its position is unchanged.
+	cur.setGrapheme(s, positions, ends, k-1)
+	return nil
+}
@@ -0,0 +1,250 @@
+package crdt_test
+
+import (
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// Emoji sequences.
+const (
+	// Woman, ZWJ, woman, ZWJ, girl.
+	family = "\U0001F469\u200d\U0001F469\u200d\U0001F467"
+	// Regional indicators B and R.
+	brazil = "\U0001F1E7\U0001F1F7"
+	// Regional indicators U and S.
+	usa = "\U0001F1FA\U0001F1F8"
+)
+
+func TestGraphemes(t *testing.T) {
+	tests := []struct {
+		desc string
+		text string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"ascii", "abc", []string{"a", "b", "c"}},
+		{"combining accents", "e\u0327\u0301o", []string{"e\u0327\u0301", "o"}},
+		{"CRLF", "a\r\n\nb", []string{"a", "\r\n", "\n", "b"}},
+		{"flags", brazil + usa + "\U0001F1EF", []string{brazil, usa, "\U0001F1EF"}},
+		{"skin tone", "\U0001F44D\U0001F3FD!", []string{"\U0001F44D\U0001F3FD", "!"}},
+		{"ZWJ sequence", family + "x", []string{family, "x"}},
+		{"ZWJ without emoji", "a\u200d\U0001F467", []string{"a\u200d", "\U0001F467"}},
+		{"keycap", "1\ufe0f\u20e3", []string{"1\ufe0f\u20e3"}},
+		{"hangul jamo", "\u1100\u1161\u11a8\u1100\u1161", []string{"\u1100\u1161\u11a8", "\u1100\u1161"}},
+		{"spacing mark", "\u0915\u094d\u0937\u093f", []string{"\u0915\u094d", "\u0937\u093f"}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			_, str := makeString(t, test.text)
+			if diff := cmp.Diff(test.want, str.Graphemes(), cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("Graphemes(%q) (-want, +got):\n%s", test.text, diff)
+			}
+			if n := str.GraphemeLen(); n != len(test.want) {
+				t.Errorf("GraphemeLen(%q) = %d, want %d", test.text, n, len(test.want))
+			}
+		})
+	}
+}
+
+func TestGraphemeCursor(t *testing.T) {
+	_, str := makeString(t, "ae\u0301"+brazil+"o")
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	value := func(cur *crdt.StringCursor) rune {
+		t.Helper()
+		ch, err := cur.Value()
+		must(err)
+		return ch
+	}
+	cur := str.Cursor()
+	// Move forward, from head to end of string.
+	var got []rune
+	for cur.NextGrapheme() == nil {
+		got = append(got, value(cur))
+	}
+	if diff := cmp.Diff([]rune{'a', '\u0301', '\U0001F1F7', 'o'}, got); diff != "" {
+		t.Errorf("NextGrapheme (-want, +got):\n%s", diff)
+	}
+	// Move backward, from end of string to head.
+	got = nil
+	for cur.PrevGrapheme() == nil {
+		if ch, err := cur.Value(); err == nil {
+			got = append(got, ch)
+		}
+	}
+	if diff := cmp.Diff([]rune{'\U0001F1F7', '\u0301', 'a'}, got); diff != "" {
+		t.Errorf("PrevGrapheme (-want, +got):\n%s", diff)
+	}
+	// Moving from the middle of a cluster goes to its boundaries.
+	must(cur.Index(1)) // 'e'
+	must(cur.NextGrapheme())
+	if ch := value(cur); ch != '\u0301' {
+		t.Errorf("NextGrapheme from middle: got %q, want U+0301", ch)
+	}
+	must(cur.Index(3)) // First regional indicator.
+	must(cur.PrevGrapheme())
+	if ch := value(cur); ch != '\u0301' {
+		t.Errorf("PrevGrapheme from middle: got %q, want U+0301", ch)
+	}
+	// Index by cluster.
+	must(cur.IndexGrapheme(2))
+	if ch := value(cur); ch != '\U0001F1F7' {
+		t.Errorf("IndexGrapheme(2): got %q, want U+1F1F7", ch)
+	}
+	for _, k := range []int{-2, 4} {
+		if err := cur.IndexGrapheme(k); err == nil {
+			t.Errorf("IndexGrapheme(%d): want error", k)
+		}
+	}
+	// Delete whole clusters.
+	must(cur.IndexGrapheme(2))
+	must(cur.DeleteGrapheme())
+	if ch := value(cur); ch != '\u0301' {
+		t.Errorf("DeleteGrapheme: got %q, want U+0301", ch)
+	}
+	must(cur.Index(1)) // 'e'
+	must(cur.DeleteGrapheme())
+	if s := str.Snapshot(); s != "ao" {
+		t.Errorf("DeleteGrapheme: got %q, want %q", s, "ao")
+	}
+	must(cur.DeleteGrapheme())
+	if err := cur.DeleteGrapheme(); err == nil {
+		t.Errorf("DeleteGrapheme at head: want error")
+	}
+	if err := cur.PrevGrapheme(); err == nil {
+		t.Errorf("PrevGrapheme at head: want error")
+	}
+}
+
+func TestGraphemeConcurrentInserts(t *testing.T) {
+	tree, str := makeString(t, "x")
+	cur := str.Cursor()
+	if err := cur.Index(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cur.InsertString(family + "e\u0301"); err != nil {
+		t.Fatal(err)
+	}
+	// Concurrent inserts at every cluster boundary, from many sites.
+	var remotes []*crdt.CausalTree
+	for k := -1; k < str.GraphemeLen(); k++ {
+		remote, err := tree.Fork()
+		if err != nil {
+			t.Fatal(err)
+		}
+		remoteStr, err := remote.StringValue(str.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		remoteCur := remoteStr.Cursor()
+		if err := remoteCur.IndexGrapheme(k); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := remoteCur.InsertString("-"); err != nil {
+			t.Fatal(err)
+		}
+		remotes = append(remotes, remote)
+	}
+	// Delete the last cluster concurrently.
+	if err := cur.DeleteGrapheme(); err != nil {
+		t.Fatal(err)
+	}
+	for _, remote := range remotes {
+		if err := tree.Merge(remote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"-", "x", "-", family, "-", "-"}
+	if diff := cmp.Diff(want, str.Graphemes()); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestGraphemeConcurrentCodepointInserts(t *testing.T) {
+	tree, str := makeString(t, "e\u0301")
+	insertAt := func(move func(cur *crdt.StringCursor) error, s string) *crdt.CausalTree {
+		remote, err := tree.Fork()
+		if err != nil {
+			t.Fatal(err)
+		}
+		remoteStr, err := remote.StringValue(str.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cur := remoteStr.Cursor()
+		if err := move(cur); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cur.InsertString(s); err != nil {
+			t.Fatal(err)
+		}
+		return remote
+	}
+	// Inserting after a codepoint in the middle of a cluster is the same as inserting after the
+	// cluster, so it isn't split.
+	r1 := insertAt(func(cur *crdt.StringCursor) error { return cur.IndexGrapheme(0) }, "-")
+	r2 := insertAt(func(cur *crdt.StringCursor) error { return cur.Index(0) }, "X")
+	for _, remote := range []*crdt.CausalTree{r1, r2} {
+		if err := tree.Merge(remote); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{"e\u0301", "X", "-"}
+	if diff := cmp.Diff(want, str.Graphemes()); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestGraphemeInsertMidCluster(t *testing.T) {
+	tests := []struct {
+		name   string
+		insert func(tree *crdt.CausalTree, str *crdt.String) error
+	}{
+		{"Insert", func(tree *crdt.CausalTree, str *crdt.String) error {
+			cur := str.Cursor()
+			if err := cur.Index(1); err != nil {
+				return err
+			}
+			_, err := cur.Insert('X')
+			return err
+		}},
+		{"InsertString", func(tree *crdt.CausalTree, str *crdt.String) error {
+			cur := str.Cursor()
+			if err := cur.Index(1); err != nil {
+				return err
+			}
+			_, err := cur.InsertString("X")
+			return err
+		}},
+		{"ReplaceRange", func(tree *crdt.CausalTree, str *crdt.String) error {
+			_, err := str.ReplaceRange(2, 2, "X")
+			return err
+		}},
+		{"InsertChar", func(tree *crdt.CausalTree, str *crdt.String) error {
+			if err := tree.SetCursor(2); err != nil {
+				return err
+			}
+			return tree.InsertChar('X')
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The insertion point is the "e", in the middle of the cluster.
+			tree, str := makeString(t, "ae\u0301\u0302b")
+			if err := test.insert(tree, str); err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"a", "e\u0301\u0302", "X", "b"}
+			if diff := cmp.Diff(want, str.Graphemes()); diff != "" {
+				t.Errorf("(-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package crdt
+
+import "fmt"
+
+// +-----------------+
+// | String iterator |
+// +-----------------+
+
+// Direction of iteration over a string.
+type Direction int
+
+// Iteration directions.
+const (
+	// Forward iterates over the chars after the starting point, in increasing position.
+	Forward Direction = iota
+	// Backward iterates over the chars before the starting point, in decreasing position.
+	Backward
+)
+
+// CharIterator walks over the chars of a string, without building a snapshot.
+//
+// Iterators start between two chars, like a caret: a forward iterator yields the chars to the
+// right of the start, and a backward iterator yields the chars to its left.
+//
+// Call Next to advance to the next char, and then Value, ID or Char to read it.
+//
+//	it, err := str.Iterator(0, crdt.Forward)
+//	for it.Next() {
+//	    fmt.Print(string(it.Value()))
+//	}
+//
+// The iterator is invalidated if the tree is modified, including by merges.
+type CharIterator struct {
+	t         *CausalTree
+	headPos   int
+	direction Direction
+	// Position of the last yielded char, or the starting point.
+	pos int
+	// Position of the next candidate, in backward iteration.
+	next      int
+	isDeleted bool
+
+	// IncludeDeleted makes the iterator yield deleted chars, too. Should be set before the first
+	// call to Next.
+	IncludeDeleted bool
+}
+
+func newCharIterator(t *CausalTree, headPos, pos int, direction Direction) *CharIterator {
+	return &CharIterator{
+		t:         t,
+		headPos:   headPos,
+		direction: direction,
+		pos:       pos,
+		next:      pos,
+	}
+}
+
+// Iterator returns an iterator starting at position i of the string, in range [0:Len()]. That
+// is, a forward iterator yields the i-th char first, and a backward iterator yields the
+// (i-1)-th char first.
+// Ignores whether the string was deleted.
+func (s *String) Iterator(i int, direction Direction) (*CharIterator, error) {
+	if i < 0 {
+		return nil, fmt.Errorf("out of bounds")
+	}
+	headPos := s.atomIndex()
+	pos := headPos
+	if i > 0 {
+		pos = s.charPos(i - 1)
+		if pos < 0 {
+			return nil, fmt.Errorf("out of bounds")
+		}
+	}
+	return newCharIterator(s.t, headPos, pos, direction), nil
+}
+
+// Iterator returns an iterator starting right after the cursor. That is, a backward iterator
+// yields the char pointed by the cursor first, if not deleted, and a forward iterator yields the
+// char after it.
+func (cur *StringCursor) Iterator(direction Direction) *CharIterator {
+	headPos := cur.GetString().atomIndex()
+	return newCharIterator(cur.t, headPos, cur.atomIndex(), direction)
+}
+
+// Next advances the iterator to the next char, returning false if there are no more chars.
+//
+// Time complexity: O(1), or, O(deleted chars) if they are skipped.
+func (it *CharIterator) Next() bool {
+	weave := it.t.Weave
+	if it.direction == Backward {
+		for it.next > it.headPos {
+			pos := it.next
+			it.next--
+			if it.visit(weave, pos) {
+				return true
+			}
+		}
+		return false
+	}
+	head := weave[it.headPos]
+	for pos := it.pos + 1; pos < len(weave); pos++ {
+		if weave[pos].Cause.Timestamp < head.ID.Timestamp {
+			// First atom whose parent is older than head is the end of the causal block.
+			break
+		}
+		if it.visit(weave, pos) {
+			return true
+		}
+	}
+	it.pos = len(weave)
+	return false
+}
+
+// Moves the iterator to pos, if it's a char that should be yielded.
+func (it *CharIterator) visit(weave []Atom, pos int) bool {
+	if _, ok := weave[pos].Value.(InsertChar); !ok {
+		return false
+	}
+	isDeleted := pos+1 < len(weave) && isDelete(weave[pos+1])
+	if isDeleted && !it.IncludeDeleted {
+		return false
+	}
+	it.pos = pos
+	it.isDeleted = isDeleted
+	return true
+}
+
+func isDelete(atom Atom) bool {
+	_, ok := atom.Value.(Delete)
+	return ok
+}
+
+// Value returns the current char value.
+func (it *CharIterator) Value() rune {
+	return it.t.Weave[it.pos].Value.(InsertChar).Char
+}
+
+// ID returns the current char's atom ID.
+func (it *CharIterator) ID() AtomID {
+	return it.t.Weave[it.pos].ID
+}
+
+// IsDeleted returns whether the current char was deleted. It's always false, unless
+// IncludeDeleted is set.
+func (it *CharIterator) IsDeleted() bool {
+	return it.isDeleted
+}
+
+// Char returns a handle for the current char, that remains valid after the tree is modified.
+func (it *CharIterator) Char() *Char {
+	return &Char{newTreePosition(it.t, it.pos), it.headPos}
+}
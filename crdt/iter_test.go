@@ -0,0 +1,100 @@
+package crdt_test
+
+import (
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+type iterItem struct {
+	Char      rune
+	IsDeleted bool
+}
+
+func collect(it *crdt.CharIterator) []iterItem {
+	var items []iterItem
+	for it.Next() {
+		items = append(items, iterItem{it.Value(), it.IsDeleted()})
+	}
+	return items
+}
+
+func TestCharIterator(t *testing.T) {
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Create another string before, such that it's placed after this one in the weave.
+	tree := crdt.NewCausalTree()
+	other, err := tree.SetString()
+	must(err)
+	_, err = other.Cursor().InsertString("xyz")
+	must(err)
+	str, err := tree.SetString()
+	must(err)
+	_, err = str.Cursor().InsertString("abcdef")
+	must(err)
+	// Delete 'b' and 'e'.
+	must(str.DeleteRange(1, 2))
+	must(str.DeleteRange(3, 4))
+	tests := []struct {
+		desc           string
+		index          int
+		direction      crdt.Direction
+		includeDeleted bool
+		want           []iterItem
+	}{
+		{"forward", 0, crdt.Forward, false, []iterItem{{'a', false}, {'c', false}, {'d', false}, {'f', false}}},
+		{"forward from middle", 2, crdt.Forward, false, []iterItem{{'d', false}, {'f', false}}},
+		{"forward from end", 4, crdt.Forward, false, nil},
+		{"backward", 4, crdt.Backward, false, []iterItem{{'f', false}, {'d', false}, {'c', false}, {'a', false}}},
+		{"backward from middle", 2, crdt.Backward, false, []iterItem{{'c', false}, {'a', false}}},
+		{"backward from start", 0, crdt.Backward, false, nil},
+		{"forward with deleted", 1, crdt.Forward, true, []iterItem{
+			{'b', true}, {'c', false}, {'d', false}, {'e', true}, {'f', false}}},
+		{"backward with deleted", 3, crdt.Backward, true, []iterItem{
+			{'d', false}, {'c', false}, {'b', true}, {'a', false}}},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			it, err := str.Iterator(test.index, test.direction)
+			must(err)
+			it.IncludeDeleted = test.includeDeleted
+			if diff := cmp.Diff(test.want, collect(it), cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("(-want, +got):\n%s", diff)
+			}
+		})
+	}
+	for _, i := range []int{-1, 5} {
+		if _, err := str.Iterator(i, crdt.Forward); err == nil {
+			t.Errorf("Iterator(%d): want error", i)
+		}
+	}
+}
+
+func TestCharIteratorFromCursor(t *testing.T) {
+	_, str := makeString(t, "abc")
+	cur := str.Cursor()
+	if err := cur.Index(1); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]iterItem{{'c', false}}, collect(cur.Iterator(crdt.Forward))); diff != "" {
+		t.Errorf("forward (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]iterItem{{'b', false}, {'a', false}}, collect(cur.Iterator(crdt.Backward))); diff != "" {
+		t.Errorf("backward (-want, +got):\n%s", diff)
+	}
+	// Handles and IDs point to the same char.
+	it := cur.Iterator(crdt.Backward)
+	if !it.Next() {
+		t.Fatal("empty iterator")
+	}
+	ch := it.Char()
+	if ch.ID() != it.ID() || ch.Snapshot() != 'b' || ch.Index() != 1 {
+		t.Errorf("Char() = %v (%q at %d), want %v ('b' at 1)", ch.ID(), ch.Snapshot(), ch.Index(), it.ID())
+	}
+}
@@ -0,0 +1,298 @@
+package crdt
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// +------------+
+// | Line index |
+// +------------+
+
+// Identifies an atom independently of the sitemap, which may be remapped by forks and merges.
+type atomKey struct {
+	site  uuid.UUID
+	index uint32
+}
+
+func (t *CausalTree) atomKey(id AtomID) atomKey {
+	return atomKey{t.Sitemap[id.Site], id.Index}
+}
+
+// lineIndex stores the lines of a string, and is updated as atoms are inserted into the weave.
+//
+// Every insertion shifts the stored positions in O(lines), and updates line lengths by looking
+// at the atoms close to the insertion, but it never walks the whole string.
+type lineIndex struct {
+	head atomKey
+	// Weave position of the string head.
+	headPos int
+	// Number of atoms in the string's causal block, excluding the head.
+	size int
+	// Weave positions of non-deleted newlines, in ascending order.
+	newlines []int
+	// Number of non-deleted chars in each line, excluding the newline. There's always one more
+	// line than newlines.
+	lengths []int
+}
+
+// Builds the line index for the string with head at the given position.
+//
+// Time complexity: O(block size)
+func newLineIndex(t *CausalTree, headPos int) *lineIndex {
+	idx := &lineIndex{
+		head:    t.atomKey(t.Weave[headPos].ID),
+		headPos: headPos,
+		size:    causalBlockSize(t.Weave[headPos:]) - 1,
+		lengths: []int{0},
+	}
+	s := &String{newTreePosition(t, headPos)}
+	s.walkChars(func(pos int, atom Atom, isDeleted bool) bool {
+		if isDeleted {
+			return true
+		}
+		if atom.Value.(InsertChar).Char == '\n' {
+			idx.newlines = append(idx.newlines, pos)
+			idx.lengths = append(idx.lengths, 0)
+		} else {
+			idx.lengths[len(idx.lengths)-1]++
+		}
+		return true
+	})
+	return idx
+}
+
+// Returns the line index of the string with head at the given position, building it if necessary.
+func (t *CausalTree) lineIndex(headPos int) *lineIndex {
+	head := t.atomKey(t.Weave[headPos].ID)
+	for _, idx := range t.lineIndexes {
+		if idx.head == head {
+			return idx
+		}
+	}
+	idx := newLineIndex(t, headPos)
+	t.lineIndexes = append(t.lineIndexes, idx)
+	return idx
+}
+
+func allPresent(pos int) bool { return true }
+
+// Updates line indices after an atom was inserted at pos.
+func (t *CausalTree) updateLineIndexes(pos int) {
+	for _, idx := range t.lineIndexes {
+		idx.insert(t.Weave, pos, allPresent)
+	}
+}
+
+// Updates line indices after new atoms were inserted in the weave all at once, as in a merge.
+//
+// New atoms are replayed as insertions in ascending order of position, so that each one is inserted
+// into a weave containing all atoms to its left. Positions to the right of the replayed atom may
+// hold new atoms that were not replayed yet, so they are ignored by the index.
+//
+// Time complexity: O(atoms + (new atoms)*(lines + avg. line size))
+func (t *CausalTree) replayLineIndexes(isNew func(pos int) bool) {
+	if len(t.lineIndexes) == 0 {
+		return
+	}
+	newAtoms := make([]bool, len(t.Weave))
+	for i := range t.Weave {
+		newAtoms[i] = isNew(i)
+	}
+	for i := range t.Weave {
+		if !newAtoms[i] {
+			continue
+		}
+		present := func(pos int) bool { return pos <= i || !newAtoms[pos] }
+		for _, idx := range t.lineIndexes {
+			idx.insert(t.Weave, i, present)
+		}
+	}
+}
+
+// Returns the size of each yarn, by site ID, if there are line indices to be updated.
+func (t *CausalTree) yarnSizes() map[uuid.UUID]uint32 {
+	if len(t.lineIndexes) == 0 {
+		return nil
+	}
+	sizes := make(map[uuid.UUID]uint32, len(t.Sitemap))
+	for i, site := range t.Sitemap {
+		sizes[site] = uint32(len(t.Yarns[i]))
+	}
+	return sizes
+}
+
+// Updates line indices with the atoms that are beyond the yarn sizes, as returned by yarnSizes
+// before the weave was changed.
+func (t *CausalTree) replayNewAtoms(sizes map[uuid.UUID]uint32) {
+	t.replayLineIndexes(func(pos int) bool {
+		id := t.Weave[pos].ID
+		return id.Index >= sizes[t.Sitemap[id.Site]]
+	})
+}
+
+// Checks whether line indices match the ones built from scratch.
+func (t *CausalTree) validateLineIndexes() error {
+	for _, idx := range t.lineIndexes {
+		want := newLineIndex(t, idx.headPos)
+		if !idx.equal(want) {
+			return fmt.Errorf("%w: line index %+v, want %+v", ErrInvalidTree, idx, want)
+		}
+	}
+	return nil
+}
+
+// Updates the index after the atom at pos was inserted. The predicate 'present' tells whether the
+// atom at some position was already inserted.
+//
+// Time complexity: O(lines + avg. line size)
+func (idx *lineIndex) insert(weave []Atom, pos int, present func(pos int) bool) {
+	// Check whether atom is within the string's causal block, before shifting positions.
+	atom := weave[pos]
+	inBlock := false
+	if pos > idx.headPos {
+		head := weave[idx.headPos]
+		end := idx.headPos + idx.size + 1
+		inBlock = pos < end || (pos == end && atom.Cause.Timestamp >= head.ID.Timestamp)
+	} else {
+		idx.headPos++
+	}
+	for i := sort.SearchInts(idx.newlines, pos); i < len(idx.newlines); i++ {
+		idx.newlines[i]++
+	}
+	if !inBlock {
+		return
+	}
+	idx.size++
+	switch v := atom.Value.(type) {
+	case InsertChar:
+		k := sort.SearchInts(idx.newlines, pos)
+		if v.Char != '\n' {
+			idx.lengths[k]++
+			return
+		}
+		// Split line k at the new newline.
+		start := idx.headPos
+		if k > 0 {
+			start = idx.newlines[k-1]
+		}
+		var n int
+		for i := start + 1; i < pos; i++ {
+			if _, ok := weave[i].Value.(InsertChar); ok && !isDeletedAt(weave, i, present) {
+				n++
+			}
+		}
+		idx.newlines = insertInt(idx.newlines, k, pos)
+		idx.lengths = insertInt(idx.lengths, k+1, idx.lengths[k]-n)
+		idx.lengths[k] = n
+	case Delete:
+		// Deletes are the first children of their cause, so the cause is the first atom to
+		// the left that isn't a Delete.
+		causePos := pos - 1
+		for {
+			if _, ok := weave[causePos].Value.(Delete); !ok {
+				break
+			}
+			causePos--
+		}
+		if causePos == idx.headPos {
+			// Deleting the string doesn't change its lines.
+			return
+		}
+		wasDeleted := isDeletedAt(weave, causePos, func(i int) bool { return i != pos && present(i) })
+		if wasDeleted {
+			return
+		}
+		k := sort.SearchInts(idx.newlines, causePos)
+		if weave[causePos].Value.(InsertChar).Char != '\n' {
+			idx.lengths[k]--
+			return
+		}
+		// Join lines k and k+1, removing the newline between them.
+		idx.lengths[k] += idx.lengths[k+1]
+		idx.newlines = append(idx.newlines[:k], idx.newlines[k+1:]...)
+		idx.lengths = append(idx.lengths[:k+1], idx.lengths[k+2:]...)
+	}
+}
+
+// Returns whether the atom at pos has a present Delete child.
+func isDeletedAt(weave []Atom, pos int, present func(pos int) bool) bool {
+	for i := pos + 1; i < len(weave); i++ {
+		if _, ok := weave[i].Value.(Delete); !ok {
+			break
+		}
+		if present(i) {
+			return true
+		}
+	}
+	return false
+}
+
+func (idx *lineIndex) equal(other *lineIndex) bool {
+	if idx.head != other.head || idx.headPos != other.headPos || idx.size != other.size {
+		return false
+	}
+	return equalInts(idx.newlines, other.newlines) && equalInts(idx.lengths, other.lengths)
+}
+
+func equalInts(xs, ys []int) bool {
+	if len(xs) != len(ys) {
+		return false
+	}
+	for i, x := range xs {
+		if x != ys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func insertInt(xs []int, i, x int) []int {
+	xs = append(xs, 0)
+	copy(xs[i+1:], xs[i:])
+	xs[i] = x
+	return xs
+}
+
+// ---- String lines
+
+func (s *String) lineIndex() *lineIndex {
+	return s.t.lineIndex(s.atomIndex())
+}
+
+// LineCount returns the number of lines in the string, which is one more than its number of
+// newlines.
+func (s *String) LineCount() int {
+	return len(s.lineIndex().lengths)
+}
+
+// LineCol returns the line and column of a string position, in range [0:Len()]. Both are
+// zero-based, and columns are counted in codepoints.
+func (s *String) LineCol(i int) (line, col int, err error) {
+	if i < 0 {
+		return -1, -1, fmt.Errorf("out of bounds")
+	}
+	for line, size := range s.lineIndex().lengths {
+		if i <= size {
+			return line, i, nil
+		}
+		i -= size + 1
+	}
+	return -1, -1, fmt.Errorf("out of bounds")
+}
+
+// PositionAt returns the string position of a line and column. Both are zero-based, and the
+// column may be at most the line size.
+func (s *String) PositionAt(line, col int) (int, error) {
+	lengths := s.lineIndex().lengths
+	if line < 0 || line >= len(lengths) || col < 0 || col > lengths[line] {
+		return -1, fmt.Errorf("out of bounds")
+	}
+	var i int
+	for _, size := range lengths[:line] {
+		i += size + 1
+	}
+	return i + col, nil
+}
@@ -0,0 +1,137 @@
+package crdt_test
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/go-cmp/cmp"
+)
+
+type lineCol struct{ Line, Col int }
+
+// Checks that line queries match the string contents.
+func checkLines(t *testing.T, str *crdt.String) {
+	t.Helper()
+	lines := strings.Split(str.Snapshot(), "\n")
+	if n := str.LineCount(); n != len(lines) {
+		t.Fatalf("%q: LineCount() = %d, want %d", str.Snapshot(), n, len(lines))
+	}
+	var want, got []lineCol
+	var i int
+	for line, text := range lines {
+		for col := 0; col <= utf8.RuneCountInString(text); col++ {
+			want = append(want, lineCol{line, col})
+			l, c, err := str.LineCol(i)
+			if err != nil {
+				t.Fatalf("%q: LineCol(%d): %v", str.Snapshot(), i, err)
+			}
+			got = append(got, lineCol{l, c})
+			if pos, err := str.PositionAt(line, col); err != nil || pos != i {
+				t.Fatalf("%q: PositionAt(%d, %d) = (%d, %v), want %d", str.Snapshot(), line, col, pos, err, i)
+			}
+			i++
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("%q: LineCol (-want, +got):\n%s", str.Snapshot(), diff)
+	}
+}
+
+func TestLines(t *testing.T) {
+	tree, str := makeString(t, "ab\ncd\n\nef")
+	checkLines(t, str)
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	insertAt := func(i int, s string) func(cur *crdt.StringCursor) error {
+		return func(cur *crdt.StringCursor) error {
+			if err := cur.Index(i - 1); err != nil {
+				return err
+			}
+			_, err := cur.InsertString(s)
+			return err
+		}
+	}
+	deleteAt := func(i int) func(cur *crdt.StringCursor) error {
+		return func(cur *crdt.StringCursor) error {
+			if err := cur.Index(i); err != nil {
+				return err
+			}
+			return cur.Delete()
+		}
+	}
+	// Local edits.
+	must(insertAt(1, "x\ny")(str.Cursor()))
+	checkLines(t, str)
+	must(deleteAt(4)(str.Cursor()))
+	checkLines(t, str)
+	must(deleteAt(2)(str.Cursor()))
+	checkLines(t, str)
+	_, err := str.ReplaceRange(2, 7, "1\n2\n3")
+	must(err)
+	checkLines(t, str)
+	must(str.DeleteRange(0, 4))
+	checkLines(t, str)
+	// Other containers don't affect the line index.
+	other, err := tree.SetString()
+	must(err)
+	_, err = other.Cursor().InsertString("z\nz")
+	must(err)
+	checkLines(t, str)
+	checkLines(t, other)
+	// Remote edits, concurrent with local edits.
+	remote, err := tree.Fork()
+	must(err)
+	remoteStr, err := remote.StringValue(str.ID())
+	must(err)
+	must(insertAt(0, "\nr\n")(remoteStr.Cursor()))
+	must(deleteAt(remoteStr.Len() - 1)(remoteStr.Cursor()))
+	must(insertAt(2, "\n")(str.Cursor()))
+	must(deleteAt(1)(str.Cursor()))
+	must(tree.Merge(remote))
+	checkLines(t, str)
+	checkLines(t, other)
+	editRemote(t, tree, str, deleteAt(0))
+	checkLines(t, str)
+	// Edits applied with a delta.
+	remote, err = tree.Fork()
+	must(err)
+	remoteStr, err = remote.StringValue(str.ID())
+	must(err)
+	must(insertAt(1, "d\ne\nl")(remoteStr.Cursor()))
+	must(deleteAt(0)(str.Cursor()))
+	must(applyDelta(tree, remote))
+	checkLines(t, str)
+}
+
+func TestLinesDeletedString(t *testing.T) {
+	tree, str := makeString(t, "a\nb")
+	checkLines(t, str)
+	if err := tree.DeleteAtom(str.ID()); err != nil {
+		t.Fatal(err)
+	}
+	checkLines(t, str)
+	if _, err := str.Cursor().InsertString("\nc"); err != nil {
+		t.Fatal(err)
+	}
+	checkLines(t, str)
+}
+
+func TestLinesOutOfBounds(t *testing.T) {
+	_, str := makeString(t, "ab\n\nc")
+	for _, i := range []int{-1, 6} {
+		if _, _, err := str.LineCol(i); err == nil {
+			t.Errorf("LineCol(%d): want error", i)
+		}
+	}
+	for _, pos := range []lineCol{{-1, 0}, {0, -1}, {0, 3}, {1, 1}, {3, 0}} {
+		if _, err := str.PositionAt(pos.Line, pos.Col); err == nil {
+			t.Errorf("PositionAt(%d, %d): want error", pos.Line, pos.Col)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package crdt
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidMark is returned when a mark can't be applied to a string.
+var ErrInvalidMark = errors.New("invalid mark")
+
+// +-------+
+// | Marks |
+// +-------+
+
+// Marks format ranges of a string with attributes, like bold, italic or links.
+//
+// A mark is an InsertMark atom whose boundaries are anchored to chars, so the marked range
+// grows and shrinks with concurrent edits. Marks are never deleted: an attribute is removed by
+// another mark with an empty value over the range. When many marks with the same name cover a
+// char, the most recent one wins.
+
+// Expand defines whether a mark extends to chars inserted at its boundaries.
+type Expand int
+
+// Expansion values are bit flags, such that ExpandBoth = ExpandBefore | ExpandAfter.
+const (
+	// ExpandNone doesn't extend the mark to chars inserted at its boundaries, e.g., for links.
+	ExpandNone Expand = iota
+	// ExpandBefore extends the mark to chars inserted right before its start.
+	ExpandBefore
+	// ExpandAfter extends the mark to chars inserted right after its end, e.g., for bold text.
+	ExpandAfter
+	// ExpandBoth extends the mark to chars inserted at both boundaries.
+	ExpandBoth
+)
+
+// Span is a sequence of chars with the same attributes.
+type Span struct {
+	Text  string            `json:"text"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+// AddMark formats the chars in range [start:end) with an attribute.
+// Returns an error if the range is empty or out of bounds [0:Len()], or if name or value are
+// empty.
+func (s *String) AddMark(start, end int, name, value string, expand Expand) error {
+	if value == "" {
+		return fmt.Errorf("%w: empty value for %q", ErrInvalidMark, name)
+	}
+	return s.addMark(start, end, name, value, expand)
+}
+
+// RemoveMark removes an attribute from the chars in range [start:end).
+//
+// The expand behavior should be the same used to add the attribute, such that chars inserted
+// at the boundaries of the range behave the same as chars within it.
+// Returns an error if the range is empty or out of bounds [0:Len()], or if name is empty.
+func (s *String) RemoveMark(start, end int, name string, expand Expand) error {
+	return s.addMark(start, end, name, "", expand)
+}
+
+func (s *String) addMark(start, end int, name, value string, expand Expand) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidMark)
+	}
+	if start < 0 || start >= end || end > s.Len() {
+		return fmt.Errorf("%w: range [%d:%d) is empty or out of bounds", ErrInvalidMark, start, end)
+	}
+	// Without expansion, the range starts right before the first char, and ends right after
+	// the last char. Expanding the start attaches it after the previous char (or head), and
+	// expanding the end attaches it before the next char (or the end of the string).
+	startBias, endBias := BiasRight, BiasLeft
+	if expand&ExpandBefore != 0 {
+		startBias = BiasLeft
+	}
+	if expand&ExpandAfter != 0 {
+		endBias = BiasRight
+	}
+	startAnchor, err := s.Anchor(start, startBias)
+	if err != nil {
+		return err
+	}
+	endAnchor, err := s.Anchor(end, endBias)
+	if err != nil {
+		return err
+	}
+	_, err = s.t.addAtom(startAnchor.atomIndex(), InsertMark{
+		Name:      name,
+		Value:     value,
+		StartBias: startBias,
+		End:       endAnchor.ID(),
+		EndBias:   endBias,
+	})
+	return err
+}
+
+// A boundary of a mark, placed at one side of an atom.
+type markBoundary struct {
+	id   AtomID
+	bias Bias
+}
+
+// Spans returns the string split in sequences of chars with the same attributes.
+// Ignores whether the string was deleted.
+//
+// Time complexity: O(block size * marks)
+func (s *String) Spans() []Span {
+	// Find marks, and where they start and end.
+	starts := make(map[markBoundary][]Atom)
+	ends := make(map[markBoundary][]Atom)
+	s.walk(func(pos int, atom Atom, isDeleted bool) bool {
+		if mark, ok := atom.Value.(InsertMark); ok {
+			start := markBoundary{atom.Cause, mark.StartBias}
+			end := markBoundary{mark.End, mark.EndBias}
+			starts[start] = append(starts[start], atom)
+			ends[end] = append(ends[end], atom)
+		}
+		return true
+	})
+	// Walk over chars, keeping the set of marks covering them.
+	var active []Atom
+	closed := make(map[AtomID]bool)
+	visit := func(b markBoundary) {
+		for _, mark := range ends[b] {
+			closed[mark.ID] = true
+			for i, other := range active {
+				if other.ID == mark.ID {
+					active = append(active[:i], active[i+1:]...)
+					break
+				}
+			}
+		}
+		for _, mark := range starts[b] {
+			if !closed[mark.ID] {
+				active = append(active, mark)
+			}
+		}
+	}
+	var spans []Span
+	var text []rune
+	var attrs map[string]string
+	flush := func() {
+		if len(text) > 0 {
+			spans = append(spans, Span{string(text), attrs})
+		}
+		text = nil
+	}
+	s.walk(func(pos int, atom Atom, isDeleted bool) bool {
+		switch v := atom.Value.(type) {
+		case InsertStr:
+			visit(markBoundary{atom.ID, BiasLeft})
+		case InsertChar:
+			visit(markBoundary{atom.ID, BiasRight})
+			if !isDeleted {
+				charAttrs := markAttributes(active)
+				if !equalAttrs(attrs, charAttrs) {
+					flush()
+					attrs = charAttrs
+				}
+				text = append(text, v.Char)
+			}
+			visit(markBoundary{atom.ID, BiasLeft})
+		}
+		return true
+	})
+	flush()
+	return spans
+}
+
+// Returns the attributes set by the most recent mark of each name.
+func markAttributes(marks []Atom) map[string]string {
+	latest := make(map[string]Atom)
+	for _, atom := range marks {
+		name := atom.Value.(InsertMark).Name
+		if other, ok := latest[name]; !ok || atom.ID.Compare(other.ID) > 0 {
+			latest[name] = atom
+		}
+	}
+	var attrs map[string]string
+	for name, atom := range latest {
+		if value := atom.Value.(InsertMark).Value; value != "" {
+			if attrs == nil {
+				attrs = make(map[string]string)
+			}
+			attrs[name] = value
+		}
+	}
+	return attrs
+}
+
+func equalAttrs(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
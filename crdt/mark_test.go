@@ -0,0 +1,235 @@
+package crdt_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/go-cmp/cmp"
+)
+
+type attrs = map[string]string
+
+// Returns a fork of the tree, and the same string in the fork.
+func forkString(t *testing.T, tree *crdt.CausalTree, str *crdt.String) (*crdt.CausalTree, *crdt.String) {
+	remote, err := tree.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteStr, err := remote.StringValue(str.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return remote, remoteStr
+}
+
+func TestMarks(t *testing.T) {
+	tree, str := makeString(t, "hello world")
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(str.AddMark(0, 5, "bold", "true", crdt.ExpandAfter))
+	must(str.AddMark(3, 8, "italic", "true", crdt.ExpandAfter))
+	must(str.AddMark(6, 11, "link", "https://example.com", crdt.ExpandNone))
+	must(str.RemoveMark(1, 2, "bold", crdt.ExpandAfter))
+	want := []crdt.Span{
+		{"h", attrs{"bold": "true"}},
+		{"e", nil},
+		{"l", attrs{"bold": "true"}},
+		{"lo", attrs{"bold": "true", "italic": "true"}},
+		{" ", attrs{"italic": "true"}},
+		{"wo", attrs{"italic": "true", "link": "https://example.com"}},
+		{"rld", attrs{"link": "https://example.com"}},
+	}
+	if diff := cmp.Diff(want, str.Spans()); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+	// Marks don't change the string contents.
+	if s := str.Snapshot(); s != "hello world" {
+		t.Errorf("Snapshot() = %q, want %q", s, "hello world")
+	}
+	if s := tree.ToString(); s != "hello world" {
+		t.Errorf("ToString() = %q, want %q", s, "hello world")
+	}
+}
+
+func TestMarksExpand(t *testing.T) {
+	tests := []struct {
+		expand crdt.Expand
+		want   []crdt.Span
+	}{
+		{crdt.ExpandNone, []crdt.Span{{"a<", nil}, {"bc", attrs{"x": "y"}}, {">d", nil}}},
+		{crdt.ExpandBefore, []crdt.Span{{"a", nil}, {"<bc", attrs{"x": "y"}}, {">d", nil}}},
+		{crdt.ExpandAfter, []crdt.Span{{"a<", nil}, {"bc>", attrs{"x": "y"}}, {"d", nil}}},
+		{crdt.ExpandBoth, []crdt.Span{{"a", nil}, {"<bc>", attrs{"x": "y"}}, {"d", nil}}},
+	}
+	for _, test := range tests {
+		_, str := makeString(t, "abcd")
+		if err := str.AddMark(1, 3, "x", "y", test.expand); err != nil {
+			t.Fatal(err)
+		}
+		// Type at the boundaries of the mark.
+		for _, edit := range []struct {
+			i  int
+			ch rune
+		}{{3, '>'}, {1, '<'}} {
+			cur := str.Cursor()
+			if err := cur.Index(edit.i - 1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := cur.Insert(edit.ch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if diff := cmp.Diff(test.want, str.Spans()); diff != "" {
+			t.Errorf("expand %d: (-want, +got):\n%s", test.expand, diff)
+		}
+	}
+}
+
+func TestMarksConcurrent(t *testing.T) {
+	tree, str := makeString(t, "hello world")
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(str.AddMark(0, 11, "color", "red", crdt.ExpandAfter))
+	remote, remoteStr := forkString(t, tree, str)
+	// Local: bold on "hello", type at its end, and delete "wor".
+	must(str.AddMark(0, 5, "bold", "true", crdt.ExpandAfter))
+	cur := str.Cursor()
+	must(cur.Index(4))
+	_, err := cur.InsertString("!")
+	must(err)
+	must(str.DeleteRange(7, 10))
+	// Remote: overlapping italic, color removed from "world", and changed in "lo w".
+	must(remoteStr.AddMark(3, 9, "italic", "true", crdt.ExpandAfter))
+	must(remoteStr.RemoveMark(6, 11, "color", crdt.ExpandAfter))
+	must(remoteStr.AddMark(3, 7, "color", "blue", crdt.ExpandAfter))
+	// Merge in both directions.
+	other, err := remote.Fork()
+	must(err)
+	must(tree.Merge(remote))
+	must(other.Merge(tree))
+	otherStr, err := other.StringValue(str.ID())
+	must(err)
+	want := []crdt.Span{
+		{"hel", attrs{"bold": "true", "color": "red"}},
+		{"lo!", attrs{"bold": "true", "color": "blue", "italic": "true"}},
+		{" ", attrs{"color": "blue", "italic": "true"}},
+		{"ld", nil},
+	}
+	if diff := cmp.Diff(want, str.Spans()); diff != "" {
+		t.Errorf("local (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, otherStr.Spans()); diff != "" {
+		t.Errorf("remote (-want, +got):\n%s", diff)
+	}
+}
+
+func TestMarkErrors(t *testing.T) {
+	_, str := makeString(t, "abc")
+	tests := []struct {
+		desc string
+		f    func() error
+	}{
+		{"empty range", func() error { return str.AddMark(1, 1, "bold", "true", crdt.ExpandNone) }},
+		{"negative start", func() error { return str.AddMark(-1, 1, "bold", "true", crdt.ExpandNone) }},
+		{"end out of bounds", func() error { return str.AddMark(0, 4, "bold", "true", crdt.ExpandNone) }},
+		{"empty name", func() error { return str.AddMark(0, 1, "", "true", crdt.ExpandNone) }},
+		{"empty value", func() error { return str.AddMark(0, 1, "bold", "", crdt.ExpandNone) }},
+		{"remove empty name", func() error { return str.RemoveMark(0, 1, "", crdt.ExpandNone) }},
+	}
+	for _, test := range tests {
+		if err := test.f(); !errors.Is(err, crdt.ErrInvalidMark) {
+			t.Errorf("%s: want %v, got %v", test.desc, crdt.ErrInvalidMark, err)
+		}
+	}
+}
+
+func TestMarksLegacyCursor(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	if err := tree.InsertStr(); err != nil {
+		t.Fatal(err)
+	}
+	for _, ch := range "abc" {
+		if err := tree.InsertChar(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	str, err := tree.StringValue(tree.Weave[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := str.AddMark(0, 2, "bold", "true", crdt.ExpandNone); err != nil {
+		t.Fatal(err)
+	}
+	// Tree positions don't count marks: 0 is the string, and 1-3 are its chars.
+	if err := tree.InsertCharAt('x', 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.DeleteAt(1); err != nil {
+		t.Fatal(err)
+	}
+	if s := tree.ToString(); s != "bxc" {
+		t.Errorf("ToString() = %q, want %q", s, "bxc")
+	}
+}
+
+func TestValidateMarks(t *testing.T) {
+	tests := []struct {
+		desc    string
+		corrupt func(mark *crdt.InsertMark, other crdt.AtomID, next crdt.AtomID)
+		want    string
+	}{
+		{"valid tree", func(mark *crdt.InsertMark, other, next crdt.AtomID) {}, ""},
+		{"end in other string", func(mark *crdt.InsertMark, other, next crdt.AtomID) {
+			mark.End = other
+		}, "ends outside of its string"},
+		{"end after mark", func(mark *crdt.InsertMark, other, next crdt.AtomID) {
+			mark.End = next
+		}, "ends outside of its string"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			tree, str := makeString(t, "abc")
+			if err := str.AddMark(0, 2, "bold", "true", crdt.ExpandNone); err != nil {
+				t.Fatal(err)
+			}
+			cur := str.Cursor()
+			if err := cur.Index(2); err != nil {
+				t.Fatal(err)
+			}
+			next, err := cur.Insert('d')
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := tree.SetString()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, atom := range tree.Weave {
+				if mark, ok := atom.Value.(crdt.InsertMark); ok {
+					test.corrupt(&mark, other.ID(), next.ID())
+					setAtom(tree, i, func(atom *crdt.Atom) { atom.Value = mark })
+				}
+			}
+			err = tree.Validate()
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("want no error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, crdt.ErrInvalidTree) || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("want error containing %q, got %v", test.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+// Package netsim simulates a network of causal tree replicas, to test replication in-process.
+//
+// Messages between replicas are delayed by a random number of ticks, so they may arrive out of
+// order. They may also be duplicated or lost, and replicas may be partitioned from each other.
+// All randomness comes from a seeded source, and replicas are always visited in the same order,
+// so a simulation is fully reproducible from its seed.
+//
+// Every event may be recorded into a trace, with the same format of the demo's debug logs, that
+// may be loaded by the debug viewer.
+package netsim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+
+	"github.com/google/uuid"
+
+	"github.com/brunokim/causal-tree/crdt"
+)
+
+// Delivery defines the contents of messages between replicas.
+type Delivery int
+
+const (
+	// MergeDelivery sends a copy of the sender's tree, which is merged into the receiver.
+	MergeDelivery Delivery = iota
+	// AtomDelivery sends only the atoms that the receiver was missing when the message was
+	// sent, which are applied as a delta. Deltas that arrive out of order may be rejected, if
+	// the receiver doesn't have their causes yet.
+	AtomDelivery
+)
+
+func (d Delivery) String() string {
+	switch d {
+	case MergeDelivery:
+		return "merge"
+	case AtomDelivery:
+		return "atoms"
+	}
+	return fmt.Sprintf("Delivery(%d)", int(d))
+}
+
+// Config sets up the network behavior. It may be changed between steps, e.g., to stop losing
+// messages at the end of a simulation.
+type Config struct {
+	// Seed for all random decisions.
+	Seed int64
+	// Range of message delays, in ticks. Each message gets a delay in [MinDelay, MaxDelay].
+	MinDelay, MaxDelay int
+	// Probability that a message is delivered twice.
+	DuplicateProb float64
+	// Probability that a message is never delivered.
+	LossProb float64
+	// Contents of messages.
+	Delivery Delivery
+	// If not nil, every event is written into the trace as a JSON line.
+	Trace io.Writer
+}
+
+// Stats counts what happened to messages.
+type Stats struct {
+	Sent       int
+	Delivered  int
+	Duplicated int
+	Lost       int
+	// Messages dropped because sender and receiver were partitioned.
+	Dropped int
+	// Deltas that couldn't be applied, because they arrived out of order.
+	Rejected int
+}
+
+// Errors returned by the network.
+var (
+	ErrReplicaExists   = errors.New("replica already exists")
+	ErrReplicaNotFound = errors.New("replica not found")
+)
+
+type message struct {
+	seq      int
+	at       int
+	from, to string
+	tree     *crdt.CausalTree
+	delta    *crdt.Delta
+}
+
+// Network of replicas identified by name.
+type Network struct {
+	Config
+	Stats Stats
+
+	rand     *rand.Rand
+	now      int
+	seq      int
+	names    []string
+	replicas map[string]*crdt.CausalTree
+	// Messages in flight, in ascending order of delivery time and sequence.
+	queue []message
+	// Partition group of each replica. If nil, there are no partitions.
+	groups map[string]int
+}
+
+// New creates an empty network.
+func New(cfg Config) *Network {
+	return &Network{
+		Config:   cfg,
+		rand:     rand.New(rand.NewSource(cfg.Seed)),
+		replicas: make(map[string]*crdt.CausalTree),
+	}
+}
+
+// Rand returns the network's source of randomness. Tests may use it to draw local operations,
+// so that the whole simulation is reproducible from the seed.
+func (n *Network) Rand() *rand.Rand {
+	return n.rand
+}
+
+// NewSiteID returns a random site ID drawn from the network's source of randomness. Use it
+// to create the initial replica, so that site IDs are reproducible from the seed.
+func (n *Network) NewSiteID() uuid.UUID {
+	var id uuid.UUID
+	n.rand.Read(id[:])
+	id[6] = (id[6] & 0x0f) | 0x40 // Version 4
+	id[8] = (id[8] & 0x3f) | 0x80 // Variant is 10
+	return id
+}
+
+// Now returns the current time, in ticks.
+func (n *Network) Now() int {
+	return n.now
+}
+
+// Names returns the names of all replicas, in the order they were added.
+func (n *Network) Names() []string {
+	names := make([]string, len(n.names))
+	copy(names, n.names)
+	return names
+}
+
+// Add includes a replica in the network.
+func (n *Network) Add(name string, t *crdt.CausalTree) error {
+	if _, ok := n.replicas[name]; ok {
+		return fmt.Errorf("%w: %q", ErrReplicaExists, name)
+	}
+	n.names = append(n.names, name)
+	n.replicas[name] = t
+	return n.trace(fmt.Sprintf("add %s", name))
+}
+
+// Replica returns the tree of a replica, or nil if it doesn't exist.
+func (n *Network) Replica(name string) *crdt.CausalTree {
+	return n.replicas[name]
+}
+
+func (n *Network) replica(name string) (*crdt.CausalTree, error) {
+	t, ok := n.replicas[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrReplicaNotFound, name)
+	}
+	return t, nil
+}
+
+// Do runs a local operation on a replica, recording it in the trace with the given description.
+func (n *Network) Do(name, desc string, f func(t *crdt.CausalTree) error) error {
+	t, err := n.replica(name)
+	if err != nil {
+		return err
+	}
+	if err := f(t); err != nil {
+		return fmt.Errorf("%s at %s: %w", desc, name, err)
+	}
+	return n.trace(fmt.Sprintf("%s at %s", desc, name))
+}
+
+// Fork creates a new replica from an existing one.
+func (n *Network) Fork(from, name string) error {
+	if _, ok := n.replicas[name]; ok {
+		return fmt.Errorf("%w: %q", ErrReplicaExists, name)
+	}
+	t, err := n.replica(from)
+	if err != nil {
+		return err
+	}
+	remote, err := t.ForkWithSiteID(n.NewSiteID())
+	if err != nil {
+		return err
+	}
+	n.names = append(n.names, name)
+	n.replicas[name] = remote
+	if n.groups != nil {
+		n.groups[name] = n.groups[from]
+	}
+	return n.trace(fmt.Sprintf("fork %s into %s", from, name))
+}
+
+// +----------+
+// | Messages |
+// +----------+
+
+// Send enqueues a message from one replica to another, with the sender's current state.
+func (n *Network) Send(from, to string) error {
+	src, err := n.replica(from)
+	if err != nil {
+		return err
+	}
+	dst, err := n.replica(to)
+	if err != nil {
+		return err
+	}
+	msg := message{from: from, to: to}
+	switch n.Delivery {
+	case MergeDelivery:
+		msg.tree, err = src.ViewAt(src.Now())
+	case AtomDelivery:
+		msg.delta, err = src.DeltaSince(dst.Sitemap, dst.Now())
+	default:
+		err = fmt.Errorf("unknown delivery %v", n.Delivery)
+	}
+	if err != nil {
+		return err
+	}
+	n.Stats.Sent++
+	if !n.connected(from, to) {
+		n.Stats.Dropped++
+		return n.trace(fmt.Sprintf("drop %s -> %s (partitioned)", from, to))
+	}
+	if n.rand.Float64() < n.LossProb {
+		n.Stats.Lost++
+		return n.trace(fmt.Sprintf("lose %s -> %s", from, to))
+	}
+	n.enqueue(msg)
+	if n.rand.Float64() < n.DuplicateProb {
+		n.Stats.Duplicated++
+		n.enqueue(msg)
+	}
+	return n.trace(fmt.Sprintf("send %s -> %s", from, to))
+}
+
+// Broadcast sends a message from a replica to every other replica.
+func (n *Network) Broadcast(from string) error {
+	for _, to := range n.names {
+		if to == from {
+			continue
+		}
+		if err := n.Send(from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Network) enqueue(msg message) {
+	delay := n.MinDelay
+	if n.MaxDelay > n.MinDelay {
+		delay += n.rand.Intn(n.MaxDelay - n.MinDelay + 1)
+	}
+	n.seq++
+	msg.seq = n.seq
+	msg.at = n.now + delay
+	i := sort.Search(len(n.queue), func(i int) bool {
+		m := n.queue[i]
+		return m.at > msg.at || (m.at == msg.at && m.seq > msg.seq)
+	})
+	n.queue = append(n.queue, message{})
+	copy(n.queue[i+1:], n.queue[i:])
+	n.queue[i] = msg
+}
+
+// Pending returns the number of messages in flight.
+func (n *Network) Pending() int {
+	return len(n.queue)
+}
+
+// Step advances the clock to the next message in flight and delivers it. Returns false if there
+// were no messages.
+func (n *Network) Step() (bool, error) {
+	if len(n.queue) == 0 {
+		return false, nil
+	}
+	msg := n.queue[0]
+	n.queue = n.queue[1:]
+	if msg.at > n.now {
+		n.now = msg.at
+	}
+	if !n.connected(msg.from, msg.to) {
+		// Partition happened while message was in flight.
+		n.Stats.Dropped++
+		return true, n.trace(fmt.Sprintf("drop %s -> %s (partitioned)", msg.from, msg.to))
+	}
+	dst := n.replicas[msg.to]
+	var err error
+	switch {
+	case msg.tree != nil:
+		err = dst.Merge(msg.tree)
+	case msg.delta != nil:
+		err = dst.ApplyDelta(msg.delta)
+		if errors.Is(err, crdt.ErrDeltaGap) || errors.Is(err, crdt.ErrDeltaMissingCause) {
+			n.Stats.Rejected++
+			return true, n.trace(fmt.Sprintf("reject %s -> %s: %v", msg.from, msg.to, err))
+		}
+	}
+	if err != nil {
+		return true, fmt.Errorf("deliver %s -> %s: %w", msg.from, msg.to, err)
+	}
+	n.Stats.Delivered++
+	return true, n.trace(fmt.Sprintf("deliver %s -> %s (%v)", msg.from, msg.to, n.Delivery))
+}
+
+// Run delivers all messages in flight.
+func (n *Network) Run() error {
+	for {
+		ok, err := n.Step()
+		if err != nil || !ok {
+			return err
+		}
+	}
+}
+
+// +------------+
+// | Partitions |
+// +------------+
+
+// Partition splits replicas into groups that can't communicate with each other. Replicas that
+// are not in any group are isolated. Messages in flight between groups are dropped.
+func (n *Network) Partition(groups ...[]string) error {
+	partition := make(map[string]int)
+	for i, group := range groups {
+		for _, name := range group {
+			if _, err := n.replica(name); err != nil {
+				return err
+			}
+			partition[name] = i + 1
+		}
+	}
+	for i, name := range n.names {
+		if _, ok := partition[name]; !ok {
+			partition[name] = -(i + 1)
+		}
+	}
+	n.groups = partition
+	return n.trace(fmt.Sprintf("partition %v", groups))
+}
+
+// Heal removes all partitions.
+func (n *Network) Heal() error {
+	n.groups = nil
+	return n.trace("heal")
+}
+
+func (n *Network) connected(a, b string) bool {
+	if n.groups == nil {
+		return true
+	}
+	return n.groups[a] == n.groups[b]
+}
+
+// +-------+
+// | Trace |
+// +-------+
+
+// Records the current state of replicas, in the format of debug logs.
+func (n *Network) trace(action string) error {
+	if n.Trace == nil {
+		return nil
+	}
+	sites := make([]*crdt.CausalTree, len(n.names))
+	for i, name := range n.names {
+		sites[i] = n.replicas[name]
+	}
+	bs, err := json.Marshal(map[string]interface{}{
+		"Type":   "test",
+		"Action": fmt.Sprintf("t=%d: %s", n.now, action),
+		"Names":  n.names,
+		"Sites":  sites,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = n.Trace.Write(append(bs, '\n'))
+	return err
+}
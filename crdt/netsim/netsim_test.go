@@ -0,0 +1,165 @@
+package netsim_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/brunokim/causal-tree/crdt/netsim"
+)
+
+var names = []string{"a", "b", "c", "d"}
+
+// Runs a chaotic simulation, and then syncs all replicas over a reliable network.
+func simulate(cfg netsim.Config) (*netsim.Network, error) {
+	n := netsim.New(cfg)
+	if err := n.Add(names[0], crdt.NewCausalTreeWithSiteID(n.NewSiteID())); err != nil {
+		return nil, err
+	}
+	for _, name := range names[1:] {
+		if err := n.Fork(names[0], name); err != nil {
+			return nil, err
+		}
+	}
+	r := n.Rand()
+	for i := 0; i < 200; i++ {
+		name := names[r.Intn(len(names))]
+		switch p := r.Float64(); {
+		case p < 0.6:
+			ch := rune('a' + r.Intn(26))
+			err := n.Do(name, fmt.Sprintf("insert %c", ch), func(t *crdt.CausalTree) error {
+				return t.InsertCharAt(ch, r.Intn(len(t.Weave)+1)-1)
+			})
+			if err != nil && !errors.Is(err, crdt.ErrCursorOutOfRange) {
+				return nil, err
+			}
+		case p < 0.7:
+			err := n.Do(name, "delete", func(t *crdt.CausalTree) error {
+				return t.DeleteAt(r.Intn(len(t.Weave) + 1))
+			})
+			if err != nil && !errors.Is(err, crdt.ErrCursorOutOfRange) {
+				return nil, err
+			}
+		case p < 0.9:
+			if err := n.Broadcast(name); err != nil {
+				return nil, err
+			}
+		case p < 0.95:
+			if err := n.Partition(names[:2], names[2:]); err != nil {
+				return nil, err
+			}
+		default:
+			if err := n.Heal(); err != nil {
+				return nil, err
+			}
+		}
+		// Deliver some messages.
+		for j := r.Intn(3); j > 0; j-- {
+			if _, err := n.Step(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Stop the chaos, and sync everyone.
+	if err := n.Run(); err != nil {
+		return nil, err
+	}
+	n.Heal()
+	n.LossProb = 0
+	for _, name := range names {
+		if err := n.Broadcast(name); err != nil {
+			return nil, err
+		}
+		if err := n.Run(); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func TestConvergence(t *testing.T) {
+	for _, delivery := range []netsim.Delivery{netsim.MergeDelivery, netsim.AtomDelivery} {
+		for seed := int64(0); seed < 10; seed++ {
+			t.Run(fmt.Sprintf("%v/seed=%d", delivery, seed), func(t *testing.T) {
+				n, err := simulate(netsim.Config{
+					Seed:          seed,
+					MinDelay:      1,
+					MaxDelay:      10,
+					DuplicateProb: 0.1,
+					LossProb:      0.2,
+					Delivery:      delivery,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := n.Replica(names[0]).ToString()
+				for _, name := range names {
+					tree := n.Replica(name)
+					if err := tree.Validate(); err != nil {
+						t.Errorf("%s: %v", name, err)
+					}
+					if got := tree.ToString(); got != want {
+						t.Errorf("%s: got %q, want %q", name, got, want)
+					}
+				}
+				if n.Stats.Lost == 0 || n.Stats.Duplicated == 0 || n.Stats.Dropped == 0 {
+					t.Errorf("expecting some lost, duplicated and dropped messages, got %+v", n.Stats)
+				}
+			})
+		}
+	}
+}
+
+func TestDeterminism(t *testing.T) {
+	run := func(seed int64) []byte {
+		var trace bytes.Buffer
+		_, err := simulate(netsim.Config{
+			Seed:          seed,
+			MaxDelay:      5,
+			DuplicateProb: 0.1,
+			LossProb:      0.1,
+			Delivery:      netsim.AtomDelivery,
+			Trace:         &trace,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return trace.Bytes()
+	}
+	trace1, trace2 := run(42), run(42)
+	if !bytes.Equal(trace1, trace2) {
+		t.Errorf("traces with same seed differ")
+	}
+	if trace3 := run(43); bytes.Equal(trace1, trace3) {
+		t.Errorf("traces with different seeds are equal")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	n := netsim.New(netsim.Config{MinDelay: 1, MaxDelay: 1})
+	n.Add("a", crdt.NewCausalTree())
+	n.Fork("a", "b")
+	n.Fork("a", "c")
+	n.Do("a", "insert x", func(t *crdt.CausalTree) error { return t.InsertChar('x') })
+	n.Broadcast("a")
+	// Message to c is in flight when it's partitioned away.
+	n.Partition([]string{"a", "b"})
+	if err := n.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.Replica("b").ToString(); got != "x" {
+		t.Errorf("b: got %q, want %q", got, "x")
+	}
+	if got := n.Replica("c").ToString(); got != "" {
+		t.Errorf("c: got %q, want empty", got)
+	}
+	want := netsim.Stats{Sent: 2, Delivered: 1, Dropped: 1}
+	if n.Stats != want {
+		t.Errorf("got stats %+v, want %+v", n.Stats, want)
+	}
+	if err := n.Send("a", "z"); !errors.Is(err, netsim.ErrReplicaNotFound) {
+		t.Errorf("want ErrReplicaNotFound, got %v", err)
+	}
+}
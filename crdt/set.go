@@ -0,0 +1,201 @@
+package crdt
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrInvalidSetElement is returned when a value can't be an element of a set.
+var ErrInvalidSetElement = errors.New("invalid set element")
+
+// +------+
+// | Sets |
+// +------+
+
+// Sets are unordered collections of scalar elements, with observed-remove semantics.
+//
+// Each addition is an InsertSetAdd atom, child of the set head, and an element is a member while
+// any of its additions is not deleted. Removing an element deletes all of its additions seen by
+// the site, so an addition made concurrently with the removal is kept: the add wins.
+//
+// Elements are bools, int64 or strings. Other integer types are converted to int64, so that
+// Add(1) and Add(int64(1)) add the same element.
+
+// Set is a Value representing a set of scalar elements.
+type Set struct{ treePosition }
+
+func (*Set) isValue() {}
+
+// Returns the element as a valid set element, converting integers to int64.
+func setElement(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case bool, int64, string:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case int32:
+		return int64(v), nil
+	default:
+		return nil, fmt.Errorf("%w: %T (%v)", ErrInvalidSetElement, value, value)
+	}
+}
+
+// Returns an error if the value is not a stored set element: a bool, int64 or string.
+func checkSetElement(value interface{}) error {
+	switch value.(type) {
+	case bool, int64, string:
+		return nil
+	default:
+		return fmt.Errorf("%w: %T (%v)", ErrInvalidSetElement, value, value)
+	}
+}
+
+// Returns the sort rank of an element's type: bools first, then numbers, then strings.
+func elementRank(value interface{}) int {
+	switch value.(type) {
+	case bool:
+		return 0
+	case int64:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Returns whether element a is sorted before b.
+func elementLess(a, b interface{}) bool {
+	ra, rb := elementRank(a), elementRank(b)
+	if ra != rb {
+		return ra < rb
+	}
+	switch v := a.(type) {
+	case bool:
+		return !v && b.(bool)
+	case int64:
+		return v < b.(int64)
+	default:
+		return v.(string) < b.(string)
+	}
+}
+
+// Inserts value into the sorted slice of members, if it's not there already.
+func insertMember(members []interface{}, value interface{}) []interface{} {
+	i := sort.Search(len(members), func(i int) bool { return !elementLess(members[i], value) })
+	if i < len(members) && members[i] == value {
+		return members
+	}
+	members = append(members, nil)
+	copy(members[i+1:], members[i:])
+	members[i] = value
+	return members
+}
+
+// Invokes f with the weave position and value of each addition that wasn't removed.
+func (s *Set) walkAdds(f func(pos int, value interface{}) bool) {
+	s.walk(func(pos int, atom Atom, isDeleted bool) bool {
+		switch v := atom.Value.(type) {
+		case InsertSet:
+		case InsertSetAdd:
+			if !isDeleted {
+				return f(pos, v.Value)
+			}
+		default:
+			panic(fmt.Sprintf("unexpected atom type in Set: %T", atom.Value))
+		}
+		return true
+	})
+}
+
+// Add adds an element to the set.
+// Returns an error if the value is not a bool, integer or string.
+func (s *Set) Add(value interface{}) error {
+	elem, err := setElement(value)
+	if err != nil {
+		return err
+	}
+	_, err = s.t.addAtom(s.atomIndex(), InsertSetAdd{elem})
+	return err
+}
+
+// Remove removes an element from the set, if present.
+// Returns an error if the value is not a bool, integer or string.
+func (s *Set) Remove(value interface{}) error {
+	elem, err := setElement(value)
+	if err != nil {
+		return err
+	}
+	var positions []int
+	s.walkAdds(func(pos int, value interface{}) bool {
+		if value == elem {
+			positions = append(positions, pos)
+		}
+		return true
+	})
+	if len(positions) == 0 {
+		return nil
+	}
+	return s.t.deleteAtoms(positions)
+}
+
+// Contains returns whether the value is an element of the set.
+func (s *Set) Contains(value interface{}) bool {
+	elem, err := setElement(value)
+	if err != nil {
+		return false
+	}
+	var found bool
+	s.walkAdds(func(pos int, value interface{}) bool {
+		found = value == elem
+		return !found
+	})
+	return found
+}
+
+// Members returns the set elements, sorted with bools first, then numbers, then strings.
+// Ignores whether the set was deleted.
+func (s *Set) Members() []interface{} {
+	var members []interface{}
+	s.walkAdds(func(pos int, value interface{}) bool {
+		members = insertMember(members, value)
+		return true
+	})
+	return members
+}
+
+// Snapshot returns the set elements, as in Members.
+func (s *Set) Snapshot() []interface{} {
+	return s.Members()
+}
+
+// Len returns the number of elements in the set.
+func (s *Set) Len() int {
+	return len(s.Members())
+}
+
+// ---- CausalTree methods
+
+// SetValue returns a wrapper over InsertSet.
+func (t *CausalTree) SetValue(atomID AtomID) (*Set, error) {
+	i, err := t.findAtom(atomID)
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 {
+		return nil, fmt.Errorf("%v is not an InsertSet atom: root", atomID)
+	}
+	atom := t.Weave[i]
+	if _, ok := atom.Value.(InsertSet); !ok {
+		return nil, fmt.Errorf("%v is not an InsertSet atom: %T (%v)", atomID, atom, atom)
+	}
+	return &Set{newTreePosition(t, i)}, nil
+}
+
+// SetSet sets the tree register to a new set and returns it.
+func (t *CausalTree) SetSet() (*Set, error) {
+	i, err := t.addAtom(-1, InsertSet{})
+	if err != nil {
+		return nil, err
+	}
+	return &Set{newTreePosition(t, i)}, nil
+}
@@ -0,0 +1,161 @@
+package crdt_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSet(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	set, err := tree.SetSet()
+	must(err)
+	for _, elem := range []interface{}{"b", 2, true, "a", int64(-1), 2, "b", false} {
+		must(set.Add(elem))
+	}
+	must(set.Remove("a"))
+	must(set.Remove(false))
+	must(set.Remove("not a member"))
+	want := []interface{}{true, int64(-1), int64(2), "b"}
+	if diff := cmp.Diff(want, set.Members()); diff != "" {
+		t.Errorf("Members() (-want, +got):\n%s", diff)
+	}
+	if n := set.Len(); n != 4 {
+		t.Errorf("Len() = %d, want 4", n)
+	}
+	for _, test := range []struct {
+		elem interface{}
+		want bool
+	}{
+		{"b", true}, {2, true}, {int64(2), true}, {int32(2), true},
+		{"a", false}, {false, false}, {"2", false}, {2.0, false},
+	} {
+		if got := set.Contains(test.elem); got != test.want {
+			t.Errorf("Contains(%#v) = %t, want %t", test.elem, got, test.want)
+		}
+	}
+	// Sets are rendered as sorted arrays.
+	_, err = tree.SetSet()
+	must(err)
+	bs, err := tree.ToJSON()
+	must(err)
+	var wantData, gotData interface{}
+	must(json.Unmarshal([]byte(`[[], [true, -1, 2, "b"]]`), &wantData))
+	must(json.Unmarshal(bs, &gotData))
+	if diff := cmp.Diff(wantData, gotData); diff != "" {
+		t.Errorf("ToJSON() (-want, +got):\n%s", diff)
+	}
+	if s := tree.ToString(); s != "true-12b" {
+		t.Errorf("ToString() = %q, want %q", s, "true-12b")
+	}
+	must(tree.Validate())
+}
+
+func TestSetAddWins(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	set, err := tree.SetSet()
+	must(err)
+	must(set.Add("x"))
+	must(set.Add("y"))
+	remote, err := tree.Fork()
+	must(err)
+	remoteSet, err := remote.SetValue(set.ID())
+	must(err)
+	// Concurrent remove and re-add of "x": the add wins.
+	must(set.Remove("x"))
+	must(remoteSet.Add("x"))
+	// Concurrent removes of "y": it's removed.
+	must(set.Remove("y"))
+	must(remoteSet.Remove("y"))
+	// Remove of an element unseen by the site doesn't affect it.
+	must(remoteSet.Add("z"))
+	must(set.Remove("z"))
+
+	other, err := remote.Fork()
+	must(err)
+	must(tree.Merge(remote))
+	must(other.Merge(tree))
+	otherSet, err := other.SetValue(set.ID())
+	must(err)
+	want := []interface{}{"x", "z"}
+	if diff := cmp.Diff(want, set.Members()); diff != "" {
+		t.Errorf("local (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want, otherSet.Members()); diff != "" {
+		t.Errorf("remote (-want, +got):\n%s", diff)
+	}
+	// Once observed, all additions are removed together.
+	must(set.Remove("x"))
+	if set.Contains("x") {
+		t.Errorf("Contains(%q) after removal", "x")
+	}
+}
+
+func TestSetErrors(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	set, err := tree.SetSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, elem := range []interface{}{nil, 1.5, []int{1}, uint(1)} {
+		if err := set.Add(elem); !errors.Is(err, crdt.ErrInvalidSetElement) {
+			t.Errorf("Add(%#v): want %v, got %v", elem, crdt.ErrInvalidSetElement, err)
+		}
+		if err := set.Remove(elem); !errors.Is(err, crdt.ErrInvalidSetElement) {
+			t.Errorf("Remove(%#v): want %v, got %v", elem, crdt.ErrInvalidSetElement, err)
+		}
+	}
+	if _, err := tree.SetValue(set.ID()); err != nil {
+		t.Errorf("SetValue(%v): %v", set.ID(), err)
+	}
+	str, err := tree.SetString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.SetValue(str.ID()); err == nil {
+		t.Errorf("SetValue(%v): want error for string", str.ID())
+	}
+}
+
+func TestSetInvalidRemoteElement(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	set, err := tree.SetSet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Add("x"); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := tree.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := tree.DeltaSince(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Slices are not comparable, and must be rejected before atoms are compared.
+	setAtom(remote, 1, func(atom *crdt.Atom) { atom.Value = crdt.InsertSetAdd{Value: []string{"x"}} })
+	if err := tree.Merge(remote); !errors.Is(err, crdt.ErrInvalidTree) {
+		t.Errorf("Merge: want %v, got %v", crdt.ErrInvalidTree, err)
+	}
+	d.Yarns[0][1].Value = crdt.InsertSetAdd{Value: []string{"x"}}
+	if err := tree.ApplyDelta(d); !errors.Is(err, crdt.ErrDeltaInvalid) {
+		t.Errorf("ApplyDelta: want %v, got %v", crdt.ErrDeltaInvalid, err)
+	}
+}
@@ -0,0 +1,226 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/brunokim/causal-tree/crdt"
+)
+
+const (
+	snapshotFilename = "snapshot.json"
+	atomsFilename    = "atoms.jsonl"
+)
+
+// DirStore keeps each document in a subdirectory of a root directory.
+//
+// A document directory contains a snapshot file with a JSON-encoded delta, and a JSONL file
+// with one delta per line, for each call to AppendAtoms since the last snapshot.
+//
+// Appended atoms are checked against the stored ones before being written, so that a bad
+// append is rejected instead of making the document unloadable. This requires reading the
+// whole document, so snapshots should be saved periodically to keep appends fast.
+type DirStore struct {
+	mu   sync.Mutex
+	root string
+}
+
+// NewDirStore creates a store at the given directory, creating it if necessary.
+func NewDirStore(root string) (*DirStore, error) {
+	if err := os.MkdirAll(root, 0777); err != nil {
+		return nil, err
+	}
+	return &DirStore{root: root}, nil
+}
+
+func (s *DirStore) docDir(name string) (string, error) {
+	if err := checkName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, name), nil
+}
+
+// List returns the names of all stored documents, in ascending order.
+func (s *DirStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// LoadYarns returns all atoms stored for a document.
+func (s *DirStore) LoadYarns(name string) (*crdt.Delta, error) {
+	dir, err := s.docDir(name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, err := s.load(dir)
+	if err != nil {
+		return nil, err
+	}
+	return allAtoms(doc), nil
+}
+
+// Reads snapshot and appended atoms into a tree.
+func (s *DirStore) load(dir string) (*crdt.CausalTree, error) {
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	doc := crdt.NewCausalTree()
+	// Read snapshot, if it exists.
+	bs, err := os.ReadFile(filepath.Join(dir, snapshotFilename))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		var d crdt.Delta
+		if err := json.Unmarshal(bs, &d); err != nil {
+			return nil, fmt.Errorf("reading snapshot: %w", err)
+		}
+		if err := doc.ApplyDelta(&d); err != nil {
+			return nil, fmt.Errorf("applying snapshot: %w", err)
+		}
+	}
+	// Read appended atoms, if they exist.
+	f, err := os.Open(filepath.Join(dir, atomsFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return doc, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var d crdt.Delta
+		if err := json.Unmarshal(line, &d); err != nil {
+			return nil, fmt.Errorf("reading %s:%d: %w", atomsFilename, lineno, err)
+		}
+		if err := doc.ApplyDelta(&d); err != nil {
+			return nil, fmt.Errorf("applying %s:%d: %w", atomsFilename, lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// AppendAtoms adds atoms to a document, creating it if it doesn't exist.
+// Returns an error, without writing anything, if the atoms can't be applied to the document.
+func (s *DirStore) AppendAtoms(name string, delta *crdt.Delta) error {
+	dir, err := s.docDir(name)
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(delta)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, err := s.load(dir)
+	if errors.Is(err, ErrNotFound) {
+		doc, err = crdt.NewCausalTree(), nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := doc.ApplyDelta(delta); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	if delta.Len() == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(dir, atomsFilename), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(bs, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SaveSnapshot stores every atom of the tree, together with the stored ones, in a single
+// snapshot file.
+func (s *DirStore) SaveSnapshot(name string, t *crdt.CausalTree) error {
+	dir, err := s.docDir(name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, err := s.load(dir)
+	if errors.Is(err, ErrNotFound) {
+		doc, err = crdt.NewCausalTree(), os.MkdirAll(dir, 0777)
+	}
+	if err != nil {
+		return err
+	}
+	if err := doc.ApplyDelta(allAtoms(t)); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(allAtoms(doc))
+	if err != nil {
+		return err
+	}
+	// Write snapshot atomically, and only then remove appended atoms. If the process stops
+	// in-between, atoms will be repeated in both files, which is harmless.
+	tmpFilename := filepath.Join(dir, snapshotFilename+".tmp")
+	if err := os.WriteFile(tmpFilename, bs, 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFilename, filepath.Join(dir, snapshotFilename)); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, atomsFilename)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Delete removes a document.
+func (s *DirStore) Delete(name string) error {
+	dir, err := s.docDir(name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/brunokim/causal-tree/crdt"
+)
+
+// MemoryStore keeps documents in memory, and is mainly useful for tests and demos.
+type MemoryStore struct {
+	mu sync.Mutex
+	// Each document is kept as a tree that accumulates all atoms. Its own site is never
+	// used, so it's not part of loaded yarns.
+	docs map[string]*crdt.CausalTree
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{docs: make(map[string]*crdt.CausalTree)}
+}
+
+// List returns the names of all stored documents, in ascending order.
+func (s *MemoryStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.docs))
+	for name := range s.docs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LoadYarns returns all atoms stored for a document.
+func (s *MemoryStore) LoadYarns(name string) (*crdt.Delta, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, ok := s.docs[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return allAtoms(doc), nil
+}
+
+// AppendAtoms adds atoms to a document, creating it if it doesn't exist.
+// Returns an error, without changing the document, if the atoms can't be applied to it.
+func (s *MemoryStore) AppendAtoms(name string, delta *crdt.Delta) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	doc, ok := s.docs[name]
+	if !ok {
+		doc = crdt.NewCausalTree()
+	}
+	if err := doc.ApplyDelta(delta); err != nil {
+		return err
+	}
+	s.docs[name] = doc
+	return nil
+}
+
+// SaveSnapshot stores every atom of the tree in a document.
+func (s *MemoryStore) SaveSnapshot(name string, t *crdt.CausalTree) error {
+	return s.AppendAtoms(name, allAtoms(t))
+}
+
+// Delete removes a document.
+func (s *MemoryStore) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.docs[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.docs, name)
+	return nil
+}
@@ -0,0 +1,95 @@
+// Package store provides persistence backends for causal trees.
+//
+// A document is stored as the set of yarns of every site that edited it. Backends only need
+// to append new atoms as they are created, and occasionally compact them into a snapshot,
+// without knowing anything about the tree's internals.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/brunokim/causal-tree/crdt"
+)
+
+// Store persists documents as sets of yarns.
+//
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// List returns the names of all stored documents, in ascending order.
+	List() ([]string, error)
+	// LoadYarns returns all atoms stored for a document.
+	LoadYarns(name string) (*crdt.Delta, error)
+	// AppendAtoms adds atoms to a document, creating it if it doesn't exist.
+	// Atoms that are already stored are ignored. If the atoms can't be applied to the
+	// stored ones, e.g., because they don't continue from them, an error is returned and
+	// the document is left untouched.
+	AppendAtoms(name string, delta *crdt.Delta) error
+	// SaveSnapshot stores every atom of the tree in a document, compacting previous appends.
+	SaveSnapshot(name string, t *crdt.CausalTree) error
+	// Delete removes a document.
+	Delete(name string) error
+}
+
+// Errors returned by stores.
+var (
+	ErrNotFound    = errors.New("document not found")
+	ErrInvalidName = errors.New("invalid document name")
+)
+
+// Load creates a new tree with the contents of a stored document.
+//
+// The tree is a new site, as if it were forked from the stored document.
+func Load(s Store, name string) (*crdt.CausalTree, error) {
+	d, err := s.LoadYarns(name)
+	if err != nil {
+		return nil, err
+	}
+	t := crdt.NewCausalTree()
+	if err := t.ApplyDelta(d); err != nil {
+		return nil, fmt.Errorf("loading %q: %w", name, err)
+	}
+	return t, nil
+}
+
+// AppendSince stores the atoms of a tree that were created after the given weft, and
+// returns the tree's current weft.
+//
+// It's meant to be called periodically, passing the returned weft to the next call.
+// If the tree learned about new sites in the meantime, the weft is not valid anymore and
+// all atoms are stored again, which is harmless since stores ignore known atoms.
+func AppendSince(s Store, name string, t *crdt.CausalTree, weft crdt.Weft) (crdt.Weft, error) {
+	var d *crdt.Delta
+	if len(weft) == len(t.Sitemap) {
+		// The sitemap only grows, so a weft with the same length refers to the same sites.
+		var err error
+		if d, err = t.DeltaSince(t.Sitemap, weft); err != nil {
+			return nil, err
+		}
+	} else {
+		d = allAtoms(t)
+	}
+	if err := s.AppendAtoms(name, d); err != nil {
+		return nil, err
+	}
+	return t.Now(), nil
+}
+
+// Checks whether name may be used as a document name.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// Returns a copy of all atoms in the tree.
+func allAtoms(t *crdt.CausalTree) *crdt.Delta {
+	d, err := t.DeltaSince(nil, nil)
+	if err != nil {
+		// Unreachable: an empty weft always has the same length as the empty sitemap.
+		panic(err)
+	}
+	return d
+}
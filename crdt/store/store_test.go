@@ -0,0 +1,239 @@
+package store_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/brunokim/causal-tree/crdt/store"
+)
+
+// Conformance tests that every Store implementation must pass.
+func testStore(t *testing.T, newStore func(t *testing.T) store.Store) {
+	insertString := func(t *testing.T, tree *crdt.CausalTree, s string) {
+		for _, ch := range s {
+			if err := tree.InsertChar(ch); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	checkLoad := func(t *testing.T, s store.Store, name, want string) {
+		tree, err := store.Load(s, name)
+		if err != nil {
+			t.Fatalf("Load(%q): %v", name, err)
+		}
+		if got := tree.ToString(); got != want {
+			t.Errorf("Load(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		s := newStore(t)
+		names, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 0 {
+			t.Errorf("List() = %v, want empty", names)
+		}
+		if _, err := s.LoadYarns("doc"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("LoadYarns: want ErrNotFound, got %v", err)
+		}
+		if err := s.Delete("doc"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("Delete: want ErrNotFound, got %v", err)
+		}
+	})
+	t.Run("InvalidNames", func(t *testing.T) {
+		s := newStore(t)
+		for _, name := range []string{"", ".", "..", "a/b", `a\b`, "a\x00b"} {
+			if _, err := s.LoadYarns(name); !errors.Is(err, store.ErrInvalidName) {
+				t.Errorf("LoadYarns(%q): want ErrInvalidName, got %v", name, err)
+			}
+			if err := s.AppendAtoms(name, &crdt.Delta{}); !errors.Is(err, store.ErrInvalidName) {
+				t.Errorf("AppendAtoms(%q): want ErrInvalidName, got %v", name, err)
+			}
+			if err := s.SaveSnapshot(name, crdt.NewCausalTree()); !errors.Is(err, store.ErrInvalidName) {
+				t.Errorf("SaveSnapshot(%q): want ErrInvalidName, got %v", name, err)
+			}
+			if err := s.Delete(name); !errors.Is(err, store.ErrInvalidName) {
+				t.Errorf("Delete(%q): want ErrInvalidName, got %v", name, err)
+			}
+		}
+	})
+	t.Run("AppendAtoms", func(t *testing.T) {
+		s := newStore(t)
+		tree := crdt.NewCausalTree()
+		var weft crdt.Weft
+		var err error
+		for _, word := range []string{"hello", " ", "world"} {
+			insertString(t, tree, word)
+			if weft, err = store.AppendSince(s, "doc", tree, weft); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkLoad(t, s, "doc", "hello world")
+		// Appending the same atoms again is harmless.
+		if _, err := store.AppendSince(s, "doc", tree, nil); err != nil {
+			t.Fatal(err)
+		}
+		checkLoad(t, s, "doc", "hello world")
+	})
+	t.Run("RejectedAppend", func(t *testing.T) {
+		s := newStore(t)
+		tree := crdt.NewCausalTree()
+		insertString(t, tree, "abc")
+		weft := tree.Now()
+		insertString(t, tree, "def")
+		weft2 := tree.Now()
+		insertString(t, tree, "ghi")
+		// Atoms that don't continue from the stored ones are rejected, even for a new document.
+		gapped, err := tree.DeltaSince(tree.Sitemap, weft)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AppendAtoms("doc", gapped); !errors.Is(err, crdt.ErrDeltaGap) {
+			t.Errorf("AppendAtoms(gapped): want %v, got %v", crdt.ErrDeltaGap, err)
+		}
+		if _, err := s.LoadYarns("doc"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("LoadYarns after rejected append: want ErrNotFound, got %v", err)
+		}
+		if _, err := store.AppendSince(s, "doc", tree, nil); err != nil {
+			t.Fatal(err)
+		}
+		// Malformed atoms are rejected, and the document is still loadable.
+		malformed, err := tree.DeltaSince(tree.Sitemap, weft2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		malformed.Yarns[0][0].Cause = crdt.AtomID{Site: 1, Index: 0, Timestamp: 1}
+		if err := s.AppendAtoms("doc", malformed); !errors.Is(err, crdt.ErrDeltaInvalid) {
+			t.Errorf("AppendAtoms(malformed): want %v, got %v", crdt.ErrDeltaInvalid, err)
+		}
+		checkLoad(t, s, "doc", "abcdefghi")
+	})
+	t.Run("SaveSnapshot", func(t *testing.T) {
+		s := newStore(t)
+		tree := crdt.NewCausalTree()
+		insertString(t, tree, "crdt")
+		weft, err := store.AppendSince(s, "doc", tree, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree.DeleteAt(3)
+		insertString(t, tree, "s are")
+		if err := s.SaveSnapshot("doc", tree); err != nil {
+			t.Fatal(err)
+		}
+		checkLoad(t, s, "doc", "crds are")
+		// Appends after a snapshot are kept.
+		insertString(t, tree, " nice")
+		if _, err := store.AppendSince(s, "doc", tree, weft); err != nil {
+			t.Fatal(err)
+		}
+		checkLoad(t, s, "doc", "crds are nice")
+	})
+	t.Run("ConcurrentSites", func(t *testing.T) {
+		s := newStore(t)
+		t1 := crdt.NewCausalTree()
+		insertString(t, t1, "crdt is nice")
+		t2, _ := t1.Fork()
+		if err := s.SaveSnapshot("doc", t1); err != nil {
+			t.Fatal(err)
+		}
+		// Both sites edit the document and store their changes, without syncing.
+		weft1, weft2 := t1.Now(), t2.Now()
+		t1.SetCursor(3)
+		insertString(t, t1, "s")
+		t2.DeleteAt(11)
+		t2.DeleteAt(10)
+		t2.DeleteAt(9)
+		t2.DeleteAt(8)
+		insertString(t, t2, "cool")
+		if _, err := store.AppendSince(s, "doc", t1, weft1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.AppendSince(s, "doc", t2, weft2); err != nil {
+			t.Fatal(err)
+		}
+		checkLoad(t, s, "doc", "crdts is cool")
+		// Loaded trees are equivalent to merging both sites.
+		if err := t1.Merge(t2); err != nil {
+			t.Fatal(err)
+		}
+		d, err := s.LoadYarns("doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := t1.DeltaSince(nil, nil)
+		if diff := cmp.Diff(want, d); diff != "" {
+			t.Errorf("LoadYarns (-want, +got):\n%s", diff)
+		}
+	})
+	t.Run("ListAndDelete", func(t *testing.T) {
+		s := newStore(t)
+		for _, name := range []string{"b", "c", "a"} {
+			tree := crdt.NewCausalTree()
+			insertString(t, tree, name)
+			if err := s.SaveSnapshot(name, tree); err != nil {
+				t.Fatal(err)
+			}
+		}
+		names, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{"a", "b", "c"}, names); diff != "" {
+			t.Errorf("List (-want, +got):\n%s", diff)
+		}
+		if err := s.Delete("b"); err != nil {
+			t.Fatal(err)
+		}
+		names, _ = s.List()
+		if diff := cmp.Diff([]string{"a", "c"}, names); diff != "" {
+			t.Errorf("List after delete (-want, +got):\n%s", diff)
+		}
+		if _, err := s.LoadYarns("b"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("LoadYarns after delete: want ErrNotFound, got %v", err)
+		}
+		checkLoad(t, s, "c", "c")
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) store.Store {
+		return store.NewMemoryStore()
+	})
+}
+
+func TestDirStore(t *testing.T) {
+	testStore(t, func(t *testing.T) store.Store {
+		s, err := store.NewDirStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
+
+func TestDirStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s1, _ := store.NewDirStore(dir)
+	tree := crdt.NewCausalTree()
+	for _, ch := range "persistent" {
+		tree.InsertChar(ch)
+	}
+	if _, err := store.AppendSince(s1, "doc", tree, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s2, _ := store.NewDirStore(dir)
+	loaded, err := store.Load(s2, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.ToString(); got != "persistent" {
+		t.Errorf("got %q, want %q", got, "persistent")
+	}
+}
@@ -0,0 +1,312 @@
+// Package sync implements an anti-entropy protocol to replicate causal trees between peers.
+//
+// The protocol is symmetric, and runs over any reliable byte stream, like a net.Conn:
+//
+//  1. each peer sends a hello message with the protocol version, and its tree's sitemap and
+//     weft, as returned by Now();
+//  2. each peer computes which atoms are missing at the other side, and sends them in
+//     chunks, in causal order;
+//  3. each peer sends a done message after its last chunk.
+//
+// Each chunk is applied atomically as soon as it's received. If the connection drops, the
+// atoms already received are kept, and a new sync will only exchange the remaining ones,
+// since it always starts from the peers' current wefts.
+//
+// Messages are framed with a 4-byte big-endian length, followed by a JSON payload.
+package sync
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	gosync "sync"
+
+	"github.com/google/uuid"
+
+	"github.com/brunokim/causal-tree/crdt"
+)
+
+// ProtocolVersion is the version of the sync protocol. Peers only sync if they use the same version.
+const ProtocolVersion = 1
+
+// MaxFrameSize is the maximum size of a message, in bytes.
+const MaxFrameSize = 64 << 20
+
+// DefaultChunkSize is the default number of atoms sent in each message.
+const DefaultChunkSize = 1024
+
+// Errors returned by the sync protocol.
+var (
+	ErrVersionMismatch   = errors.New("peers have different protocol versions")
+	ErrFrameTooLarge     = errors.New("message is larger than MaxFrameSize")
+	ErrUnexpectedMessage = errors.New("unexpected message")
+
+	// Returned by the writer when Sync has already returned.
+	errSyncStopped = errors.New("sync stopped")
+)
+
+// +----------+
+// | Messages |
+// +----------+
+
+type messageType string
+
+const (
+	helloMsg messageType = "hello"
+	atomsMsg messageType = "atoms"
+	doneMsg  messageType = "done"
+)
+
+type message struct {
+	Type messageType `json:"type"`
+	// Fields of hello message.
+	Version int         `json:"version,omitempty"`
+	Sitemap []uuid.UUID `json:"sitemap,omitempty"`
+	Weft    crdt.Weft   `json:"weft,omitempty"`
+	// Fields of atoms message.
+	Delta *crdt.Delta `json:"delta,omitempty"`
+}
+
+func writeMessage(w io.Writer, msg *message) error {
+	bs, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(bs) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, 4+len(bs))
+	binary.BigEndian.PutUint32(frame, uint32(len(bs)))
+	copy(frame[4:], bs)
+	_, err = w.Write(frame)
+	return err
+}
+
+func readMessage(r io.Reader) (*message, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	bs := make([]byte, size)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	msg := new(message)
+	if err := json.Unmarshal(bs, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// +------+
+// | Peer |
+// +------+
+
+// Peer is a replica that may be synced with other peers.
+//
+// A peer guards its tree with a mutex, so it may sync with several peers concurrently.
+type Peer struct {
+	mu   gosync.Mutex
+	tree *crdt.CausalTree
+
+	// ChunkSize is the maximum number of atoms sent per message.
+	ChunkSize int
+}
+
+// NewPeer creates a peer for the given tree. The tree should only be accessed with Update
+// from now on.
+func NewPeer(tree *crdt.CausalTree) *Peer {
+	return &Peer{tree: tree, ChunkSize: DefaultChunkSize}
+}
+
+// Update runs f with exclusive access to the peer's tree.
+func (p *Peer) Update(f func(t *crdt.CausalTree) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return f(p.tree)
+}
+
+// Stats reports the number of atoms exchanged during a sync.
+type Stats struct {
+	Sent, Received int
+}
+
+// Sync exchanges missing atoms with a remote peer that is also running Sync at the other end
+// of the connection. When it returns without error, both trees have the same atoms, unless
+// they were edited concurrently.
+//
+// If an error occurs and conn implements io.Closer, it's closed to unblock the remote peer.
+// Otherwise, Sync returns without waiting for pending writes, and no more messages are written
+// to conn after the current one.
+func (p *Peer) Sync(conn io.ReadWriter) (Stats, error) {
+	type writeResult struct {
+		sent int
+		err  error
+	}
+	// Messages are written in a separate goroutine, so that both peers may write at the same
+	// time over unbuffered connections. The writer stops once done is closed.
+	remoteHello := make(chan *message, 1)
+	writeDone := make(chan writeResult, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		sent, err := p.write(conn, remoteHello, done)
+		writeDone <- writeResult{sent, err}
+	}()
+	received, err := p.read(conn, remoteHello)
+	if err != nil {
+		close(remoteHello)
+		closer, ok := conn.(io.Closer)
+		if !ok {
+			// Can't unblock a pending write, so we don't wait for the writer.
+			return Stats{Received: received}, err
+		}
+		closer.Close()
+		result := <-writeDone
+		return Stats{Sent: result.sent, Received: received}, err
+	}
+	result := <-writeDone
+	stats := Stats{Sent: result.sent, Received: received}
+	if result.err != nil {
+		if closer, ok := conn.(io.Closer); ok {
+			closer.Close()
+		}
+		return stats, result.err
+	}
+	return stats, nil
+}
+
+// Sends hello, waits for the remote hello, and sends the missing atoms in chunks.
+// Stops before writing each message if done is closed.
+func (p *Peer) write(w io.Writer, remoteHello <-chan *message, done <-chan struct{}) (int, error) {
+	send := func(msg *message) error {
+		select {
+		case <-done:
+			return errSyncStopped
+		default:
+			return writeMessage(w, msg)
+		}
+	}
+	p.mu.Lock()
+	hello := &message{
+		Type:    helloMsg,
+		Version: ProtocolVersion,
+		Sitemap: append([]uuid.UUID(nil), p.tree.Sitemap...),
+		Weft:    p.tree.Now(),
+	}
+	p.mu.Unlock()
+	if err := send(hello); err != nil {
+		return 0, err
+	}
+	var remote *message
+	select {
+	case msg, ok := <-remoteHello:
+		if !ok {
+			return 0, nil
+		}
+		remote = msg
+	case <-done:
+		return 0, errSyncStopped
+	}
+	p.mu.Lock()
+	delta, err := p.tree.DeltaSince(remote.Sitemap, remote.Weft)
+	p.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	var sent int
+	for _, chunk := range splitDelta(delta, p.ChunkSize) {
+		if err := send(&message{Type: atomsMsg, Delta: chunk}); err != nil {
+			return sent, err
+		}
+		sent += chunk.Len()
+	}
+	return sent, send(&message{Type: doneMsg})
+}
+
+// Receives hello, forwards it to the writer, and applies received chunks until done.
+func (p *Peer) read(r io.Reader, remoteHello chan<- *message) (int, error) {
+	msg, err := readMessage(r)
+	if err != nil {
+		return 0, err
+	}
+	if msg.Type != helloMsg {
+		return 0, fmt.Errorf("%w: want %q, got %q", ErrUnexpectedMessage, helloMsg, msg.Type)
+	}
+	if msg.Version != ProtocolVersion {
+		return 0, fmt.Errorf("%w: local=%d, remote=%d", ErrVersionMismatch, ProtocolVersion, msg.Version)
+	}
+	if len(msg.Sitemap) != len(msg.Weft) {
+		return 0, crdt.ErrWeftInvalidLength
+	}
+	remoteHello <- msg
+	var received int
+	for {
+		msg, err := readMessage(r)
+		if err != nil {
+			return received, err
+		}
+		switch msg.Type {
+		case atomsMsg:
+			if msg.Delta == nil {
+				return received, fmt.Errorf("%w: atoms message without delta", ErrUnexpectedMessage)
+			}
+			err := p.Update(func(t *crdt.CausalTree) error {
+				return t.ApplyDelta(msg.Delta)
+			})
+			if err != nil {
+				return received, err
+			}
+			received += msg.Delta.Len()
+		case doneMsg:
+			return received, nil
+		default:
+			return received, fmt.Errorf("%w: want %q or %q, got %q", ErrUnexpectedMessage, atomsMsg, doneMsg, msg.Type)
+		}
+	}
+}
+
+// Splits a delta into chunks of at most n atoms, such that each chunk may be applied
+// after the previous ones.
+//
+// Atoms are sent in timestamp order, so that an atom's cause is always in the same or a
+// previous chunk.
+func splitDelta(d *crdt.Delta, n int) []*crdt.Delta {
+	if n <= 0 {
+		n = DefaultChunkSize
+	}
+	var atoms []crdt.Atom
+	for _, yarn := range d.Yarns {
+		atoms = append(atoms, yarn...)
+	}
+	sort.Slice(atoms, func(i, j int) bool {
+		return atoms[i].ID.Compare(atoms[j].ID) < 0
+	})
+	var chunks []*crdt.Delta
+	for len(atoms) > 0 {
+		size := n
+		if size > len(atoms) {
+			size = len(atoms)
+		}
+		chunk := &crdt.Delta{
+			Sitemap: d.Sitemap,
+			Yarns:   make([][]crdt.Atom, len(d.Sitemap)),
+		}
+		for _, atom := range atoms[:size] {
+			chunk.Yarns[atom.ID.Site] = append(chunk.Yarns[atom.ID.Site], atom)
+		}
+		chunks = append(chunks, chunk)
+		atoms = atoms[size:]
+	}
+	return chunks
+}
@@ -0,0 +1,249 @@
+package sync_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/brunokim/causal-tree/crdt"
+	crdtsync "github.com/brunokim/causal-tree/crdt/sync"
+)
+
+type syncResult struct {
+	stats crdtsync.Stats
+	err   error
+}
+
+// Runs Sync at both ends of a pipe.
+func syncPeers(p1, p2 *crdtsync.Peer, c1, c2 net.Conn) (syncResult, syncResult) {
+	done := make(chan syncResult)
+	go func() {
+		stats, err := p2.Sync(c2)
+		done <- syncResult{stats, err}
+	}()
+	stats, err := p1.Sync(c1)
+	r1 := syncResult{stats, err}
+	r2 := <-done
+	return r1, r2
+}
+
+func insertString(t *testing.T, tree *crdt.CausalTree, s string) {
+	for _, ch := range s {
+		if err := tree.InsertChar(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func snapshot(p *crdtsync.Peer) string {
+	var s string
+	p.Update(func(t *crdt.CausalTree) error {
+		s = t.ToString()
+		return nil
+	})
+	return s
+}
+
+func TestSync(t *testing.T) {
+	t1 := crdt.NewCausalTree()
+	insertString(t, t1, "crdt is nice")
+	t2, _ := t1.Fork()
+	t3, _ := t2.Fork()
+
+	// t1: crdt is nice -> crdts is nice
+	t1.SetCursor(3)
+	insertString(t, t1, "s")
+	// t2: crdt is nice -> crdt is cool
+	for i := 0; i < 4; i++ {
+		t2.DeleteAt(8)
+	}
+	insertString(t, t2, "cool")
+	// t3: crdt is nice -> crdt is nice!
+	t3.SetCursor(11)
+	insertString(t, t3, "!")
+
+	p1, p2, p3 := crdtsync.NewPeer(t1), crdtsync.NewPeer(t2), crdtsync.NewPeer(t3)
+	p2.ChunkSize = 2
+
+	// Sync p1 <-> p2, then p2 <-> p3, then p1 <-> p2 again.
+	pairs := []struct {
+		local, remote *crdtsync.Peer
+	}{
+		{p1, p2},
+		{p2, p3},
+		{p1, p2},
+	}
+	for i, pair := range pairs {
+		c1, c2 := net.Pipe()
+		r1, r2 := syncPeers(pair.local, pair.remote, c1, c2)
+		if r1.err != nil || r2.err != nil {
+			t.Fatalf("sync #%d: errors: %v, %v", i, r1.err, r2.err)
+		}
+		if r1.stats.Sent != r2.stats.Received || r2.stats.Sent != r1.stats.Received {
+			t.Errorf("sync #%d: stats don't match: %+v, %+v", i, r1.stats, r2.stats)
+		}
+		c1.Close()
+		c2.Close()
+	}
+	want := "crdts is cool!"
+	for i, p := range []*crdtsync.Peer{p1, p2, p3} {
+		if got := snapshot(p); got != want {
+			t.Errorf("peer #%d: got %q, want %q", i+1, got, want)
+		}
+	}
+
+	// Syncing converged peers exchanges nothing.
+	c1, c2 := net.Pipe()
+	r1, r2 := syncPeers(p1, p3, c1, c2)
+	if r1.err != nil || r2.err != nil {
+		t.Fatalf("errors: %v, %v", r1.err, r2.err)
+	}
+	if r1.stats != (crdtsync.Stats{}) || r2.stats != (crdtsync.Stats{}) {
+		t.Errorf("want empty stats, got %+v, %+v", r1.stats, r2.stats)
+	}
+}
+
+// Conn that fails after writing a number of messages.
+type flakyConn struct {
+	net.Conn
+	numWrites int
+}
+
+func (c *flakyConn) Write(bs []byte) (int, error) {
+	if c.numWrites == 0 {
+		c.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	c.numWrites--
+	return c.Conn.Write(bs)
+}
+
+func TestSyncResume(t *testing.T) {
+	t1 := crdt.NewCausalTree()
+	t2, _ := t1.Fork()
+	insertString(t, t1, "a long text to be sent in many chunks")
+
+	p1, p2 := crdtsync.NewPeer(t1), crdtsync.NewPeer(t2)
+	p1.ChunkSize = 5
+
+	// Drop connection after sending hello and 3 chunks.
+	c1, c2 := net.Pipe()
+	r1, r2 := syncPeers(p1, p2, &flakyConn{c1, 4}, c2)
+	if r1.err == nil || r2.err == nil {
+		t.Fatalf("want errors, got %v, %v", r1.err, r2.err)
+	}
+	if r2.stats.Received != 15 {
+		t.Errorf("want 15 atoms received before failure, got %d", r2.stats.Received)
+	}
+	if got := snapshot(p2); got != "a long text to " {
+		t.Errorf("partial sync: got %q", got)
+	}
+
+	// Resume sync, sending only the remaining atoms.
+	c1, c2 = net.Pipe()
+	r1, r2 = syncPeers(p1, p2, c1, c2)
+	if r1.err != nil || r2.err != nil {
+		t.Fatalf("errors: %v, %v", r1.err, r2.err)
+	}
+	if r1.stats.Sent != 22 {
+		t.Errorf("want 22 atoms sent after resuming, got %d", r1.stats.Sent)
+	}
+	if got, want := snapshot(p2), snapshot(p1); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSyncVersionMismatch(t *testing.T) {
+	p1 := crdtsync.NewPeer(crdt.NewCausalTree())
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	done := make(chan error)
+	go func() {
+		_, err := p1.Sync(c1)
+		done <- err
+	}()
+	// Send a hello from the future, and discard whatever p1 sends.
+	go io.Copy(io.Discard, c2)
+	payload := []byte(`{"type": "hello", "version": 1000, "sitemap": [], "weft": []}`)
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	c2.Write(header)
+	c2.Write(payload)
+
+	if err := <-done; !errors.Is(err, crdtsync.ErrVersionMismatch) {
+		t.Errorf("want ErrVersionMismatch, got %v", err)
+	}
+}
+
+// Conn that doesn't implement io.Closer, reading from a fixed buffer. Writes after the first
+// one block until release is closed.
+type blockingConn struct {
+	r         io.Reader
+	release   chan struct{}
+	mu        gosync.Mutex
+	numWrites int
+}
+
+func (c *blockingConn) Read(bs []byte) (int, error) {
+	return c.r.Read(bs)
+}
+
+func (c *blockingConn) Write(bs []byte) (int, error) {
+	c.mu.Lock()
+	c.numWrites++
+	n := c.numWrites
+	c.mu.Unlock()
+	if n > 1 {
+		<-c.release
+	}
+	return len(bs), nil
+}
+
+func (c *blockingConn) writes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.numWrites
+}
+
+func TestSyncStopsWriterWithoutCloser(t *testing.T) {
+	tree := crdt.NewCausalTree()
+	insertString(t, tree, "many chunks")
+	p := crdtsync.NewPeer(tree)
+	p.ChunkSize = 1
+
+	// Remote sends hello, and fails in the middle of the next message.
+	var buf bytes.Buffer
+	payload := []byte(`{"type": "hello", "version": 1, "sitemap": [], "weft": []}`)
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	buf.Write(header)
+	buf.Write(payload)
+	binary.BigEndian.PutUint32(header, 100)
+	buf.Write(header)
+	buf.WriteString(`{"type"`)
+
+	numGoroutines := runtime.NumGoroutine()
+	conn := &blockingConn{r: &buf, release: make(chan struct{})}
+	if _, err := p.Sync(conn); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("want %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	// Unblock the pending write: the writer must stop instead of sending the remaining chunks.
+	close(conn.release)
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > numGoroutines && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > numGoroutines {
+		t.Errorf("writer goroutine leaked: %d goroutines, want %d", n, numGoroutines)
+	}
+	if n := conn.writes(); n > 2 {
+		t.Errorf("want at most 2 writes (hello and a chunk), got %d", n)
+	}
+}
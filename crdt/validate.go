@@ -0,0 +1,255 @@
+package crdt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidTree is returned by Validate when a tree breaks some structural invariant.
+var ErrInvalidTree = errors.New("invalid tree")
+
+// +------------+
+// | Validation |
+// +------------+
+
+// Validate checks the structural invariants of the tree:
+//
+//   - the sitemap is sorted and contains this tree's site, with one yarn per site;
+//   - each atom in a yarn belongs to its site, with its position as index and increasing
+//     timestamps, up to the tree's timestamp;
+//   - the weave and the yarns contain exactly the same atoms;
+//   - every atom appears to the right of its cause, and has a higher timestamp;
+//   - causal blocks are contiguous, that is, the weave is a depth-first traversal of the tree;
+//   - siblings are sorted in descending order, according to Atom.Compare;
+//   - every atom is a valid child of its cause;
+//   - marks are within a string, and end at an older atom of the same string;
+//   - counters have a known overflow policy;
+//   - rights are transferred only within bounded counters, with positive values, additions
+//     to bounded counters are not deleted, and no site spends more rights than it was given;
+//   - set elements are bools, int64 or strings;
+//   - annotations are children of the root, and start and end at older chars of the same string;
+//   - the cursor points to an existing atom.
+//
+// Time complexity: O(atoms + sites)
+func (t *CausalTree) Validate() error {
+	if err := t.validateSitemap(); err != nil {
+		return err
+	}
+	if err := t.validateYarns(); err != nil {
+		return err
+	}
+	return t.validateWeave()
+}
+
+func invalidTreef(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidTree, fmt.Sprintf(format, args...))
+}
+
+func (t *CausalTree) validateSitemap() error {
+	if len(t.Sitemap) != len(t.Yarns) {
+		return invalidTreef("sitemap has %d sites, but there are %d yarns", len(t.Sitemap), len(t.Yarns))
+	}
+	for i := 1; i < len(t.Sitemap); i++ {
+		if bytes.Compare(t.Sitemap[i-1][:], t.Sitemap[i][:]) >= 0 {
+			return invalidTreef("sitemap is not sorted at #%d: %v >= %v", i, t.Sitemap[i-1], t.Sitemap[i])
+		}
+	}
+	i := siteIndex(t.Sitemap, t.SiteID)
+	if i == len(t.Sitemap) || t.Sitemap[i] != t.SiteID {
+		return invalidTreef("site ID %v is not in sitemap", t.SiteID)
+	}
+	return nil
+}
+
+func (t *CausalTree) validateYarns() error {
+	for i, yarn := range t.Yarns {
+		var last uint32
+		for j, atom := range yarn {
+			if atom.ID.Site != uint16(i) || atom.ID.Index != uint32(j) {
+				return invalidTreef("atom %v is at position %d of yarn #%d", atom, j, i)
+			}
+			if atom.ID.Timestamp <= last {
+				return invalidTreef("atom %v has a timestamp <= the previous one in yarn #%d (%d)", atom, i, last)
+			}
+			last = atom.ID.Timestamp
+			// Set elements must be checked before comparing atoms, since values of other types
+			// may not be comparable.
+			if add, ok := atom.Value.(InsertSetAdd); ok {
+				if err := checkSetElement(add.Value); err != nil {
+					return invalidTreef("atom %v: %v", atom, err)
+				}
+			}
+		}
+		if last > t.Timestamp {
+			return invalidTreef("yarn #%d has timestamp %d, greater than the tree's (%d)", i, last, t.Timestamp)
+		}
+	}
+	return nil
+}
+
+func (t *CausalTree) validateWeave() error {
+	var numAtoms int
+	for _, yarn := range t.Yarns {
+		numAtoms += len(yarn)
+	}
+	if numAtoms != len(t.Weave) {
+		return invalidTreef("yarns have %d atoms, but the weave has %d", numAtoms, len(t.Weave))
+	}
+	// Stack of ancestors of the current atom, starting with the root.
+	// The weave is a depth-first traversal iff the cause of every atom is in this stack.
+	root := Atom{}
+	stack := []Atom{root}
+	// Last visited child of each atom, to check sibling order.
+	lastChild := make(map[AtomID]Atom)
+	// Position of each visited atom, to look up atoms referenced by marks and annotations.
+	positions := make(map[AtomID]int, len(t.Weave))
+	// Closest container of each atom (including itself), and marks and annotations to be checked
+	// after the traversal.
+	container := make(map[AtomID]Atom, len(t.Weave))
+	var marks, annotations []int
+	// Rights of each site in each bounded counter, to be checked after the traversal.
+	var boundedCounters []AtomID
+	rights := make(map[AtomID]map[uuid.UUID]*counterSum)
+	for i, atom := range t.Weave {
+		if atom.ID.Timestamp == 0 || int(atom.ID.Site) >= len(t.Yarns) || int(atom.ID.Index) >= len(t.Yarns[atom.ID.Site]) {
+			return invalidTreef("weave atom #%d %v is not in yarns", i, atom)
+		}
+		if yarnAtom := t.Yarns[atom.ID.Site][atom.ID.Index]; yarnAtom != atom {
+			return invalidTreef("weave atom #%d %v differs from yarn atom %v", i, atom, yarnAtom)
+		}
+		if _, ok := positions[atom.ID]; ok {
+			return invalidTreef("weave atom #%d %v is repeated", i, atom)
+		}
+		positions[atom.ID] = i
+		// Find cause in stack.
+		for len(stack) > 0 && stack[len(stack)-1].ID != atom.Cause {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			if _, ok := positions[atom.Cause]; ok {
+				return invalidTreef("weave atom #%d %v is not contiguous with its cause's causal block", i, atom)
+			}
+			return invalidTreef("weave atom #%d %v appears before its cause", i, atom)
+		}
+		cause := stack[len(stack)-1]
+		if atom.ID.Timestamp <= atom.Cause.Timestamp {
+			return invalidTreef("weave atom #%d %v has a timestamp <= its cause's", i, atom)
+		}
+		if cause.ID.Timestamp == 0 {
+			if _, ok := atom.Value.(Delete); ok {
+				return invalidTreef("weave atom #%d %v deletes the root", i, atom)
+			}
+		} else if err := cause.Value.ValidateChild(atom.Value); err != nil {
+			return invalidTreef("weave atom #%d %v: %v", i, atom, err)
+		}
+		if sibling, ok := lastChild[atom.Cause]; ok && sibling.Compare(atom) <= 0 {
+			return invalidTreef("weave atom #%d %v is sorted after its sibling %v", i, atom, sibling)
+		}
+		lastChild[atom.Cause] = atom
+		stack = append(stack, atom)
+		if isContainer(atom) {
+			container[atom.ID] = atom
+		} else {
+			container[atom.ID] = container[atom.Cause]
+		}
+		switch atom.Value.(type) {
+		case InsertMark:
+			marks = append(marks, i)
+		case InsertCounter:
+			counter := atom.Value.(InsertCounter)
+			if _, err := counter.Overflow.MarshalText(); err != nil {
+				return invalidTreef("weave atom #%d %v: %v", i, atom, err)
+			}
+			if counter.Bounded {
+				boundedCounters = append(boundedCounters, atom.ID)
+				rights[atom.ID] = make(map[uuid.UUID]*counterSum)
+			}
+		case InsertAdd:
+			if r, ok := rights[container[atom.Cause].ID]; ok {
+				siteRights(r, t.Sitemap[atom.ID.Site]).add(atom.Value.(InsertAdd).Value)
+			}
+		case Delete:
+			if _, ok := cause.Value.(InsertAdd); ok {
+				if counter, ok := container[cause.ID].Value.(InsertCounter); ok && counter.Bounded {
+					return invalidTreef("weave atom #%d %v deletes an addition to a bounded counter", i, atom)
+				}
+			}
+		case InsertTransfer:
+			if counter, ok := cause.Value.(InsertCounter); !ok || !counter.Bounded {
+				return invalidTreef("weave atom #%d %v is not within a bounded counter", i, atom)
+			}
+			v := atom.Value.(InsertTransfer)
+			if v.Value <= 0 {
+				return invalidTreef("weave atom #%d %v transfers a non-positive value", i, atom)
+			}
+			r := rights[cause.ID]
+			siteRights(r, t.Sitemap[atom.ID.Site]).add(-v.Value)
+			siteRights(r, v.To).add(v.Value)
+		case InsertAnnotation:
+			if atom.Cause.Timestamp != 0 {
+				return invalidTreef("weave atom #%d %v is not a child of the root", i, atom)
+			}
+			annotations = append(annotations, i)
+		}
+	}
+	// Sites only spend rights they have seen, which are all in the tree, so their rights are
+	// never negative.
+	for _, id := range boundedCounters {
+		for _, site := range t.Sitemap {
+			if r, ok := rights[id][site]; ok && r.value() < 0 {
+				return invalidTreef("site %v has negative rights (%d) in bounded counter %v", site, r.value(), id)
+			}
+		}
+	}
+	for _, i := range marks {
+		atom := t.Weave[i]
+		if _, ok := container[atom.ID].Value.(InsertStr); !ok {
+			return invalidTreef("weave atom #%d %v is not within a string", i, atom)
+		}
+		end := atom.Value.(InsertMark).End
+		if end.Timestamp >= atom.ID.Timestamp || container[end] != container[atom.ID] {
+			return invalidTreef("weave atom #%d %v ends outside of its string", i, atom)
+		}
+		switch v := t.Weave[positions[end]].Value.(type) {
+		case InsertChar, InsertStr:
+		default:
+			return invalidTreef("weave atom #%d %v ends at %T (%v)", i, atom, v, v)
+		}
+	}
+	for _, i := range annotations {
+		atom := t.Weave[i]
+		v := atom.Value.(InsertAnnotation)
+		for _, id := range []AtomID{v.Start, v.End} {
+			pos, ok := positions[id]
+			if id.Timestamp >= atom.ID.Timestamp || !ok {
+				return invalidTreef("weave atom #%d %v references unknown char %v", i, atom, id)
+			}
+			if _, ok := t.Weave[pos].Value.(InsertChar); !ok {
+				return invalidTreef("weave atom #%d %v references non-char %v", i, atom, id)
+			}
+		}
+		if _, ok := container[v.Start].Value.(InsertStr); !ok || container[v.Start] != container[v.End] {
+			return invalidTreef("weave atom #%d %v is not within a single string", i, atom)
+		}
+	}
+	if _, ok := positions[t.Cursor]; t.Cursor.Timestamp != 0 && !ok {
+		return invalidTreef("cursor %v is not in weave", t.Cursor)
+	}
+	return nil
+}
+
+// Panics if the tree is invalid, in debug builds.
+func (t *CausalTree) mustValidate() {
+	if !validateMerge {
+		return
+	}
+	if err := t.Validate(); err != nil {
+		panic(err)
+	}
+	if err := t.validateLineIndexes(); err != nil {
+		panic(err)
+	}
+}
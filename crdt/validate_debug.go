@@ -0,0 +1,7 @@
+//go:build crdtdebug
+// +build crdtdebug
+
+package crdt
+
+// Debug builds validate the tree after every merge, panicking if it's invalid.
+const validateMerge = true
@@ -0,0 +1,7 @@
+//go:build !crdtdebug
+// +build !crdtdebug
+
+package crdt
+
+// Build with the 'crdtdebug' tag to validate the tree after every merge.
+const validateMerge = false
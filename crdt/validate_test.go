@@ -0,0 +1,137 @@
+package crdt_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/brunokim/causal-tree/crdt"
+	"github.com/google/uuid"
+)
+
+// Returns a tree with weave "a x y b c ⌫", where "xy" was inserted by a second site.
+func makeValidateTree(t *testing.T) *crdt.CausalTree {
+	t0 := crdt.NewCausalTree()
+	for _, ch := range "abc" {
+		if err := t0.InsertChar(ch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t1, err := t0.Fork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := t0.DeleteAt(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := t1.InsertCharAt('x', 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := t1.InsertChar('y'); err != nil {
+		t.Fatal(err)
+	}
+	if err := t0.Merge(t1); err != nil {
+		t.Fatal(err)
+	}
+	if got := weaveString(t0); got != "axybc⌫ " {
+		t.Fatalf("unexpected weave %q", got)
+	}
+	return t0
+}
+
+func weaveString(t *crdt.CausalTree) string {
+	var sb strings.Builder
+	for _, atom := range t.Weave {
+		fmt.Fprint(&sb, atom.Value)
+	}
+	return sb.String()
+}
+
+// Replaces the i-th atom in the weave, and the corresponding atom in yarns.
+func setAtom(t *crdt.CausalTree, i int, f func(atom *crdt.Atom)) {
+	id := t.Weave[i].ID
+	f(&t.Weave[i])
+	atom := t.Weave[i]
+	t.Yarns[id.Site][id.Index] = atom
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		desc    string
+		corrupt func(t *crdt.CausalTree)
+		want    string
+	}{
+		{"valid tree", func(t *crdt.CausalTree) {}, ""},
+		{"unsorted sitemap", func(t *crdt.CausalTree) {
+			t.Sitemap[0], t.Sitemap[1] = t.Sitemap[1], t.Sitemap[0]
+		}, "sitemap is not sorted"},
+		{"missing yarn", func(t *crdt.CausalTree) {
+			t.Yarns = t.Yarns[:1]
+		}, "sitemap has 2 sites, but there are 1 yarns"},
+		{"unknown site ID", func(t *crdt.CausalTree) {
+			t.SiteID = uuid.MustParse("ffffffff-ffff-ffff-ffff-ffffffffffff")
+		}, "is not in sitemap"},
+		{"wrong index in yarn", func(t *crdt.CausalTree) {
+			t.Yarns[0][1].ID.Index = 2
+		}, "is at position 1"},
+		{"decreasing timestamp in yarn", func(t *crdt.CausalTree) {
+			t.Yarns[0][1].ID.Timestamp = 1
+		}, "timestamp <= the previous one"},
+		{"timestamp greater than tree's", func(t *crdt.CausalTree) {
+			t.Timestamp = 2
+		}, "greater than the tree's"},
+		{"missing atom in weave", func(t *crdt.CausalTree) {
+			t.Weave = t.Weave[:len(t.Weave)-1]
+		}, "yarns have 6 atoms, but the weave has 5"},
+		{"weave differs from yarn", func(t *crdt.CausalTree) {
+			t.Weave[1].Value = crdt.InsertChar{Char: 'z'}
+		}, "differs from yarn atom"},
+		{"atom before its cause", func(t *crdt.CausalTree) {
+			t.Weave[0], t.Weave[1] = t.Weave[1], t.Weave[0]
+		}, "appears before its cause"},
+		{"non-contiguous causal block", func(t *crdt.CausalTree) {
+			// a x y b c ⌫ --> a x b c y ⌫
+			y := t.Weave[2]
+			copy(t.Weave[2:], t.Weave[3:5])
+			t.Weave[4] = y
+		}, "is not contiguous"},
+		{"timestamp <= cause's", func(t *crdt.CausalTree) {
+			setAtom(t, 1, func(atom *crdt.Atom) { atom.ID.Timestamp = 1 })
+		}, "has a timestamp <= its cause's"},
+		{"wrong sibling order", func(t *crdt.CausalTree) {
+			// a x y b c ⌫ --> a b c ⌫ x y
+			x, y := t.Weave[1], t.Weave[2]
+			copy(t.Weave[1:], t.Weave[3:])
+			t.Weave[4], t.Weave[5] = x, y
+		}, "is sorted after its sibling"},
+		{"invalid child", func(t *crdt.CausalTree) {
+			setAtom(t, 2, func(atom *crdt.Atom) { atom.Value = crdt.InsertCounter{} })
+		}, "invalid atom value after InsertChar"},
+		{"deleted root", func(t *crdt.CausalTree) {
+			setAtom(t, 0, func(atom *crdt.Atom) { atom.Value = crdt.Delete{} })
+		}, "deletes the root"},
+		{"cursor not in weave", func(t *crdt.CausalTree) {
+			t.Cursor = crdt.AtomID{Site: 0, Index: 99, Timestamp: 99}
+		}, "is not in weave"},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			tree := makeValidateTree(t)
+			test.corrupt(tree)
+			err := tree.Validate()
+			if test.want == "" {
+				if err != nil {
+					t.Fatalf("want no error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, crdt.ErrInvalidTree) {
+				t.Fatalf("want ErrInvalidTree, got %v", err)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("want error containing %q, got %v", test.want, err)
+			}
+		})
+	}
+}
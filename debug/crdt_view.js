@@ -78,7 +78,7 @@ export class Crdt {
         $("<div>")
           .addClass("state")
           .append($("<h2>").append(this.renderTitle(state)))
-          .append(this.renderSites(state["Sites"]))
+          .append(this.renderSites(state["Sites"], state["Names"]))
       );
   }
 
@@ -95,26 +95,31 @@ export class Crdt {
       case "forkStep":
         return `Fork tree #${state["LocalIdx"]} into tree #${state["RemoteIdx"]}`;
       case "syncStep":
+        if (state["Request"].auto) {
+          return `Auto-merge tree #${state["LocalIdx"]} from tree #${state["RemoteIdx"]}`;
+        }
         return `Merge tree #${state["LocalIdx"]} from tree #${state["RemoteIdx"]}`;
     }
     return "";
   }
 
-  renderSites(sites) {
+  // Sites may be named, as in network simulation traces.
+  renderSites(sites, names) {
     let siteEls = [];
     let i = 0;
     for (let site of sites) {
-      siteEls.push(this.renderSite(site, i));
+      let title = names ? names[i] : `Tree #${i}`;
+      siteEls.push(this.renderSite(site, title));
       i++;
     }
     return siteEls;
   }
 
-  renderSite(site, i) {
+  renderSite(site, title) {
     let index = site["Sitemap"].indexOf(site["SiteID"]);
     return $("<div>")
       .addClass("site")
-      .append($("<h3>").append(`Tree #${i}`))
+      .append($("<h3>").append(title))
       .append($("<h4>").append("Sitemap"))
       .append(
         $("<ol>")
@@ -98,6 +98,19 @@ func TestDiff(t *testing.T) {
 				{Op: diff.Delete, Char: 'g'},
 			},
 		},
+		{
+			s1: "olá, 😀",
+			s2: "olé 😀",
+			want: []diff.Operation{
+				{Op: diff.Keep, Char: 'o'},
+				{Op: diff.Keep, Char: 'l'},
+				{Op: diff.Insert, Char: 'é'},
+				{Op: diff.Delete, Char: 'á'},
+				{Op: diff.Delete, Char: ','},
+				{Op: diff.Keep, Char: ' '},
+				{Op: diff.Keep, Char: '😀'},
+			},
+		},
 	}
 	ignoreDist := cmpopts.IgnoreFields(diff.Operation{}, "Dist")
 	for _, test := range tests {